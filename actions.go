@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//defaultActionTimeout is how long an HTTP action can take, set Timeout on
+//the action to change it
+const defaultActionTimeout = 10 * time.Second
+
+//actionResponseLimit is how much of the response we read
+const actionResponseLimit = 1 << 20
+
+//builtinIntents are the intents Cortex knows, an action can't use them
+var builtinIntents = []string{
+	"lights", "temperature", "convert", "github", "github_close", "github_label", "create_issue", "undo", "history",
+}
+
+//ActionConfig is an intent Cortex runs by calling a url, from the Actions
+//setting. URL, Headers, Body, Reply and ErrorReply are Go templates over
+//actionData. Requires are the entities Cortex asks for when the message
+//doesn't have them. Editing a chat message doesn't call the url again,
+//unless RunOnEdit says it is safe to.
+type ActionConfig struct {
+	Method     string
+	URL        string
+	Headers    map[string]string
+	Token      string `cortex:"secret"`
+	Body       string
+	Reply      string
+	ErrorReply string
+	Requires   []string
+	Timeout    string
+	RunOnEdit  bool
+}
+
+//actionData is what the templates of an action see. Entities are the ones
+//Wit found, as it sends them. Status and Response are only there for Reply
+//and ErrorReply, Response is the json the url answered, or its text, and
+//Error is what went wrong, for ErrorReply.
+type actionData struct {
+	Intent     string
+	Confidence float64
+	Text       string
+	Entities   map[string]interface{}
+	Status     int
+	Response   interface{}
+	Error      string
+}
+
+var actionFuncs = template.FuncMap{
+	"json":  actionJSON,
+	"value": entityValue,
+	"get":   jsonPath,
+}
+
+//actionJSON writes a value as json, so {"text": {{json .Text}}} is valid
+//whatever the text has
+func actionJSON(v interface{}) (string, error) {
+	text, err := json.Marshal(v)
+	return string(text), err
+}
+
+//entityValue gives you the value of an entity, Wit sends some as a list
+//and some as a single one, with the value in "value". Missing entities are
+//empty strings, so they don't show up as <no value> in a reply.
+func entityValue(entity interface{}) interface{} {
+	if list, ok := entity.([]interface{}); ok {
+		if len(list) == 0 {
+			return ""
+		}
+		entity = list[0]
+	}
+	if fields, ok := entity.(map[string]interface{}); ok {
+		entity = fields["value"]
+	}
+	if entity == nil {
+		return ""
+	}
+	return entity
+}
+
+//jsonPath finds a value in decoded json by a path like "builds.0.url",
+//numbers are list indexes. It gives you an empty string when there is
+//nothing there.
+func jsonPath(v interface{}, path string) interface{} {
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+		switch node := v.(type) {
+		case map[string]interface{}:
+			v = node[part]
+		case []interface{}:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(node) {
+				return ""
+			}
+			v = node[i]
+		default:
+			return ""
+		}
+	}
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+func parseActionTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(actionFuncs).Option("missingkey=zero").Parse(text)
+}
+
+func executeActionTemplate(name, text string, data actionData) (string, error) {
+	tmpl, err := parseActionTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+//actionProblems checks the templates parse, for validateConfig
+func actionProblems(action ActionConfig) []string {
+	var problems []string
+	templates := map[string]string{"url": action.URL, "body": action.Body, "reply": action.Reply, "errorReply": action.ErrorReply}
+	for header, value := range action.Headers {
+		templates["headers."+header] = value
+	}
+	for key, text := range templates {
+		if _, err := parseActionTemplate(key, text); err != nil {
+			problems = append(problems, key+"\x00"+err.Error())
+		}
+	}
+	return problems
+}
+
+func isBuiltinIntent(intent string) bool {
+	return containsString(builtinIntents, intent)
+}
+
+//runAction calls the url of the action and gives you the reply. When the
+//call fails you get ErrorReply, or a sorry with what went wrong.
+func runAction(ctx context.Context, intent WitMessage, action ActionConfig) string {
+	name := intent.Outcome.Intent
+	logger := actionLog.withContext(ctx).with("intent", name)
+	data := actionData{
+		Intent:     name,
+		Confidence: intent.Outcome.Confidence,
+		Text:       intent.MsgBody,
+		Entities:   intent.Outcome.AllEntities,
+	}
+	if data.Entities == nil {
+		data.Entities = make(map[string]interface{})
+	}
+	sorry := func(format string, args ...interface{}) string {
+		msg := fmt.Sprintf(format, args...)
+		logger.Warnf("%s", msg)
+		if action.ErrorReply != "" {
+			data.Error = msg
+			if reply, err := executeActionTemplate("errorReply", action.ErrorReply, data); err == nil {
+				return strings.TrimSpace(reply)
+			}
+		}
+		return fmt.Sprintf("Sorry, I could not %s: %s", strings.Replace(name, "_", " ", -1), msg)
+	}
+
+	url, err := executeActionTemplate("url", action.URL, data)
+	if err != nil {
+		return sorry("the url template failed, %v", err)
+	}
+	body, err := executeActionTemplate("body", action.Body, data)
+	if err != nil {
+		return sorry("the body template failed, %v", err)
+	}
+	method := strings.ToUpper(action.Method)
+	if method == "" {
+		method = "GET"
+		if body != "" {
+			method = "POST"
+		}
+	}
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, strings.TrimSpace(url), reader)
+	if err != nil {
+		return sorry("%v", err)
+	}
+	timeout := defaultActionTimeout
+	if action.Timeout != "" {
+		if parsed, err := time.ParseDuration(action.Timeout); err == nil {
+			timeout = parsed
+		}
+	}
+	reqCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req = req.WithContext(reqCtx)
+	req.Header.Set("User-Agent", "go-cortex")
+	if body != "" && strings.HasPrefix(strings.TrimSpace(body), "{") {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id := correlationID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+	if action.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+action.Token)
+	}
+	for header, value := range action.Headers {
+		value, err = executeActionTemplate("headers."+header, value, data)
+		if err != nil {
+			return sorry("the %s header template failed, %v", header, err)
+		}
+		req.Header.Set(header, value)
+	}
+
+	logger.Infof("Calling %s %s", method, req.URL.Host)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return sorry("%v", err)
+	}
+	defer res.Body.Close()
+	text, err := ioutil.ReadAll(io.LimitReader(res.Body, actionResponseLimit))
+	if err != nil {
+		return sorry("could not read the answer, %v", err)
+	}
+	data.Status = res.StatusCode
+	var decoded interface{}
+	if json.Unmarshal(text, &decoded) == nil {
+		data.Response = decoded
+	} else {
+		data.Response = strings.TrimSpace(string(text))
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		logger.Debugf("%s answered %s", req.URL.Host, text)
+		return sorry("%s answered %s", req.URL.Host, res.Status)
+	}
+	if action.Reply == "" {
+		return "Done"
+	}
+	reply, err := executeActionTemplate("reply", action.Reply, data)
+	if err != nil {
+		return sorry("the reply template failed, %v", err)
+	}
+	return strings.TrimSpace(reply)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func deployIntent(entities string) WitMessage {
+	body := `{"msg_body": "deploy the site to staging", "outcome": {"intent": "deploy", "confidence": 0.93, "entities": ` + entities + `}}`
+	return ProcessWitResponse(context.Background(), ioutil.NopCloser(bytes.NewBufferString(body)))
+}
+
+func TestJSONPathAndEntityValue(t *testing.T) {
+	var response interface{}
+	json.Unmarshal([]byte(`{"builds": [{"number": 12, "url": "https://ci.example.com/12"}]}`), &response)
+	if got := jsonPath(response, "builds.0.url"); got != "https://ci.example.com/12" {
+		t.Errorf("builds.0.url is %v", got)
+	}
+	if got := jsonPath(response, "builds.3.url"); got != "" {
+		t.Errorf("builds.3.url is %v", got)
+	}
+	intent := deployIntent(`{"environment": [{"value": "staging", "body": "staging"}], "service": {"value": "site"}}`)
+	if entityValue(intent.Outcome.AllEntities["environment"]) != "staging" || entityValue(intent.Outcome.AllEntities["service"]) != "site" {
+		t.Errorf("The entities are %+v", intent.Outcome.AllEntities)
+	}
+	if entityValue(intent.Outcome.AllEntities["missing"]) != "" {
+		t.Errorf("A missing entity should be empty")
+	}
+}
+
+func TestRunAction(t *testing.T) {
+	var got *http.Request
+	var body string
+	ci := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		text, _ := ioutil.ReadAll(r.Body)
+		body = string(text)
+		if r.URL.Query().Get("env") == "prod" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"message": "prod is frozen"}`))
+			return
+		}
+		w.Write([]byte(`{"build": {"number": 12, "url": "https://ci.example.com/12"}}`))
+	}))
+	defer ci.Close()
+	action := ActionConfig{
+		URL:        ci.URL + `/deploy?env={{value .Entities.environment | urlquery}}`,
+		Headers:    map[string]string{"X-Confidence": "{{.Confidence}}"},
+		Token:      "t0ken",
+		Body:       `{"text": {{json .Text}}, "environment": {{json (value .Entities.environment)}}}`,
+		Reply:      `Deploying to {{value .Entities.environment}}, build {{get .Response "build.number"}} {{.Response.build.url}}`,
+		ErrorReply: `CI said no: {{get .Response "message"}}`,
+	}
+
+	reply := runAction(context.Background(), deployIntent(`{"environment": [{"value": "staging"}]}`), action)
+	if reply != "Deploying to staging, build 12 https://ci.example.com/12" {
+		t.Errorf("The reply is %q", reply)
+	}
+	if got.Method != "POST" || got.Header.Get("Authorization") != "Bearer t0ken" || got.Header.Get("X-Confidence") != "0.93" ||
+		got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("The request was %s with %v", got.Method, got.Header)
+	}
+	if body != `{"text": "deploy the site to staging", "environment": "staging"}` {
+		t.Errorf("The body was %s", body)
+	}
+
+	reply = runAction(context.Background(), deployIntent(`{"environment": {"value": "prod"}}`), action)
+	if reply != "CI said no: prod is frozen" {
+		t.Errorf("The error reply is %q", reply)
+	}
+
+	action.ErrorReply = ""
+	action.URL = "http://127.0.0.1:1/deploy"
+	reply = runAction(context.Background(), deployIntent(`{}`), action)
+	if !strings.HasPrefix(reply, "Sorry, I could not deploy: ") {
+		t.Errorf("The reply when CI is down is %q", reply)
+	}
+}
+
+func TestActionIntents(t *testing.T) {
+	ci := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status": "queued"}`))
+	}))
+	defer ci.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Actions = map[string]ActionConfig{
+		"deploy": {URL: ci.URL, Reply: "Deploy to {{value .Entities.environment}} is {{.Response.status}}", Requires: []string{"environment"}},
+	}
+
+	ret := ProcessIntent(context.Background(), deployIntent(`{"environment": [{"value": "staging"}]}`))
+	replies := chatReplies(context.Background(), ret, ChatMessage{})
+	if len(replies) != 1 || replies[0].Text != "Deploy to staging is queued" {
+		t.Errorf("The replies are %+v", replies)
+	}
+
+	//without the environment we ask for it, and the answer runs the action
+	log := newConversationLog()
+	keys := []string{"test\x00channel\x00me"}
+	_, question := log.resolve(keys, deployIntent(`{}`))
+	if question != "Which environment?" {
+		t.Errorf("The question is %q", question)
+	}
+	var answer WitMessage
+	answer.Outcome.AllEntities = map[string]interface{}{"environment": map[string]interface{}{"value": "prod"}}
+	intent, question := log.resolve(keys, answer)
+	if question != "" || intent.Outcome.Intent != "deploy" || entityValue(intent.Outcome.AllEntities["environment"]) != "prod" {
+		t.Errorf("After the answer we have %+v and ask %q", intent.Outcome, question)
+	}
+}
+
+func TestParseCortexConfigActions(t *testing.T) {
+	data := `{
+  "actions": {
+    "lights": {"url": "http://example.com"},
+    "deploy": {"url": "http://ci/{{.Entities.env", "method": "FETCH", "timeout": "soon"}
+  }
+}`
+	_, errs := parseCortexConfig("cortex.json", []byte(data))
+	expected := []string{
+		`cortex.json:3: lights is an intent Cortex already knows, pick another name for the action`,
+		`cortex.json:4: unknown method "FETCH" for the action deploy`,
+		`cortex.json:4: the timeout of the action deploy should be a duration like 10s, not "soon"`,
+		`cortex.json:4: the url template of the action deploy is invalid: template: url:1: unclosed action`,
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("parseCortexConfig gave\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestActionsRunOnEdit(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Actions = map[string]ActionConfig{
+		"deploy": {URL: "http://ci.example.com/deploy"},
+		"status": {URL: "http://ci.example.com/status", RunOnEdit: true},
+	}
+	if runsOnEdit(chatCommand{Intent: "deploy"}, deployIntent(`{}`)) {
+		t.Error("Editing the message would deploy again")
+	}
+	status := deployIntent(`{}`)
+	status.Outcome.Intent = "status"
+	if !runsOnEdit(chatCommand{Intent: "status"}, status) {
+		t.Error("Editing the message doesn't ask for the status again")
+	}
+}
+
+func TestWitHandlerActionReply(t *testing.T) {
+	ci := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"progress": "50%s done"}`))
+	}))
+	defer ci.Close()
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"msg_body": "how is the deploy", "outcome": {"intent": "deploy_status", "confidence": 1}}`))
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	config.Actions = map[string]ActionConfig{"deploy_status": {URL: ci.URL, Reply: `{{.Response.progress}}`}}
+
+	w := httptest.NewRecorder()
+	WitHandler(w, httptest.NewRequest("GET", "/wit?q=how+is+the+deploy", nil))
+	if w.Body.String() != "50%s done" {
+		t.Errorf("/wit answered %q", w.Body.String())
+	}
+}
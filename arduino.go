@@ -3,31 +3,50 @@ package main
 //Most code on this page is from http://reprage.com/post/using-golang-to-connect-raspberrypi-and-arduino/
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"github.com/huin/goserial"
 	"io"
 	"io/ioutil"
-	"log"
 	"strings"
+	"sync"
 )
 
 var c = &goserial.Config{}
 var s io.ReadWriteCloser
 
+//serialMu guards s, commands that are still running when Cortex stops
+//write to the port while closeArduino closes it
+var serialMu sync.Mutex
+
+//lightStates remembers the last command we sent to each light
+var lightStates = make(map[int]string)
+var lightStatesMu sync.Mutex
+
+//lightAction is a light we switched, with the state it had before, which
+//is empty if we never switched it
+type lightAction struct {
+	Light    int
+	Action   string
+	Previous string
+}
+
 //We init the usb connection only once, at boot time.
 func init() {
 	// Find the device that represents the arduino serial
 	// connection.
 	c = &goserial.Config{Name: findArduino(), Baud: 9600}
-	log.Printf("the USB port the Arduino service will use is %v\n\n", findArduino())
+	arduinoLog.Infof("the USB port the Arduino service will use is %v", c.Name)
 	s, _ = goserial.OpenPort(c)
 
 }
 
 //Arduino converts the string command (on/off) to the one leter command
 // the arduino board expects. And call sendArduinoCommand
-func Arduino(command string, light int) {
+func Arduino(ctx context.Context, command string, light int) {
+	logger := arduinoLog.withContext(ctx).with("light", light)
 	var arduinoCmd byte
 	if command == "on" {
 		arduinoCmd = 'u'
@@ -35,7 +54,88 @@ func Arduino(command string, light int) {
 		arduinoCmd = 'd'
 	}
 
-	sendArduinoCommand(arduinoCmd, uint32(light), s) //u for up, d for down
+	serialMu.Lock()
+	port := s
+	err := sendArduinoCommand(arduinoCmd, uint32(light), port) //u for up, d for down
+	serialMu.Unlock()
+	switch {
+	case port == nil:
+		logger.Debugf("No Arduino, not sending %c for light %v", arduinoCmd, light)
+		serialWrites.inc("no_port")
+	case err != nil:
+		logger.Errorf("Could not switch light %v %s: %v", light, command, err)
+		serialWrites.inc("error")
+	default:
+		logger.Debugf("Sent %c for light %v to %s", arduinoCmd, light, c.Name)
+		serialWrites.inc("ok")
+	}
+	lightStatesMu.Lock()
+	previous := lightStates[light]
+	lightStates[light] = command
+	lightStatesMu.Unlock()
+	events.publish(ctx, eventLightChanged, lightChangedEvent{Light: light, State: command, Previous: previous})
+}
+
+//switchLight turns the light on or off and gives you what it did
+func switchLight(ctx context.Context, light int, command string) lightAction {
+	previous := lightState(light)
+	Arduino(ctx, command, light)
+	return lightAction{light, command, previous}
+}
+
+//revertLight puts the light back the way it was before the action, when
+//we don't know, we do the opposite of the action
+func revertLight(ctx context.Context, action lightAction) lightAction {
+	previous := action.Previous
+	if previous == "" {
+		previous = "off"
+		if action.Action != "on" {
+			previous = "on"
+		}
+	}
+	return switchLight(ctx, action.Light, previous)
+}
+
+//closeArduino closes the serial port, call it when nothing else will switch
+//lights
+func closeArduino() {
+	serialMu.Lock()
+	defer serialMu.Unlock()
+	if s == nil {
+		return
+	}
+	err := s.Close()
+	if err != nil {
+		arduinoLog.Errorf("Could not close the serial port %s: %v", c.Name, err)
+	}
+	s = nil
+}
+
+//lightState gives you the last command we sent to the light, or an empty
+//string if we never did
+func lightState(light int) string {
+	lightStatesMu.Lock()
+	defer lightStatesMu.Unlock()
+	return lightStates[light]
+}
+
+//watchSensors reads what the Arduino sends us, it prints 1 when somebody
+//is in front of the ultrasonic sensor. It stops when the port closes.
+func watchSensors(port io.Reader) {
+	scanner := bufio.NewScanner(port)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch line {
+		case "":
+		case "1":
+			arduinoLog.Debugf("The ultrasonic sensor saw something")
+			events.publish(context.Background(), eventSensorTriggered, sensorTriggeredEvent{Sensor: "ultrasonic", Value: line})
+		default:
+			arduinoLog.Debugf("Ignoring %q from the Arduino", line)
+		}
+	}
+	//closeArduino makes the read fail when Cortex stops
+	arduinoLog.Debugf("Stopped reading the sensors on %s: %v", c.Name, scanner.Err())
 }
 
 // findArduino looks for the file that represents the Arduino
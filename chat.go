@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ChatMessage is what every chat adapter hands to Cortex, no matter which
+//platform the text came from.
+type ChatMessage struct {
+	//ID is the platform's id for this message
+	ID string
+	//ThreadID is what Reply uses to answer in the same thread
+	ThreadID string
+	//Channel is the platform's id for the flow/channel/room
+	Channel string
+	//ChannelName is the human friendly name, used to look up per channel settings
+	ChannelName string
+	Sender      string
+	//SenderName is the human friendly name of the sender when the platform
+	//ids are not, like the Flowdock nick
+	SenderName string
+	Text       string
+	//Mentioned is true when the adapter found Cortex's name in the message,
+	//the mention is already removed from Text
+	Mentioned bool
+	//Private is true for one to one messages
+	Private bool
+	//Attachment is set when somebody uploaded a file
+	Attachment *ChatAttachment
+	//Edited is true when somebody changed a message we already saw, ID is
+	//the id of the original message
+	Edited bool
+	//URL links to the message, when the chat has links
+	URL string
+	//Adapter is the name of the chat the message came from
+	Adapter string
+}
+
+//ChatAttachment is a file somebody uploaded to the chat
+type ChatAttachment struct {
+	Name        string
+	ContentType string
+	URL         string
+}
+
+//replyEditor is implemented by adapters that can change a reply we
+//already sent, we use it when somebody edits their message
+type replyEditor interface {
+	EditReply(msg ChatMessage, replyID string, reply ChatReply) error
+}
+
+//attachmentFetcher is implemented by adapters that can download
+//attachments, Cortex sends audio files to Wit's speech endpoint
+type attachmentFetcher interface {
+	FetchAttachment(attachment ChatAttachment) (io.ReadCloser, error)
+}
+
+//ChatAdapter is implemented by each chat platform Cortex can listen to.
+//Connect is called once before we start reading, Receive blocks until there
+//is a new message and Reply answers in the thread of the given message,
+//returning the id of the reply.
+type ChatAdapter interface {
+	Name() string
+	Connect() error
+	Receive() (ChatMessage, error)
+	Reply(msg ChatMessage, reply ChatReply) (string, error)
+}
+
+//chatRetryWait is how long we wait before the first reconnect attempt, it
+//doubles after each failed attempt up to chatMaxRetryWait
+var chatRetryWait = time.Second
+var chatMaxRetryWait = 5 * time.Minute
+
+//listenChat connects the adapter and sends every message it receives
+//through Cortex. If the connection drops we connect again, waiting a bit
+//longer after each failure. When ctx is cancelled we close the adapter and
+//return.
+func listenChat(ctx context.Context, adapter ChatAdapter) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			if closer, ok := adapter.(chatCloser); ok {
+				closer.Close()
+			}
+		case <-done:
+		}
+	}()
+
+	wait := chatRetryWait
+	for ctx.Err() == nil {
+		err := adapter.Connect()
+		if err == nil {
+			connectedAt := time.Now()
+			setChatStatus(adapter.Name(), nil)
+			chatLog.with("adapter", adapter.Name()).Infof("Connected to %s", adapter.Name())
+			err = receiveChat(adapter)
+			//only start over with a short wait if the connection was stable
+			if time.Since(connectedAt) > time.Minute {
+				wait = chatRetryWait
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		setChatStatus(adapter.Name(), err)
+		chatLog.with("adapter", adapter.Name()).Warnf("Lost connection to %s: %v, reconnecting in %v", adapter.Name(), err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+		}
+		wait *= 2
+		if wait > chatMaxRetryWait {
+			wait = chatMaxRetryWait
+		}
+	}
+	setChatStatus(adapter.Name(), errors.New("stopped"))
+	chatLog.with("adapter", adapter.Name()).Infof("Stopped listening to %s", adapter.Name())
+}
+
+func receiveChat(adapter ChatAdapter) error {
+	for {
+		msg, err := adapter.Receive()
+		if err != nil {
+			return err
+		}
+		handleChatMessage(adapter, msg)
+	}
+}
+
+//chatStatus tells you if an adapter is connected, and what went wrong last
+type chatStatus struct {
+	Connected  bool
+	Since      time.Time
+	LastError  string
+	Reconnects int
+}
+
+var chatStatusesMu sync.Mutex
+var chatStatuses = make(map[string]chatStatus)
+
+//setChatStatus records a successful connection when err is nil, or a
+//dropped one otherwise
+func setChatStatus(name string, err error) {
+	chatStatusesMu.Lock()
+	defer chatStatusesMu.Unlock()
+	status, seen := chatStatuses[name]
+	if err == nil {
+		events.publish(context.Background(), eventChatConnected, chatEvent{Adapter: name})
+	} else if status.Connected || !seen {
+		events.publish(context.Background(), eventChatDisconnected, chatEvent{Adapter: name, Error: err.Error()})
+	}
+	if err == nil {
+		if !status.Since.IsZero() {
+			status.Reconnects++
+		}
+		status.Connected = true
+		status.Since = time.Now()
+	} else {
+		if status.Connected {
+			status.Since = time.Now()
+		}
+		status.Connected = false
+		status.LastError = err.Error()
+	}
+	chatStatuses[name] = status
+}
+
+//getChatStatuses returns a copy of the status of every adapter we started
+func getChatStatuses() map[string]chatStatus {
+	chatStatusesMu.Lock()
+	defer chatStatusesMu.Unlock()
+	statuses := make(map[string]chatStatus, len(chatStatuses))
+	for name, status := range chatStatuses {
+		statuses[name] = status
+	}
+	return statuses
+}
+
+//handleChatMessage sends the text, or the voice memo, to Wit, runs the
+//intent and replies using the same adapter the message came from. Every
+//command gets a correlation id, the log lines about it have it as cid.
+func handleChatMessage(adapter ChatAdapter, msg ChatMessage) {
+	ctx := withCorrelationID(context.Background(), newCorrelationID())
+	logger := chatLog.withContext(ctx).with("adapter", adapter.Name())
+	msg.Adapter = adapter.Name()
+	if !beginCommand() {
+		logger.Warnf("Cortex is stopping, ignoring message %s on %s", msg.ID, adapter.Name())
+		return
+	}
+	defer endCommand()
+	var intent WitMessage
+	var err error
+	voiceMemo := isVoiceMemo(adapter, msg)
+	if voiceMemo {
+		//a voice memo follows the activation rules of the channel too, the
+		//mention or the prefix can be in its caption
+		if _, ok := activate(adapter, msg); !ok {
+			return
+		}
+		logger.Infof("Got voice memo %s from %s in %s", msg.Attachment.Name, msg.Sender, msg.ChannelName)
+		events.publish(ctx, eventCommandReceived, commandReceivedEvent{Channel: adapter.Name(), Sender: msg.Sender, Text: msg.Attachment.Name})
+		intent, err = fetchVoiceMemoIntent(ctx, adapter.(attachmentFetcher), *msg.Attachment)
+	} else {
+		if msg.Text == "" || chatLoopGuard.isEcho(msg) {
+			return
+		}
+		text, ok := activate(adapter, msg)
+		if !ok || text == "" {
+			return
+		}
+		msg.Text = text
+		logger.Infof("Got message %s from %s in %s", msg.ID, msg.Sender, msg.ChannelName)
+		logger.Debugf("Message %s says %q", msg.ID, msg.Text)
+		events.publish(ctx, eventCommandReceived, commandReceivedEvent{Channel: adapter.Name(), Sender: msg.Sender, Text: msg.Text})
+	}
+
+	key := chatCommandKey(adapter, msg)
+	original, edited := chatCommands.get(key)
+	edited = edited && msg.Edited
+	if edited {
+		if original.Text == msg.Text {
+			return
+		}
+		msg.ThreadID = original.ThreadID
+	}
+	if !voiceMemo {
+		intent, err = FetchIntent(ctx, msg.Text)
+	}
+	var question string
+	if err == nil {
+		intent, question = conversations.resolve(conversationKeys(adapter, msg), intent)
+		publishIntent(ctx, adapter.Name(), intent.MsgBody, intent)
+	}
+	countCommand(adapter.Name(), intent, err)
+
+	var replies []ChatReply
+	var ret WitResponse
+	ran := intent.Outcome.Intent
+	replyIDs := original.ReplyIDs
+	if err != nil {
+		ran = ""
+		replies = []ChatReply{textReply(fmt.Sprintf("Error: %+v", err))}
+	} else if question != "" {
+		ran = ""
+		replies = []ChatReply{textReply(question)}
+	} else if edited && !runsOnEdit(original, intent) {
+		//what we answered the first time still stands
+		logger.Infof("Message %s was edited, not running %s again", msg.ID, ran)
+		ret.Actions = original.Actions
+	} else if historyReplies, ok := historyReplies(ctx, historyKey(adapter, msg), intent); ok {
+		replies = historyReplies
+	} else if edited {
+		var reverted []lightAction
+		ret, reverted = processEditedIntent(ctx, intent, original)
+		replies = chatReplies(ctx, ret, msg)
+		if len(reverted) > 0 && len(ret.Actions) > 0 {
+			replies = lightReplies(ret.Actions, reverted)
+		} else if len(reverted) > 0 {
+			replies = append(lightReplies(nil, reverted), replies...)
+		}
+	} else {
+		ret = ProcessIntent(ctx, intent)
+		replies = chatReplies(ctx, ret, msg)
+	}
+	if len(replies) > 0 {
+		replyIDs = sendReplies(ctx, adapter, msg, replies, original.ReplyIDs)
+	}
+	chatCommands.put(key, chatCommand{Text: msg.Text, Intent: ran, ThreadID: msg.ThreadID, Actions: ret.Actions, ReplyIDs: replyIDs})
+	text := msg.Text
+	if text == "" {
+		//voice memos
+		text = intent.MsgBody
+	}
+	userHistories.record(historyKey(adapter, msg), historyEntry{ID: key, Text: text, Actions: ret.Actions})
+	recentCommands.add(newCommandRecord(adapter.Name(), msg.Sender, text, intent, replies, err))
+}
+
+//sendReplies answers the message, when there are previousIDs and the
+//adapter can edit replies we change those instead of adding new ones
+func sendReplies(ctx context.Context, adapter ChatAdapter, msg ChatMessage, replies []ChatReply, previousIDs []string) []string {
+	logger := chatLog.withContext(ctx).with("adapter", adapter.Name())
+	var ids []string
+	editor, canEdit := adapter.(replyEditor)
+	for i, reply := range replies {
+		if !chatLoopGuard.allow(msg) {
+			logger.Warnf("Too many replies in thread %s on %s, not answering", msg.ThreadID, adapter.Name())
+			break
+		}
+		if canEdit && msg.Edited && i < len(previousIDs) {
+			err := editor.EditReply(msg, previousIDs[i], reply)
+			if err == nil {
+				logger.Debugf("Edited reply %s to message %s", previousIDs[i], msg.ID)
+				ids = append(ids, previousIDs[i])
+				chatLoopGuard.sent(msg, reply.Text)
+				continue
+			}
+			logger.Warnf("Error editing reply %s on %s, sending a new one: %v", previousIDs[i], adapter.Name(), err)
+		}
+		id, err := adapter.Reply(msg, reply)
+		if err != nil {
+			logger.Errorf("Error replying on %s, got: %v", adapter.Name(), err)
+			continue
+		}
+		logger.Debugf("Replied to message %s with %s", msg.ID, id)
+		ids = append(ids, id)
+		chatLoopGuard.sent(msg, reply.Text)
+	}
+	return ids
+}
+
+func isVoiceMemo(adapter ChatAdapter, msg ChatMessage) bool {
+	if msg.Attachment == nil || !strings.HasPrefix(msg.Attachment.ContentType, "audio/") {
+		return false
+	}
+	_, ok := adapter.(attachmentFetcher)
+	return ok
+}
+
+//fetchVoiceMemoIntent downloads the attachment to a temporary file and
+//sends it to Wit
+func fetchVoiceMemoIntent(ctx context.Context, fetcher attachmentFetcher, attachment ChatAttachment) (WitMessage, error) {
+	body, err := fetcher.FetchAttachment(attachment)
+	if err != nil {
+		chatLog.withContext(ctx).Errorf("Could not download %s, got: %v", attachment.Name, err)
+		return WitMessage{}, fmt.Errorf("Sorry, I could not download %s", attachment.Name)
+	}
+	defer body.Close()
+	file, err := ioutil.TempFile("", "cortex-voice-*"+filepath.Ext(attachment.Name))
+	if err != nil {
+		return WitMessage{}, err
+	}
+	defer os.Remove(file.Name())
+	_, err = io.Copy(file, body)
+	file.Close()
+	if err != nil {
+		return WitMessage{}, fmt.Errorf("Sorry, I could not download %s", attachment.Name)
+	}
+	return FetchVoiceIntent(ctx, file.Name())
+}
+
+//The rules you can use in the Activation setting, separated by commas
+const (
+	activationAlways  = "always"
+	activationMention = "mention"
+	activationPrefix  = "prefix"
+	activationPrivate = "private"
+)
+
+const defaultCommandPrefix = "cortex,"
+
+//activationDefaulter is implemented by adapters that should not answer
+//every message when the Activation setting doesn't cover the channel
+type activationDefaulter interface {
+	defaultActivation() string
+}
+
+//activationFor gives you the activation rules for a channel, looking at
+//the channel name, then "*", then the adapter's default
+func activationFor(adapter ChatAdapter, channelName string) string {
+	activation := currentConfig().Activation
+	if rules, ok := activation[channelName]; ok {
+		return rules
+	}
+	if rules, ok := activation["*"]; ok {
+		return rules
+	}
+	if defaulter, ok := adapter.(activationDefaulter); ok {
+		return defaulter.defaultActivation()
+	}
+	return activationAlways
+}
+
+//activate tells you if Cortex should answer the message, and gives you the
+//text to send to Wit, without the command prefix
+func activate(adapter ChatAdapter, msg ChatMessage) (string, bool) {
+	text, prefixed := stripCommandPrefix(msg.Text)
+	for _, rule := range strings.Split(activationFor(adapter, msg.ChannelName), ",") {
+		switch strings.TrimSpace(rule) {
+		case activationAlways:
+			return text, true
+		case activationMention:
+			if msg.Mentioned {
+				return text, true
+			}
+		case activationPrefix:
+			if prefixed {
+				return text, true
+			}
+		case activationPrivate:
+			if msg.Private {
+				return text, true
+			}
+		}
+	}
+	return "", false
+}
+
+func stripCommandPrefix(text string) (string, bool) {
+	prefix := currentConfig().CommandPrefix
+	if prefix == "" {
+		prefix = defaultCommandPrefix
+	}
+	trimmed := strings.TrimSpace(text)
+	if len(trimmed) < len(prefix) || !strings.EqualFold(trimmed[:len(prefix)], prefix) {
+		return text, false
+	}
+	return strings.TrimSpace(trimmed[len(prefix):]), true
+}
+
+//stripMention looks for any of the names in the text, like "@cortex turn
+//light 3 on" or "cortex: turn light 3 on", and returns the text without it
+func stripMention(text string, names ...string) (string, bool) {
+	lower := strings.ToLower(text)
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		name = strings.ToLower(name)
+		for from := 0; from < len(lower); {
+			idx := strings.Index(lower[from:], name)
+			if idx < 0 {
+				break
+			}
+			start, end := from+idx, from+idx+len(name)
+			if (start == 0 || !isNameChar(lower[start-1])) && (end == len(lower) || !isNameChar(lower[end])) {
+				if start > 0 && lower[start-1] == '@' {
+					start--
+				}
+				for end < len(text) && (text[end] == ':' || text[end] == ',') {
+					end++
+				}
+				stripped := strings.Join(strings.Fields(text[:start]+" "+text[end:]), " ")
+				return stripped, true
+			}
+			from = end
+		}
+	}
+	return text, false
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+//replyEchoWindow is how long we remember what we said, and
+//maxRepliesPerMinute how many replies we send to a single thread in a minute
+const replyEchoWindow = 5 * time.Minute
+const maxRepliesPerMinute = 10
+
+var chatLoopGuard = newReplyLoopGuard()
+
+//replyLoopGuard keeps Cortex from talking to itself. Adapters already skip
+//messages sent by Cortex, this catches what gets through anyway, like
+//another bot repeating our replies, or Cortex running with a different user.
+type replyLoopGuard struct {
+	mu      sync.Mutex
+	replies map[string]time.Time
+	threads map[string][]time.Time
+}
+
+func newReplyLoopGuard() *replyLoopGuard {
+	return &replyLoopGuard{
+		replies: make(map[string]time.Time),
+		threads: make(map[string][]time.Time),
+	}
+}
+
+//isEcho is true when the message is something we said in the same channel
+func (g *replyLoopGuard) isEcho(msg ChatMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(time.Now())
+	_, ok := g.replies[msg.Channel+"\x00"+msg.Text]
+	return ok
+}
+
+//allow is false once we sent maxRepliesPerMinute replies to the thread
+func (g *replyLoopGuard) allow(msg ChatMessage) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(time.Now())
+	return len(g.threads[msg.Channel+"\x00"+msg.ThreadID]) < maxRepliesPerMinute
+}
+
+func (g *replyLoopGuard) sent(msg ChatMessage, text string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.replies[msg.Channel+"\x00"+text] = now
+	thread := msg.Channel + "\x00" + msg.ThreadID
+	g.threads[thread] = append(g.threads[thread], now)
+}
+
+func (g *replyLoopGuard) expire(now time.Time) {
+	for key, t := range g.replies {
+		if now.Sub(t) > replyEchoWindow {
+			delete(g.replies, key)
+		}
+	}
+	for key, times := range g.threads {
+		for len(times) > 0 && now.Sub(times[0]) > time.Minute {
+			times = times[1:]
+		}
+		if len(times) == 0 {
+			delete(g.threads, key)
+		} else {
+			g.threads[key] = times
+		}
+	}
+}
+
+//chatReplies turns the result of an intent into the text we send back to
+//the chat
+func chatReplies(ctx context.Context, ret WitResponse, msg ChatMessage) []ChatReply {
+	if len(ret.Actions) > 0 {
+		return lightReplies(ret.Actions, nil)
+	} else if ret.Conversion.From != "" {
+		return conversionReplies(ret.Conversion)
+	} else if len(ret.Issues.keys) > 0 || ret.Issues.Action == "create" {
+		return issueReplies(ctx, ret, msg)
+	} else if ret.Error.msg != "" {
+		return []ChatReply{textReply(ret.Error.msg)}
+	} else if ret.Reply != "" {
+		return []ChatReply{textReply(ret.Reply)}
+	}
+	return nil
+}
+
+//lightReplies tells you what we did with the lights, reverted are the ones
+//we put back after an edit
+func lightReplies(actions []lightAction, reverted []lightAction) []ChatReply {
+	var lights []string
+	for _, action := range actions {
+		lights = append(lights, fmt.Sprintf("light %v %s", action.Light, action.Action))
+	}
+	for _, action := range reverted {
+		lights = append(lights, fmt.Sprintf("light %v back %s", action.Light, action.Action))
+	}
+	return []ChatReply{textReply("Turning " + strings.Join(lights, ", "))}
+}
+
+//getIssueURLForFlowName given a flow name, return the issues url for it
+func getIssueURLForFlowName(parametizedName string) (string, error) {
+	for _, row := range currentConfig().FlowsTicketsUrls {
+		url, ok := row[parametizedName]
+		if ok {
+			return url, nil
+		}
+	}
+	return "", fmt.Errorf("Could not find issue url for flow: %s", parametizedName)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChatRepliesTemperature(t *testing.T) {
+	ret := WitResponse{Conversion: WitConversionResponse{Value: 212, From: "F"}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{})
+	if len(replies) != 1 || replies[0].Text != "Which is 100C" {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+}
+
+func TestChatRepliesGithub(t *testing.T) {
+	//GitHub is down, we still give people the link
+	github := httptest.NewServer(http.NotFoundHandler())
+	defer github.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.GithubAPIURL = github.URL
+	config.FlowsTicketsUrls = []map[string]string{{"huston": "https://github.com/fmpwizard/go-cortex/issues/"}}
+	ret := WitResponse{Issues: WitIssuesResponse{keys: []string{"45", "102"}}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston"})
+	if len(replies) != 2 || replies[1].Text != "just click here: [#102](https://github.com/fmpwizard/go-cortex/issues/102)" {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+}
+
+func TestChatRepliesError(t *testing.T) {
+	ret := WitResponse{Error: witError{"Error: boom"}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{})
+	if len(replies) != 1 || replies[0].Text != "Error: boom" {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+}
+
+//fakeAdapter fails to connect failConnects times, then hands out the
+//messages and fails to read once they are gone. After maxConnects it
+//blocks in Connect forever
+type fakeAdapter struct {
+	failConnects int
+	maxConnects  int
+	connects     chan int
+	messages     []ChatMessage
+	pending      []ChatMessage
+	replies      []string
+}
+
+func (f *fakeAdapter) Name() string {
+	return "fake"
+}
+
+func (f *fakeAdapter) Connect() error {
+	f.maxConnects--
+	f.connects <- f.maxConnects
+	if f.maxConnects == 0 {
+		select {}
+	}
+	if f.failConnects > 0 {
+		f.failConnects--
+		return errors.New("connection refused")
+	}
+	f.pending = f.messages
+	return nil
+}
+
+func (f *fakeAdapter) Receive() (ChatMessage, error) {
+	if len(f.pending) == 0 {
+		return ChatMessage{}, errors.New("connection reset")
+	}
+	msg := f.pending[0]
+	f.pending = f.pending[1:]
+	return msg, nil
+}
+
+func (f *fakeAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	f.replies = append(f.replies, reply.Text)
+	return "1", nil
+}
+
+func TestListenChatReconnects(t *testing.T) {
+	chatRetryWait = time.Millisecond
+	adapter := &fakeAdapter{failConnects: 1, maxConnects: 4, connects: make(chan int), messages: []ChatMessage{{ID: "1"}}}
+	go listenChat(context.Background(), adapter)
+	for left := 1; left != 0; {
+		left = <-adapter.connects
+	}
+	status := getChatStatuses()["fake"]
+	if status.Connected || status.LastError != "connection reset" || status.Reconnects != 1 {
+		t.Errorf("Chat status is %+v", status)
+	}
+}
+
+func TestReplyLoopGuard(t *testing.T) {
+	g := newReplyLoopGuard()
+	msg := ChatMessage{Channel: "C1", ThreadID: "1", Text: "Which is 100C"}
+	if g.isEcho(msg) {
+		t.Error("isEcho before we said anything")
+	}
+	g.sent(ChatMessage{Channel: "C1", ThreadID: "1"}, "Which is 100C")
+	if !g.isEcho(msg) {
+		t.Error("isEcho didn't catch our own reply")
+	}
+	msg.Channel = "C2"
+	if g.isEcho(msg) {
+		t.Error("isEcho matched a reply from another channel")
+	}
+	for i := 1; i < maxRepliesPerMinute; i++ {
+		g.sent(ChatMessage{Channel: "C1", ThreadID: "1"}, "again")
+	}
+	if g.allow(ChatMessage{Channel: "C1", ThreadID: "1"}) {
+		t.Error("allow didn't stop a busy thread")
+	}
+	if !g.allow(ChatMessage{Channel: "C1", ThreadID: "2"}) {
+		t.Error("allow stopped a quiet thread")
+	}
+}
+
+func TestStripMention(t *testing.T) {
+	cases := map[string]string{
+		"cortex: turn light 3 on":     "turn light 3 on",
+		"Cortex, turn light 3 on":     "turn light 3 on",
+		"@cortex turn light 3 on":     "turn light 3 on",
+		"turn light 3 on @cortex":     "turn light 3 on",
+		"<@U123> look at #45":         "look at #45",
+		"hey @Cortex: look at #45 ok": "hey look at #45 ok",
+	}
+	for in, want := range cases {
+		got, ok := stripMention(in, "cortex", "<@U123>")
+		if !ok || got != want {
+			t.Errorf("stripMention(%q) gave %q, %v", in, got, ok)
+		}
+	}
+	if _, ok := stripMention("cortexbot: hi", "cortex"); ok {
+		t.Error("stripMention matched another name")
+	}
+}
+
+func TestActivate(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Activation = map[string]string{"mission-control": "mention,prefix", "*": "private"}
+	config.CommandPrefix = ""
+	adapter := &fakeAdapter{}
+
+	cases := []struct {
+		msg  ChatMessage
+		text string
+		ok   bool
+	}{
+		{ChatMessage{ChannelName: "mission-control", Text: "turn light 3 on"}, "", false},
+		{ChatMessage{ChannelName: "mission-control", Text: "turn light 3 on", Mentioned: true}, "turn light 3 on", true},
+		{ChatMessage{ChannelName: "mission-control", Text: "Cortex, turn light 3 on"}, "turn light 3 on", true},
+		{ChatMessage{ChannelName: "random", Text: "cortex, turn light 3 on"}, "", false},
+		{ChatMessage{ChannelName: "diego", Text: "turn light 3 on", Private: true}, "turn light 3 on", true},
+	}
+	for _, c := range cases {
+		text, ok := activate(adapter, c.msg)
+		if text != c.text || ok != c.ok {
+			t.Errorf("activate(%+v) gave %q, %v", c.msg, text, ok)
+		}
+	}
+
+	config.Activation = nil
+	if _, ok := activate(&ircAdapter{}, ChatMessage{Text: "just chatting"}); ok {
+		t.Error("activate answered on IRC without a mention")
+	}
+	if _, ok := activate(adapter, ChatMessage{Text: "just chatting"}); !ok {
+		t.Error("activate didn't answer without an Activation setting")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+//chatCommandsTTL is how long we remember what we did for a message, edits
+//after that are handled like new messages
+const chatCommandsTTL = 24 * time.Hour
+
+var chatCommands = newChatCommandLog()
+
+//chatCommand is what Cortex did for a chat message. We keep it so an edit
+//of the message only does what changed, and updates our replies.
+type chatCommand struct {
+	Text string
+	//Intent is the intent we ran for the message, empty when we only asked
+	//a question or Wit failed
+	Intent   string
+	ThreadID string
+	Actions  []lightAction
+	ReplyIDs []string
+	at       time.Time
+}
+
+type chatCommandLog struct {
+	mu       sync.Mutex
+	commands map[string]chatCommand
+}
+
+func newChatCommandLog() *chatCommandLog {
+	return &chatCommandLog{commands: make(map[string]chatCommand)}
+}
+
+func chatCommandKey(adapter ChatAdapter, msg ChatMessage) string {
+	return adapter.Name() + "\x00" + msg.Channel + "\x00" + msg.ID
+}
+
+func (l *chatCommandLog) get(key string) (chatCommand, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	command, ok := l.commands[key]
+	if ok && time.Since(command.at) > chatCommandsTTL {
+		return chatCommand{}, false
+	}
+	return command, ok
+}
+
+func (l *chatCommandLog) put(key string, command chatCommand) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for k, c := range l.commands {
+		if now.Sub(c.at) > chatCommandsTTL {
+			delete(l.commands, k)
+		}
+	}
+	command.at = now
+	l.commands[key] = command
+}
+
+//editSafeIntents only look things up, or do the same when they run twice,
+//so an edit can run them again. Lights are safe too, processEditedIntent
+//only switches what changed.
+var editSafeIntents = []string{"lights", "temperature", "convert", "github", "github_close", "github_label", "history"}
+
+//runsOnEdit tells you if an edit of a message runs its intent. Creating an
+//issue again, or undoing twice, because somebody fixed a typo is not what
+//they want, so we only run those when the edit asks for something else.
+//HTTP actions could deploy twice, they run again only with RunOnEdit.
+func runsOnEdit(original chatCommand, intent WitMessage) bool {
+	name := intent.Outcome.Intent
+	if original.Intent != name || containsString(editSafeIntents, name) {
+		return true
+	}
+	return currentConfig().Actions[name].RunOnEdit
+}
+
+//processEditedIntent runs the intent of an edited message. Lights that are
+//in both the original and the edit are left alone, new ones are switched and
+//the ones the edit doesn't mention anymore go back to how they were. The
+//second value has the lights we reverted.
+func processEditedIntent(ctx context.Context, intent WitMessage, original chatCommand) (WitResponse, []lightAction) {
+	var ret WitResponse
+	if intent.Outcome.Intent != "lights" {
+		ret = ProcessIntent(ctx, intent)
+	}
+	previous := make(map[int]lightAction)
+	for _, action := range original.Actions {
+		previous[action.Light] = action
+	}
+	for _, light := range desiredLights(intent) {
+		old, ok := previous[light.Light]
+		switch {
+		case ok && old.Action == light.Action:
+			ret.Actions = append(ret.Actions, old)
+		case ok:
+			action := switchLight(ctx, light.Light, light.Action)
+			//so reverting goes back to before the original message
+			action.Previous = old.Previous
+			ret.Actions = append(ret.Actions, action)
+		default:
+			ret.Actions = append(ret.Actions, switchLight(ctx, light.Light, light.Action))
+		}
+		if ret.Arduino.Action == "" {
+			ret.Arduino = light
+		}
+		delete(previous, light.Light)
+	}
+	var reverted []lightAction
+	for _, action := range original.Actions {
+		if _, ok := previous[action.Light]; ok {
+			reverted = append(reverted, revertLight(ctx, action))
+		}
+	}
+	return ret, reverted
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//fakeWitLights answers "turn light 3 and 4 on" like Wit would, with every
+//number in the text as a light
+func fakeWitLights() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		action := "on"
+		if strings.Contains(q, "off") {
+			action = "off"
+		}
+		var numbers []string
+		for _, word := range strings.Fields(q) {
+			if len(word) == 1 && word[0] >= '0' && word[0] <= '9' {
+				numbers = append(numbers, fmt.Sprintf(`{"value": %s, "body": "%s"}`, word, word))
+			}
+		}
+		fmt.Fprintf(w, `{"msg_body": %q, "outcome": {"intent": "lights", "confidence": 1, "entities": {"on_off": {"value": %q}, "github_issue": [%s]}}}`,
+			q, action, strings.Join(numbers, ","))
+	}))
+}
+
+func lightsIntent(action string, lights ...int) WitMessage {
+	var intent WitMessage
+	intent.Outcome.Intent = "lights"
+	intent.Outcome.Entities.OnOff.Value = action
+	for _, light := range lights {
+		intent.Outcome.Entities.MultipleNumber = append(intent.Outcome.Entities.MultipleNumber, WitNumber{Value: light})
+	}
+	return intent
+}
+
+func TestProcessEditedIntent(t *testing.T) {
+	lightStates = make(map[int]string)
+	original := chatCommand{Actions: ProcessIntent(context.Background(), lightsIntent("on", 3)).Actions}
+
+	ret, reverted := processEditedIntent(context.Background(), lightsIntent("on", 4), original)
+	if len(ret.Actions) != 1 || ret.Actions[0] != (lightAction{4, "on", ""}) {
+		t.Errorf("processEditedIntent switched %+v", ret.Actions)
+	}
+	if len(reverted) != 1 || reverted[0] != (lightAction{3, "off", "on"}) || lightState(3) != "off" {
+		t.Errorf("processEditedIntent reverted %+v", reverted)
+	}
+
+	lightStates = make(map[int]string)
+	lightStates[3] = "off"
+	original = chatCommand{Actions: ProcessIntent(context.Background(), lightsIntent("on", 3)).Actions}
+	ret, reverted = processEditedIntent(context.Background(), lightsIntent("on", 3, 5), original)
+	if len(ret.Actions) != 2 || ret.Actions[0] != original.Actions[0] || len(reverted) != 0 {
+		t.Errorf("processEditedIntent gave %+v, reverted %+v", ret.Actions, reverted)
+	}
+
+	ret, _ = processEditedIntent(context.Background(), lightsIntent("off", 3), original)
+	if ret.Actions[0] != (lightAction{3, "off", "off"}) {
+		t.Errorf("processEditedIntent gave %+v", ret.Actions)
+	}
+}
+
+//editingAdapter is a fakeAdapter that can edit its replies
+type editingAdapter struct {
+	fakeAdapter
+	edits map[string]string
+}
+
+func (e *editingAdapter) EditReply(msg ChatMessage, replyID string, reply ChatReply) error {
+	e.edits[replyID] = reply.Text
+	return nil
+}
+
+func TestHandleChatMessageEdit(t *testing.T) {
+	wit := fakeWitLights()
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	lightStates = make(map[int]string)
+
+	adapter := &editingAdapter{edits: make(map[string]string)}
+	msg := ChatMessage{ID: "10", ThreadID: "10", Channel: "C1", Text: "turn light 3 on"}
+	handleChatMessage(adapter, msg)
+	if len(adapter.replies) != 1 || adapter.replies[0] != "Turning light 3 on" {
+		t.Fatalf("First reply was %+v", adapter.replies)
+	}
+
+	msg.Text = "turn light 4 on"
+	msg.ThreadID = "edit-event"
+	msg.Edited = true
+	handleChatMessage(adapter, msg)
+	if len(adapter.replies) != 1 || adapter.edits["1"] != "Turning light 4 on, light 3 back off" {
+		t.Errorf("Edit gave replies %+v and edits %+v", adapter.replies, adapter.edits)
+	}
+	if lightState(3) != "off" || lightState(4) != "on" {
+		t.Errorf("Lights are %+v", lightStates)
+	}
+	handleChatMessage(adapter, msg)
+	if len(adapter.edits) != 1 {
+		t.Errorf("An edit without changes gave edits %+v", adapter.edits)
+	}
+}
+
+func TestRunsOnEdit(t *testing.T) {
+	var intent WitMessage
+	intent.Outcome.Intent = "create_issue"
+	if runsOnEdit(chatCommand{Intent: "create_issue"}, intent) {
+		t.Error("An edit would create the issue again")
+	}
+	if !runsOnEdit(chatCommand{Intent: "lights"}, intent) {
+		t.Error("An edit that asks for an issue now doesn't create it")
+	}
+	intent.Outcome.Intent = "temperature"
+	if !runsOnEdit(chatCommand{Intent: "temperature"}, intent) {
+		t.Error("An edit doesn't convert the temperature again")
+	}
+}
+
+func TestHandleChatMessageEditCreateIssue(t *testing.T) {
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"msg_body": %q, "outcome": {"intent": "create_issue", "confidence": 1}}`, r.URL.Query().Get("q"))
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+
+	adapter := &editingAdapter{edits: make(map[string]string)}
+	msg := ChatMessage{ID: "11", ThreadID: "11", Channel: "C1", Text: "file a bug: the lihgts blink"}
+	handleChatMessage(adapter, msg)
+	if len(adapter.replies) != 1 {
+		t.Fatalf("First replies were %+v", adapter.replies)
+	}
+
+	msg.Text = "file a bug: the lights blink"
+	msg.Edited = true
+	handleChatMessage(adapter, msg)
+	if len(adapter.replies) != 1 || len(adapter.edits) != 0 {
+		t.Errorf("Fixing a typo gave replies %+v and edits %+v", adapter.replies, adapter.edits)
+	}
+	if command, _ := chatCommands.get("fake\x00C1\x0011"); command.Text != msg.Text || len(command.ReplyIDs) != 1 {
+		t.Errorf("We remember %+v", command)
+	}
+}
@@ -0,0 +1,853 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//configPollInterval is how often we look at the config file for changes
+const configPollInterval = 2 * time.Second
+
+//configMu guards config, a reload replaces all of it while the chats and
+//the http handlers read it, so every read goes through currentConfig
+var configMu sync.RWMutex
+
+//configReloaders are told about every reload, so they can apply what changed
+var configReloaders []func(old, current CortexConfig)
+
+//currentConfig gives you a copy of the config, use it for the settings that
+//reload
+func currentConfig() CortexConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return config
+}
+
+func readCortexConfig() {
+	loaded, errs := loadCortexConfig(configFile)
+	if len(errs) > 0 {
+		configLog.Fatalf("Invalid configuration:\n%s", joinErrors(errs))
+	}
+	configMu.Lock()
+	config = loaded
+	configMu.Unlock()
+	configLog.Infof("Using configuration: %s", redactedConfigJSON(loaded))
+}
+
+//loadCortexConfig gives you the effective config. The file comes first, the
+//CORTEX_ environment variables override it, and last we read the secrets
+//that point to a file. Without a file everything comes from the environment.
+func loadCortexConfig(name string) (CortexConfig, []error) {
+	var loaded CortexConfig
+	var lines map[string]int
+	var errs []error
+	if name != "" {
+		configBytes, err := ioutil.ReadFile(name)
+		if err != nil {
+			return CortexConfig{}, []error{fmt.Errorf("Could not read config file, error: %+v", err)}
+		}
+		loaded, lines, errs, err = decodeCortexConfig(name, configBytes)
+		if err != nil {
+			return loaded, []error{err}
+		}
+	}
+	fromEnv, envErrs := applyConfigEnv(&loaded, os.Environ())
+	loaded, secretErrs := readSecretFiles(loaded)
+	if len(envErrs) > 0 || len(secretErrs) > 0 {
+		return loaded, append(envErrs, secretErrs...)
+	}
+	errs = append(errs, configProblems(name, lines, fromEnv, loaded)...)
+	sortConfigErrors(errs)
+	return loaded, errs
+}
+
+//configError is a problem with a setting, Line is 0 when we don't know where
+//it is
+type configError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e configError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+func joinErrors(errs []error) string {
+	var lines []string
+	for _, err := range errs {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func sortConfigErrors(errs []error) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].(configError).Line < errs[j].(configError).Line
+	})
+}
+
+//parseCortexConfig decodes and validates a config file, giving you every
+//problem it finds with the line it is on. It doesn't look at the environment.
+func parseCortexConfig(name string, data []byte) (CortexConfig, []error) {
+	parsed, lines, errs, err := decodeCortexConfig(name, data)
+	if err != nil {
+		return parsed, []error{err}
+	}
+	errs = append(errs, configProblems(name, lines, nil, parsed)...)
+	sortConfigErrors(errs)
+	return parsed, errs
+}
+
+//decodeCortexConfig reads json, yaml or toml, by the extension of the file.
+//It gives you the line of every key, the unknown keys, and err when the file
+//can't be decoded at all.
+func decodeCortexConfig(name string, data []byte) (CortexConfig, map[string]int, []error, error) {
+	var parsed CortexConfig
+	var formatLines map[string]int
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		converted, lines, err := yamlToJSON(name, data)
+		if err != nil {
+			return parsed, nil, nil, err
+		}
+		data, formatLines = converted, lines
+	case ".toml":
+		converted, lines, err := tomlToJSON(name, data)
+		if err != nil {
+			return parsed, nil, nil, err
+		}
+		data, formatLines = converted, lines
+	}
+
+	err := json.Unmarshal(data, &parsed)
+	switch e := err.(type) {
+	case nil:
+	case *json.SyntaxError:
+		return parsed, nil, nil, configError{name, lineAt(data, e.Offset), e.Error()}
+	case *json.UnmarshalTypeError:
+		msg := fmt.Sprintf("%s should be a %s, not a %s", e.Field, e.Type, e.Value)
+		line := lineAt(data, e.Offset)
+		if formatLines != nil {
+			line = formatLines[strings.ToLower(e.Field)]
+		}
+		return parsed, nil, nil, configError{name, line, msg}
+	default:
+		return parsed, nil, nil, configError{name, 0, err.Error()}
+	}
+
+	lines, unknown := scanConfigKeys(data)
+	if formatLines != nil {
+		lines = formatLines
+	}
+	var errs []error
+	for _, key := range unknown {
+		errs = append(errs, configError{name, lines[strings.ToLower(key)], fmt.Sprintf("unknown setting %s", key)})
+	}
+	return parsed, lines, errs, nil
+}
+
+//configProblems validates the config, problems with a setting that came from
+//the environment point there instead of to a line in the file
+func configProblems(name string, lines map[string]int, fromEnv map[string]string, c CortexConfig) []error {
+	var errs []error
+	for _, problem := range validateConfig(c) {
+		field := strings.ToLower(strings.SplitN(problem.key, ".", 2)[0])
+		if variable, ok := fromEnv[field]; ok {
+			errs = append(errs, configError{variable, 0, problem.msg})
+			continue
+		}
+		errs = append(errs, configError{name, lines[strings.ToLower(problem.key)], problem.msg})
+	}
+	return errs
+}
+
+//yamlToJSON converts a yaml config so we decode and check it like json, the
+//lines are the ones in the yaml
+func yamlToJSON(name string, data []byte) ([]byte, map[string]int, error) {
+	var root yaml.Node
+	err := yaml.Unmarshal(data, &root)
+	if err != nil {
+		return nil, nil, configError{name, 0, err.Error()}
+	}
+	lines := make(map[string]int)
+	yamlKeyLines(&root, "", lines)
+	var value interface{}
+	err = root.Decode(&value)
+	if err != nil {
+		return nil, nil, configError{name, 0, err.Error()}
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, configError{name, 0, err.Error()}
+	}
+	return converted, lines, nil
+}
+
+func yamlKeyLines(node *yaml.Node, path string, lines map[string]int) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			yamlKeyLines(child, path, lines)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := node.Content[i].Value
+			if path != "" {
+				childPath = path + "." + childPath
+			}
+			lines[strings.ToLower(childPath)] = node.Content[i].Line
+			yamlKeyLines(node.Content[i+1], childPath, lines)
+		}
+	case yaml.SequenceNode:
+		for i, child := range node.Content {
+			childPath := fmt.Sprintf("%s.%d", path, i)
+			lines[strings.ToLower(childPath)] = child.Line
+			yamlKeyLines(child, childPath, lines)
+		}
+	}
+}
+
+//tomlToJSON converts a toml config so we decode and check it like json
+func tomlToJSON(name string, data []byte) ([]byte, map[string]int, error) {
+	value := make(map[string]interface{})
+	_, err := toml.Decode(string(data), &value)
+	switch e := err.(type) {
+	case nil:
+	case toml.ParseError:
+		msg := e.Message
+		if msg == "" {
+			msg = e.Error()
+		}
+		return nil, nil, configError{name, e.Position.Line, msg}
+	default:
+		return nil, nil, configError{name, 0, err.Error()}
+	}
+	converted, err := json.Marshal(value)
+	if err != nil {
+		return nil, nil, configError{name, 0, err.Error()}
+	}
+	return converted, tomlKeyLines(data), nil
+}
+
+//tomlKeyLines finds the line of the tables and the keys in them, it only
+//knows about one key per line but that is enough to point at a problem
+func tomlKeyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	arrays := make(map[string]int)
+	table := ""
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if comment := strings.Index(line, " #"); comment > 0 && strings.HasPrefix(line, "[") {
+			line = strings.TrimSpace(line[:comment])
+		}
+		switch {
+		case strings.HasPrefix(line, "[["):
+			name := strings.ToLower(strings.Replace(strings.Trim(line, "[] "), `"`, "", -1))
+			if _, ok := lines[name]; !ok {
+				lines[name] = i + 1
+			}
+			table = fmt.Sprintf("%s.%d", name, arrays[name])
+			arrays[name]++
+			lines[table] = i + 1
+		case strings.HasPrefix(line, "["):
+			table = strings.ToLower(strings.Replace(strings.Trim(line, "[] "), `"`, "", -1))
+			lines[table] = i + 1
+		case strings.Contains(line, "=") && !strings.HasPrefix(line, "#"):
+			key := strings.ToLower(strings.Trim(strings.TrimSpace(line[:strings.Index(line, "=")]), `"'`))
+			if table != "" {
+				key = table + "." + key
+			}
+			lines[key] = i + 1
+		}
+	}
+	return lines
+}
+
+//lineAt converts an offset in data to a line number, starting at 1
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+//scanConfigKeys gives you the line of every key in the file, like
+//trackers.ops.type, and the keys CortexConfig or TrackerConfig don't have
+func scanConfigKeys(data []byte) (map[string]int, []string) {
+	lines := make(map[string]int)
+	var unknown []string
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	var walk func(path string, fields reflect.Type) error
+	walk = func(path string, fields reflect.Type) error {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		delim, ok := token.(json.Delim)
+		if !ok || (delim != '{' && delim != '[') {
+			return nil
+		}
+		index := 0
+		for dec.More() {
+			childPath := path
+			var childFields reflect.Type
+			if delim == '[' {
+				childPath = fmt.Sprintf("%s.%d", path, index)
+				index++
+				childFields = elemStruct(fields)
+			} else {
+				token, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				key := token.(string)
+				if path != "" {
+					childPath = path + "." + key
+				} else {
+					childPath = key
+				}
+				lines[strings.ToLower(childPath)] = lineAt(data, dec.InputOffset())
+				if fields != nil && fields.Kind() == reflect.Struct {
+					field, ok := fieldByJSONName(fields, key)
+					if !ok {
+						unknown = append(unknown, childPath)
+					} else {
+						childFields = field.Type
+					}
+				} else {
+					childFields = elemStruct(fields)
+				}
+			}
+			err := walk(childPath, childFields)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+		return err
+	}
+	walk("", reflect.TypeOf(CortexConfig{}))
+	return lines, unknown
+}
+
+//elemStruct gives you what a map or slice holds, when that is a struct
+//whose keys we can check, or another map or slice
+func elemStruct(t reflect.Type) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Map, reflect.Slice, reflect.Ptr:
+		return t.Elem()
+	}
+	return nil
+}
+
+//fieldByJSONName matches keys the way encoding/json does, without caring
+//about case
+func fieldByJSONName(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(t.Field(i).Name, key) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+type configProblem struct {
+	key string
+	msg string
+}
+
+//validateConfig checks the values make sense, key is where the problem is,
+//to find its line
+func validateConfig(c CortexConfig) []configProblem {
+	var problems []configProblem
+	problem := func(key, format string, args ...interface{}) {
+		problems = append(problems, configProblem{key, fmt.Sprintf(format, args...)})
+	}
+
+	if c.HttpPort != "" {
+		port, err := strconv.Atoi(c.HttpPort)
+		if err != nil || port < 1 || port > 65535 {
+			problem("httpPort", "httpPort should be a port number, not %q", c.HttpPort)
+		}
+	}
+	if strings.ContainsAny(c.HttpBindAddress, " /") || strings.Count(c.HttpBindAddress, ":") == 1 {
+		problem("httpBindAddress", "httpBindAddress should be an ip or a host name, without the port, not %q", c.HttpBindAddress)
+	}
+	if c.HttpPathPrefix != "" && (!strings.HasPrefix(c.HttpPathPrefix, "/") || strings.ContainsAny(c.HttpPathPrefix, "?# ")) {
+		problem("httpPathPrefix", "httpPathPrefix should be a path like /cortex, not %q", c.HttpPathPrefix)
+	}
+	httpTimeouts := map[string]string{
+		"httpReadTimeout":  c.HttpReadTimeout,
+		"httpWriteTimeout": c.HttpWriteTimeout,
+		"httpIdleTimeout":  c.HttpIdleTimeout,
+	}
+	for key, value := range httpTimeouts {
+		if value == "" {
+			continue
+		}
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			problem(key, "%s should be a duration like 30s, not %q", key, value)
+		}
+	}
+	if c.HttpMaxBodyBytes < 0 {
+		problem("httpMaxBodyBytes", "httpMaxBodyBytes can't be negative")
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		problem("trustedProxies", "trustedProxies should have ips or ranges like 10.0.0.0/8, %v", err)
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		problem("tlsCertFile", "https needs both tlsCertFile and tlsKeyFile")
+	}
+	urls := map[string]string{
+		"flowdockAPIURL":      c.FlowdockAPIURL,
+		"flowdockStreamURL":   c.FlowdockStreamURL,
+		"witAPIURL":           c.WitAPIURL,
+		"slackAPIURL":         c.SlackAPIURL,
+		"matrixHomeserverURL": c.MatrixHomeserverURL,
+		"githubAPIURL":        c.GithubAPIURL,
+	}
+	for key, value := range urls {
+		if !validURL(value) {
+			problem(key, "%s should be an http or https url, not %q", key, value)
+		}
+	}
+	for i, row := range c.FlowsTicketsUrls {
+		for flow, value := range row {
+			if value == "" || !validURL(value) {
+				problem(fmt.Sprintf("flowsTicketsUrls.%d.%s", i, flow), "the issues url for %s should be an http or https url, not %q", flow, value)
+			}
+		}
+	}
+	for channel, rules := range c.Activation {
+		for _, rule := range strings.Split(rules, ",") {
+			switch strings.TrimSpace(rule) {
+			case activationAlways, activationMention, activationPrefix, activationPrivate:
+			default:
+				problem("activation."+channel, "unknown activation rule %q for %s, use always, mention, prefix or private", strings.TrimSpace(rule), channel)
+			}
+		}
+	}
+	for channel, tracker := range c.Trackers {
+		key := "trackers." + channel
+		switch strings.ToLower(tracker.Type) {
+		case "", "github", "gitlab":
+		case "gitea", "jira":
+			if tracker.URL == "" {
+				problem(key, "the %s tracker for %s needs a url", tracker.Type, channel)
+			}
+		default:
+			problem(key+".type", "unknown tracker type %q for %s, use github, gitlab, gitea or jira", tracker.Type, channel)
+		}
+		if tracker.Project == "" && strings.ToLower(tracker.Type) != "jira" {
+			problem(key, "the tracker for %s needs a project", channel)
+		}
+		if !validURL(tracker.URL) {
+			problem(key+".url", "the tracker url for %s should be an http or https url, not %q", channel, tracker.URL)
+		}
+		for _, allowed := range tracker.AllowedUsers {
+			if why := allowedUserProblem(allowed); why != "" {
+				problem(key+".allowedUsers", "%s", why)
+			}
+		}
+	}
+	for _, allowed := range c.GithubAllowedUsers {
+		if why := allowedUserProblem(allowed); why != "" {
+			problem("githubAllowedUsers", "%s", why)
+		}
+	}
+	if c.UnitDecimals != nil && (*c.UnitDecimals < 0 || *c.UnitDecimals > 10) {
+		problem("unitDecimals", "unitDecimals should be between 0 and 10, not %d", *c.UnitDecimals)
+	}
+	if c.ConversationTimeout != "" {
+		timeout, err := time.ParseDuration(c.ConversationTimeout)
+		if err != nil || timeout <= 0 {
+			problem("conversationTimeout", "conversationTimeout should be a duration like 5m, not %q", c.ConversationTimeout)
+		}
+	}
+	if c.ShutdownTimeout != "" {
+		timeout, err := time.ParseDuration(c.ShutdownTimeout)
+		if err != nil || timeout <= 0 {
+			problem("shutdownTimeout", "shutdownTimeout should be a duration like 30s, not %q", c.ShutdownTimeout)
+		}
+	}
+	for light, state := range c.ShutdownLights {
+		if _, err := strconv.Atoi(light); err != nil && light != "*" {
+			problem("shutdownLights."+light, "shutdownLights should use light numbers or *, not %q", light)
+		}
+		if state != "on" && state != "off" {
+			problem("shutdownLights."+light, "light %s should be on or off when Cortex stops, not %q", light, state)
+		}
+	}
+	for light := range c.Lights {
+		if number, err := strconv.Atoi(light); err != nil || number < 1 {
+			problem("lights."+light, "lights should use light numbers, not %q", light)
+		}
+	}
+	knownEvents := make(map[string]bool)
+	for _, typ := range eventTypes {
+		knownEvents[typ] = true
+	}
+	for name, hook := range c.Webhooks {
+		key := "webhooks." + name
+		if hook.URL == "" || !validURL(hook.URL) {
+			problem(key+".url", "the url of webhook %s should be an http or https url, not %q", name, hook.URL)
+		}
+		if len(hook.Events) == 0 && len(hook.Intents) == 0 {
+			problem(key, "webhook %s needs events or intents to send", name)
+		}
+		for _, typ := range hook.Events {
+			if !knownEvents[typ] {
+				problem(key+".events", "unknown event %q for webhook %s, use %s", typ, name, strings.Join(eventTypes, ", "))
+			}
+		}
+		if hook.MaxAttempts < 0 || hook.MaxAttempts > 20 {
+			problem(key+".maxAttempts", "maxAttempts of webhook %s should be between 1 and 20, not %d", name, hook.MaxAttempts)
+		}
+	}
+	for intent, action := range c.Actions {
+		key := "actions." + intent
+		if isBuiltinIntent(intent) {
+			problem(key, "%s is an intent Cortex already knows, pick another name for the action", intent)
+		}
+		if action.URL == "" {
+			problem(key, "the action for %s needs a url", intent)
+		}
+		switch strings.ToUpper(action.Method) {
+		case "", "GET", "POST", "PUT", "PATCH", "DELETE":
+		default:
+			problem(key+".method", "unknown method %q for the action %s", action.Method, intent)
+		}
+		if action.Timeout != "" {
+			timeout, err := time.ParseDuration(action.Timeout)
+			if err != nil || timeout <= 0 {
+				problem(key+".timeout", "the timeout of the action %s should be a duration like 10s, not %q", intent, action.Timeout)
+			}
+		}
+		for _, p := range actionProblems(action) {
+			parts := strings.SplitN(p, "\x00", 2)
+			problem(key+"."+parts[0], "the %s template of the action %s is invalid: %s", parts[0], intent, parts[1])
+		}
+	}
+	switch strings.ToLower(c.LogFormat) {
+	case "", "logfmt", "json":
+	default:
+		problem("logFormat", "logFormat should be logfmt or json, not %q", c.LogFormat)
+	}
+	if _, ok := logLevelNames[strings.ToLower(c.LogLevel)]; !ok && c.LogLevel != "" {
+		problem("logLevel", "logLevel should be debug, info, warn or error, not %q", c.LogLevel)
+	}
+	for subsystem, level := range c.LogLevels {
+		if !logSubsystems[subsystem] {
+			problem("logLevels."+subsystem, "unknown subsystem %q in logLevels", subsystem)
+		}
+		if _, ok := logLevelNames[strings.ToLower(level)]; !ok {
+			problem("logLevels."+subsystem, "the log level for %s should be debug, info, warn or error, not %q", subsystem, level)
+		}
+	}
+	if c.SlackBotToken != "" && c.SlackSigningSecret == "" {
+		problem("slackBotToken", "slackSigningSecret is needed to check the events Slack sends")
+	}
+	if c.SlackBotToken != "" && c.HttpPort == "" {
+		problem("slackBotToken", "Slack sends events to /slack/events, set httpPort")
+	}
+	if c.MatrixHomeserverURL != "" && c.MatrixAccessToken == "" {
+		problem("matrixHomeserverURL", "matrixAccessToken is needed to log in to %s", c.MatrixHomeserverURL)
+	}
+	if c.IRCServer != "" && !strings.Contains(c.IRCServer, ":") {
+		problem("ircServer", "ircServer should be host:port, like irc.libera.chat:6697")
+	}
+	return problems
+}
+
+func validURL(value string) bool {
+	if value == "" {
+		return true
+	}
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+//configEnvPrefix starts the environment variables that override settings,
+//CORTEX_WIT_ACCESS_TOKEN sets witAccessToken. The underscores are only there
+//to read them, CORTEX_WITACCESSTOKEN works too.
+const configEnvPrefix = "CORTEX_"
+
+//configFileSuffix reads the setting from a file, CORTEX_WIT_ACCESS_TOKEN_FILE
+//for a Docker or Kubernetes secret
+const configFileSuffix = "_FILE"
+
+//secretFilePrefix is for secrets in the config file, "token": "file:/run/secrets/jira"
+//reads the token from /run/secrets/jira
+const secretFilePrefix = "file:"
+
+func envSettingName(name string) string {
+	return strings.ToLower(strings.Replace(name, "_", "", -1))
+}
+
+//applyConfigEnv overrides the settings with the CORTEX_ variables in environ.
+//It gives you the settings it changed, with the variable that changed them.
+func applyConfigEnv(c *CortexConfig, environ []string) (map[string]string, []error) {
+	value := reflect.ValueOf(c).Elem()
+	fields := make(map[string]int)
+	for i := 0; i < value.NumField(); i++ {
+		fields[envSettingName(value.Type().Field(i).Name)] = i
+	}
+
+	fromEnv := make(map[string]string)
+	var errs []error
+	sort.Strings(environ)
+	for _, entry := range environ {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], configEnvPrefix) {
+			continue
+		}
+		variable, setting := parts[0], parts[1]
+		name := strings.TrimPrefix(variable, configEnvPrefix)
+		if strings.HasSuffix(name, configFileSuffix) {
+			if _, ok := fields[envSettingName(name)]; !ok {
+				name = strings.TrimSuffix(name, configFileSuffix)
+				content, err := ioutil.ReadFile(setting)
+				if err != nil {
+					errs = append(errs, configError{variable, 0, err.Error()})
+					continue
+				}
+				setting = strings.TrimRight(string(content), "\r\n")
+			}
+		}
+		i, ok := fields[envSettingName(name)]
+		if !ok {
+			//Kubernetes adds CORTEX_PORT and friends for a service called cortex
+			configLog.Warnf("Ignoring %s, there is no setting with that name", variable)
+			continue
+		}
+		if other, ok := fromEnv[envSettingName(name)]; ok {
+			errs = append(errs, configError{variable, 0, fmt.Sprintf("%s sets the same setting, use one of them", other)})
+			continue
+		}
+		err := setConfigField(value.Field(i), setting)
+		if err != nil {
+			errs = append(errs, configError{variable, 0, err.Error()})
+			continue
+		}
+		fromEnv[envSettingName(name)] = variable
+	}
+	return fromEnv, errs
+}
+
+//setConfigField parses setting for the field, lists of strings are comma
+//separated and anything more complex, like trackers, is json
+func setConfigField(field reflect.Value, setting string) error {
+	switch {
+	case field.Kind() == reflect.String:
+		field.SetString(setting)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(setting)
+		if err != nil {
+			return fmt.Errorf("should be true or false, not %q", setting)
+		}
+		field.SetBool(b)
+	case field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.Int:
+		n, err := strconv.Atoi(setting)
+		if err != nil {
+			return fmt.Errorf("should be a number, not %q", setting)
+		}
+		field.Set(reflect.ValueOf(&n))
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(setting), "["):
+		var list []string
+		for _, item := range strings.Split(setting, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		//start from nothing, so the variable replaces what the file had
+		parsed := reflect.New(field.Type())
+		err := json.Unmarshal([]byte(setting), parsed.Interface())
+		if err != nil {
+			return fmt.Errorf("should be json: %v", err)
+		}
+		field.Set(parsed.Elem())
+	}
+	return nil
+}
+
+//readSecretFiles replaces the secrets that start with file: with what the
+//file has, without the final newline
+func readSecretFiles(c CortexConfig) (CortexConfig, []error) {
+	var errs []error
+	read := replaceSecrets(reflect.ValueOf(c), func(secret string) string {
+		if !strings.HasPrefix(secret, secretFilePrefix) {
+			return secret
+		}
+		content, err := ioutil.ReadFile(strings.TrimPrefix(secret, secretFilePrefix))
+		if err != nil {
+			errs = append(errs, configError{"secrets", 0, err.Error()})
+			return ""
+		}
+		return strings.TrimRight(string(content), "\r\n")
+	})
+	return read.Interface().(CortexConfig), errs
+}
+
+const redacted = "[redacted]"
+
+//replaceSecrets gives you a copy of v with the fields tagged cortex:"secret"
+//replaced by what replace gives you, it follows structs, maps and slices
+func replaceSecrets(v reflect.Value, replace func(secret string) string) reflect.Value {
+	switch v.Kind() {
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+			if field.Tag.Get("cortex") == "secret" && field.Type.Kind() == reflect.String {
+				copied.Field(i).SetString(replace(v.Field(i).String()))
+				continue
+			}
+			copied.Field(i).Set(replaceSecrets(v.Field(i), replace))
+		}
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(key, replaceSecrets(v.MapIndex(key), replace))
+		}
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(replaceSecrets(v.Index(i), replace))
+		}
+		return copied
+	}
+	return v
+}
+
+func redactSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redacted
+}
+
+//redactedConfig is the config without tokens and passwords, for logging
+func redactedConfig(c CortexConfig) CortexConfig {
+	return replaceSecrets(reflect.ValueOf(c), redactSecret).Interface().(CortexConfig)
+}
+
+func redactedConfigJSON(c CortexConfig) string {
+	text, err := json.Marshal(redactedConfig(c))
+	if err != nil {
+		return err.Error()
+	}
+	return string(text)
+}
+
+//reloadableSettings are the settings we apply without a restart, changes to
+//any other setting are logged and wait for the next start
+var reloadableSettings = []string{
+	"Flows", "FlowsTicketsUrls", "Trackers", "Activation", "CommandPrefix", "WelcomeMessage",
+	"UnitDecimals", "ConversationTimeout", "GithubAllowedUsers", "ShutdownTimeout", "ShutdownLights",
+	"LogFormat", "LogLevel", "LogLevels", "HttpMaxBodyBytes", "TrustedProxies",
+	"Lights", "DashboardPassword", "Webhooks", "WebhookDeadLetterFile",
+	"Actions",
+}
+
+//reloadCortexConfig reads the file again and applies the safe settings, when
+//the file has problems we log them and keep what we have
+func reloadCortexConfig() {
+	loaded, errs := loadCortexConfig(configFile)
+	if len(errs) > 0 {
+		configLog.Errorf("Not reloading the configuration:\n%s", joinErrors(errs))
+		return
+	}
+	old := currentConfig()
+	updated := old
+	oldValue := reflect.ValueOf(old)
+	loadedValue := reflect.ValueOf(loaded)
+	updatedValue := reflect.ValueOf(&updated).Elem()
+	reloadable := make(map[string]bool)
+	for _, name := range reloadableSettings {
+		reloadable[name] = true
+		updatedValue.FieldByName(name).Set(loadedValue.FieldByName(name))
+	}
+	for i := 0; i < oldValue.NumField(); i++ {
+		name := oldValue.Type().Field(i).Name
+		if !reloadable[name] && !reflect.DeepEqual(oldValue.Field(i).Interface(), loadedValue.Field(i).Interface()) {
+			configLog.Warnf("%s changed, restart Cortex to use it", name)
+		}
+	}
+	configMu.Lock()
+	config = updated
+	configMu.Unlock()
+	configLog.Infof("Reloaded configuration: %s", redactedConfigJSON(updated))
+	for _, reloader := range configReloaders {
+		reloader(old, updated)
+	}
+}
+
+//watchCortexConfig reloads the config on SIGHUP, and when the file changes
+func watchCortexConfig() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	lastChange := configModTime()
+	ticker := time.NewTicker(configPollInterval)
+	for {
+		select {
+		case <-hangup:
+			configLog.Infof("Got SIGHUP, reloading %s", configFile)
+			lastChange = configModTime()
+			reloadCortexConfig()
+		case <-ticker.C:
+			changed := configModTime()
+			if changed.Equal(lastChange) {
+				continue
+			}
+			lastChange = changed
+			configLog.Infof("%s changed, reloading", configFile)
+			reloadCortexConfig()
+		}
+	}
+}
+
+func configModTime() time.Time {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
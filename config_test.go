@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCortexConfigExample(t *testing.T) {
+	_, errs := loadCortexConfig("cortex.config.json.example")
+	if len(errs) > 0 {
+		t.Errorf("The example config has problems:\n%s", joinErrors(errs))
+	}
+}
+
+func TestParseCortexConfigErrors(t *testing.T) {
+	data := `{
+  "httpPort": "70a70",
+  "flowdockAcessToken": "typo",
+  "activation": {
+    "mission-control": "always,sometimes"
+  },
+  "trackers": {
+    "ops": {"type": "trac", "project": "OPS", "tokn": "x"},
+    "huston": {"project": "fmpwizard/go-cortex", "allowedUsers": ["fmpwizard", "irc:diego"]}
+  },
+  "conversationTimeout": "soon"
+}`
+	_, errs := parseCortexConfig("cortex.json", []byte(data))
+	expected := []string{
+		`cortex.json:2: httpPort should be a port number, not "70a70"`,
+		`cortex.json:3: unknown setting flowdockAcessToken`,
+		`cortex.json:5: unknown activation rule "sometimes" for mission-control, use always, mention, prefix or private`,
+		`cortex.json:8: unknown setting trackers.ops.tokn`,
+		`cortex.json:8: unknown tracker type "trac" for ops, use github, gitlab, gitea or jira`,
+		`cortex.json:9: "fmpwizard" should name the chat too, like flowdock:fmpwizard`,
+		`cortex.json:9: "irc:diego" can't be allowed, anybody can take a nick on IRC`,
+		`cortex.json:11: conversationTimeout should be a duration like 5m, not "soon"`,
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("parseCortexConfig gave\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestParseCortexConfigSyntaxAndTypes(t *testing.T) {
+	_, errs := parseCortexConfig("cortex.json", []byte("{\n  \"flows\": \"a\",\n  \"httpPort\" 7070\n}"))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "cortex.json:3: ") {
+		t.Errorf("parseCortexConfig gave %v", errs)
+	}
+	_, errs = parseCortexConfig("cortex.json", []byte("{\n  \"flows\": \"a\",\n  \"httpPort\": 7070\n}"))
+	if len(errs) != 1 || errs[0].Error() != "cortex.json:3: httpPort should be a string, not a number" {
+		t.Errorf("parseCortexConfig gave %v", errs)
+	}
+}
+
+func TestRedactedConfig(t *testing.T) {
+	c := CortexConfig{
+		WitAccessToken: "wit-secret",
+		IRCPassword:    "",
+		Flows:          "fmpwizard/huston",
+		Trackers:       map[string]TrackerConfig{"ops": {Type: "jira", Token: "jira-secret"}},
+	}
+	text := redactedConfigJSON(c)
+	if strings.Contains(text, "secret") || !strings.Contains(text, `"WitAccessToken":"[redacted]"`) ||
+		!strings.Contains(text, `"IRCPassword":""`) || !strings.Contains(text, "fmpwizard/huston") {
+		t.Errorf("redactedConfigJSON gave %s", text)
+	}
+	if c.Trackers["ops"].Token != "jira-secret" {
+		t.Error("redactedConfig changed the config")
+	}
+}
+
+func TestReloadCortexConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, oldConfig, oldReloaders := configFile, config, configReloaders
+	defer func() { configFile, config, configReloaders = oldFile, oldConfig, oldReloaders }()
+
+	configFile = filepath.Join(dir, "cortex.config.json")
+	ioutil.WriteFile(configFile, []byte(`{"httpPort": "7070", "flows": "fmpwizard/huston"}`), 0600)
+	readCortexConfig()
+	var reloaded []string
+	configReloaders = []func(old, current CortexConfig){func(old, current CortexConfig) {
+		reloaded = append(reloaded, old.Flows+" -> "+current.Flows)
+	}}
+
+	ioutil.WriteFile(configFile, []byte(`{"httpPort": "8080", "flows": "fmpwizard/ops", "commandPrefix": "hey cortex,"}`), 0600)
+	reloadCortexConfig()
+	current := currentConfig()
+	if current.Flows != "fmpwizard/ops" || current.CommandPrefix != "hey cortex," || current.HttpPort != "7070" {
+		t.Errorf("Reload gave %+v", current)
+	}
+	if len(reloaded) != 1 || reloaded[0] != "fmpwizard/huston -> fmpwizard/ops" {
+		t.Errorf("Reloaders got %+v", reloaded)
+	}
+
+	//a broken file keeps what we have
+	ioutil.WriteFile(configFile, []byte(`{"flows": "fmpwizard/other",}`), 0600)
+	reloadCortexConfig()
+	if currentConfig().Flows != "fmpwizard/ops" || len(reloaded) != 1 {
+		t.Errorf("A broken config was applied, %+v", currentConfig())
+	}
+}
+
+//run with -race, the chats read the config while it reloads
+func TestReloadWhileReading(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldFile, oldConfig, oldReloaders := configFile, config, configReloaders
+	defer func() { configFile, config, configReloaders = oldFile, oldConfig, oldReloaders }()
+	configFile = filepath.Join(dir, "cortex.config.json")
+	ioutil.WriteFile(configFile, []byte(`{"witAPIURL": "http://wit.internal/", "flows": "fmpwizard/huston"}`), 0600)
+	readCortexConfig()
+	configReloaders = nil
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 20; i++ {
+			reloadCortexConfig()
+		}
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			if witAPIURL() != "http://wit.internal" {
+				t.Fatalf("witAPIURL is %s", witAPIURL())
+			}
+		}
+	}
+}
+
+func TestParseCortexConfigYAML(t *testing.T) {
+	data := `httpPort: "7070"
+flows: fmpwizard/huston
+flowsTicketsUrls:
+  - huston: https://github.com/fmpwizard/go-cortex/issues/
+trackers:
+  ops:
+    type: trac
+    project: OPS
+unitDecimals: 3
+`
+	parsed, errs := parseCortexConfig("cortex.yaml", []byte(data))
+	if len(errs) != 1 || errs[0].Error() != `cortex.yaml:7: unknown tracker type "trac" for ops, use github, gitlab, gitea or jira` {
+		t.Errorf("parseCortexConfig gave %v", errs)
+	}
+	if parsed.HttpPort != "7070" || parsed.FlowsTicketsUrls[0]["huston"] == "" || *parsed.UnitDecimals != 3 {
+		t.Errorf("parseCortexConfig gave %+v", parsed)
+	}
+	_, errs = parseCortexConfig("cortex.yml", []byte("flows: a\nhttpPort: 7070\n"))
+	if len(errs) != 1 || errs[0].Error() != "cortex.yml:2: httpPort should be a string, not a number" {
+		t.Errorf("parseCortexConfig gave %v", errs)
+	}
+}
+
+func TestParseCortexConfigTOML(t *testing.T) {
+	data := `httpPort = "7070"
+flows = "fmpwizard/huston"
+conversationTimeout = "soon"
+
+[[flowsTicketsUrls]]
+huston = "https://github.com/fmpwizard/go-cortex/issues/"
+
+[trackers.ops]
+type = "jira"
+url = "https://jira.example.com"
+tokn = "x"
+`
+	parsed, errs := parseCortexConfig("cortex.toml", []byte(data))
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	expected := []string{
+		`cortex.toml:3: conversationTimeout should be a duration like 5m, not "soon"`,
+		`cortex.toml:11: unknown setting trackers.ops.tokn`,
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("parseCortexConfig gave\n%s", strings.Join(got, "\n"))
+	}
+	if parsed.Flows != "fmpwizard/huston" || parsed.Trackers["ops"].URL != "https://jira.example.com" {
+		t.Errorf("parseCortexConfig gave %+v", parsed)
+	}
+	_, errs = parseCortexConfig("cortex.toml", []byte("flows = \"a\"\nhttpPort = 7070 7070\n"))
+	if len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "cortex.toml:2: ") {
+		t.Errorf("parseCortexConfig gave %v", errs)
+	}
+}
+
+func TestApplyConfigEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "wit")
+	ioutil.WriteFile(secret, []byte("wit-secret\n"), 0600)
+
+	c := CortexConfig{HttpPort: "7070", Flows: "fmpwizard/huston", Activation: map[string]string{"*": "mention"}}
+	fromEnv, errs := applyConfigEnv(&c, []string{
+		"CORTEX_HTTP_PORT=8080",
+		"CORTEX_WIT_ACCESS_TOKEN_FILE=" + secret,
+		"CORTEX_IRC_USE_TLS=true",
+		"CORTEX_UNIT_DECIMALS=1",
+		"CORTEX_GITHUB_ALLOWED_USERS=flowdock:fmpwizard, slack:U024BE7LH",
+		`CORTEX_ACTIVATION={"mission-control": "always"}`,
+		"CORTEX_PORT=tcp://10.0.0.1:7070",
+		"HOME=/root",
+	})
+	if len(errs) > 0 {
+		t.Fatalf("applyConfigEnv gave %v", errs)
+	}
+	if c.HttpPort != "8080" || c.WitAccessToken != "wit-secret" || !c.IRCUseTLS || *c.UnitDecimals != 1 ||
+		strings.Join(c.GithubAllowedUsers, ",") != "flowdock:fmpwizard,slack:U024BE7LH" || c.Flows != "fmpwizard/huston" ||
+		len(c.Activation) != 1 || c.Activation["mission-control"] != "always" {
+		t.Errorf("applyConfigEnv gave %+v", c)
+	}
+	if fromEnv["httpport"] != "CORTEX_HTTP_PORT" || fromEnv["witaccesstoken"] != "CORTEX_WIT_ACCESS_TOKEN_FILE" {
+		t.Errorf("applyConfigEnv says these came from the environment %v", fromEnv)
+	}
+
+	_, errs = applyConfigEnv(&c, []string{"CORTEX_IRC_USE_TLS=sometimes", "CORTEX_WIT_ACCESS_TOKEN=a", "CORTEX_WITACCESSTOKEN=b"})
+	if len(errs) != 2 || errs[0].Error() != `CORTEX_IRC_USE_TLS: should be true or false, not "sometimes"` ||
+		errs[1].Error() != "CORTEX_WIT_ACCESS_TOKEN: CORTEX_WITACCESSTOKEN sets the same setting, use one of them" {
+		t.Errorf("applyConfigEnv gave %v", errs)
+	}
+}
+
+func TestLoadCortexConfigPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "cortex.yaml")
+	ioutil.WriteFile(name, []byte("httpPort: \"7070\"\nflows: fmpwizard/huston\ntrackers:\n  ops:\n    type: jira\n    url: https://jira.example.com\n    token: file:"+filepath.Join(dir, "jira")+"\n"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "jira"), []byte("jira-secret\n"), 0600)
+	os.Setenv("CORTEX_FLOWS", "fmpwizard/ops")
+	os.Setenv("CORTEX_SLACK_BOT_TOKEN", "xoxb")
+	defer os.Unsetenv("CORTEX_FLOWS")
+	defer os.Unsetenv("CORTEX_SLACK_BOT_TOKEN")
+
+	loaded, errs := loadCortexConfig(name)
+	if len(errs) != 1 || errs[0].Error() != "CORTEX_SLACK_BOT_TOKEN: slackSigningSecret is needed to check the events Slack sends" {
+		t.Errorf("loadCortexConfig gave %v", errs)
+	}
+	if loaded.HttpPort != "7070" || loaded.Flows != "fmpwizard/ops" || loaded.Trackers["ops"].Token != "jira-secret" {
+		t.Errorf("loadCortexConfig gave %+v", loaded)
+	}
+}
+
+func TestParseCortexConfigHTTP(t *testing.T) {
+	data := `{
+  "httpPort": "7070",
+  "httpBindAddress": "127.0.0.1:7070",
+  "httpPathPrefix": "cortex",
+  "httpWriteTimeout": "forever",
+  "trustedProxies": ["10.0.0.0/8", "proxy"],
+  "tlsCertFile": "/etc/cortex/cert.pem"
+}`
+	_, errs := parseCortexConfig("cortex.json", []byte(data))
+	expected := []string{
+		`cortex.json:3: httpBindAddress should be an ip or a host name, without the port, not "127.0.0.1:7070"`,
+		`cortex.json:4: httpPathPrefix should be a path like /cortex, not "cortex"`,
+		`cortex.json:5: httpWriteTimeout should be a duration like 30s, not "forever"`,
+		`cortex.json:6: trustedProxies should have ips or ranges like 10.0.0.0/8, "proxy" is not an ip or a range`,
+		`cortex.json:7: https needs both tlsCertFile and tlsKeyFile`,
+	}
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("parseCortexConfig gave\n%s", strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//defaultConversationTimeout is how long Cortex remembers what somebody was
+//talking about, set ConversationTimeout to change it
+const defaultConversationTimeout = 5 * time.Minute
+
+var conversations = newConversationLog()
+
+//conversation is the last intent somebody used, with the entities it ended up
+//with. Missing is the slot we asked them about, if any.
+type conversation struct {
+	Intent  WitMessage
+	Missing string
+	at      time.Time
+}
+
+type conversationLog struct {
+	mu            sync.Mutex
+	conversations map[string]conversation
+}
+
+func newConversationLog() *conversationLog {
+	return &conversationLog{conversations: make(map[string]conversation)}
+}
+
+func conversationTimeout() time.Duration {
+	setting := currentConfig().ConversationTimeout
+	if setting == "" {
+		return defaultConversationTimeout
+	}
+	timeout, err := time.ParseDuration(setting)
+	if err != nil {
+		chatLog.Warnf("Invalid ConversationTimeout %s, using %v: %v", setting, defaultConversationTimeout, err)
+		return defaultConversationTimeout
+	}
+	return timeout
+}
+
+//conversationKeys gives you where we remember what the sender said, in the
+//thread first and then in the channel. Messages that start a thread of their
+//own only use the channel, so "and 4 too" works on chats without threads.
+func conversationKeys(adapter ChatAdapter, msg ChatMessage) []string {
+	channel := adapter.Name() + "\x00" + msg.Channel + "\x00" + msg.Sender
+	if msg.ThreadID == "" || msg.ThreadID == msg.ID || msg.ThreadID == msg.Channel {
+		return []string{channel}
+	}
+	return []string{channel + "\x00" + msg.ThreadID, channel}
+}
+
+func (l *conversationLog) get(keys []string) (conversation, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		c, ok := l.conversations[key]
+		if ok && time.Since(c.at) <= conversationTimeout() {
+			return c, true
+		}
+	}
+	return conversation{}, false
+}
+
+func (l *conversationLog) put(keys []string, c conversation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	timeout := conversationTimeout()
+	for k, old := range l.conversations {
+		if now.Sub(old.at) > timeout {
+			delete(l.conversations, k)
+		}
+	}
+	c.at = now
+	for _, key := range keys {
+		l.conversations[key] = c
+	}
+}
+
+//resolve fills what the intent is missing with what the sender said before,
+//and remembers it for next time. When a required slot is still missing we
+//give you the question to ask, and the intent should not run yet.
+func (l *conversationLog) resolve(keys []string, intent WitMessage) (WitMessage, string) {
+	previous, ok := l.get(keys)
+	if ok {
+		intent = withConversation(intent, previous)
+	}
+	if intent.Outcome.Intent == "" {
+		return intent, ""
+	}
+	slot, question := missingSlot(intent)
+	l.put(keys, conversation{Intent: intent, Missing: slot})
+	return intent, question
+}
+
+//withConversation uses the previous intent when the new message has none
+//but gives it one of its slots, like "and 4 too", or when it answers the
+//question we asked. A message without either, like "thanks", is not a
+//follow up, and intents without slots never carry over, so we don't file
+//an issue or undo again. Then slots of the same kind of intent come from
+//the previous message, so "now turn it off" knows which light.
+func withConversation(intent WitMessage, previous conversation) WitMessage {
+	lowConfidence := intent.Outcome.Confidence > 0 && intent.Outcome.Confidence < 0.5
+	answered := previous.Missing != "" && hasSlot(intent, previous.Missing)
+	if (intent.Outcome.Intent == "" && suppliesSlot(intent, previous.Intent.Outcome.Intent)) || (answered && lowConfidence) {
+		intent.Outcome.Intent = previous.Intent.Outcome.Intent
+	}
+	if intentFamily(intent.Outcome.Intent) != intentFamily(previous.Intent.Outcome.Intent) {
+		return intent
+	}
+	entities := &intent.Outcome.Entities
+	before := previous.Intent.Outcome.Entities
+	for _, slot := range intentSlots(intent.Outcome.Intent) {
+		if hasSlot(intent, slot) || !hasSlot(previous.Intent, slot) {
+			continue
+		}
+		switch slot {
+		case "light":
+			entities.MultipleNumber = before.MultipleNumber
+			entities.SingleNumber = before.SingleNumber
+		case "on_off":
+			entities.OnOff = before.OnOff
+		case "issue":
+			entities.MultipleNumber = before.MultipleNumber
+			//so ProcessIntent finds the PROJ-123 keys too
+			keys := issueKeyRegexp.FindAllString(previous.Intent.MsgBody, -1)
+			intent.MsgBody = strings.TrimSpace(intent.MsgBody + " " + strings.Join(keys, " "))
+		case "label":
+			entities.Label = before.Label
+		default:
+			all := make(map[string]interface{})
+			for name, value := range intent.Outcome.AllEntities {
+				all[name] = value
+			}
+			all[slot] = previous.Intent.Outcome.AllEntities[slot]
+			intent.Outcome.AllEntities = all
+		}
+	}
+	return intent
+}
+
+//intentFamily groups intents that share slots, "close it" after "what is
+//issue 45" closes 45
+func intentFamily(intent string) string {
+	if strings.HasPrefix(intent, "github") {
+		return "github"
+	}
+	return intent
+}
+
+//intentSlots are the entities an intent needs, in the order we ask for them
+func intentSlots(intent string) []string {
+	switch intent {
+	case "lights":
+		return []string{"light", "on_off"}
+	case "github", "github_close":
+		return []string{"issue"}
+	case "github_label":
+		return []string{"issue", "label"}
+	}
+	//HTTP actions say what they need in Requires
+	return currentConfig().Actions[intent].Requires
+}
+
+//suppliesSlot tells you if the message has any of the slots of the intent
+func suppliesSlot(intent WitMessage, previousIntent string) bool {
+	for _, slot := range intentSlots(previousIntent) {
+		if hasSlot(intent, slot) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSlot(intent WitMessage, slot string) bool {
+	entities := intent.Outcome.Entities
+	switch slot {
+	case "light":
+		return len(entities.MultipleNumber) > 0 || entities.SingleNumber.Body != ""
+	case "on_off":
+		return entities.OnOff.Value != ""
+	case "issue":
+		return len(issueKeys(intent.MsgBody, entities.MultipleNumber)) > 0
+	case "label":
+		return entities.Label.Value != ""
+	}
+	return intent.Outcome.AllEntities[slot] != nil
+}
+
+var slotQuestions = map[string]string{
+	"light":  "Which light?",
+	"on_off": "Should I turn it on or off?",
+	"issue":  "Which issue?",
+	"label":  "Which label should I add?",
+}
+
+//missingSlot gives you the first slot the intent still needs, and what we
+//ask to get it
+func missingSlot(intent WitMessage) (string, string) {
+	for _, slot := range intentSlots(intent.Outcome.Intent) {
+		if hasSlot(intent, slot) {
+			continue
+		}
+		question, ok := slotQuestions[slot]
+		if !ok {
+			question = fmt.Sprintf("Which %s?", strings.Replace(slot, "_", " ", -1))
+		}
+		return slot, question
+	}
+	return "", ""
+}
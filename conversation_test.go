@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWithConversation(t *testing.T) {
+	previous := conversation{Intent: lightsIntent("on", 3)}
+
+	//"and 4 too", Wit found the number but not the intent
+	var intent WitMessage
+	intent.Outcome.Entities.MultipleNumber = []WitNumber{{Value: 4}}
+	intent = withConversation(intent, previous)
+	if intent.Outcome.Intent != "lights" || intent.Outcome.Entities.OnOff.Value != "on" {
+		t.Errorf("withConversation gave %+v", intent.Outcome)
+	}
+
+	//"now turn it off"
+	intent = withConversation(lightsIntent("off"), previous)
+	lights := desiredLights(intent)
+	if !reflect.DeepEqual(lights, []WitArduinoResponse{{3, "off"}}) {
+		t.Errorf("withConversation gave lights %+v", lights)
+	}
+
+	//other intents don't take slots from the lights
+	var github WitMessage
+	github.Outcome.Intent = "github_close"
+	github = withConversation(github, previous)
+	if len(github.Outcome.Entities.MultipleNumber) != 0 {
+		t.Errorf("withConversation gave %+v", github.Outcome)
+	}
+}
+
+func TestWithConversationNotAFollowUp(t *testing.T) {
+	//"thanks", Wit found no intent and no entities
+	var thanks WitMessage
+	thanks.MsgBody = "thanks"
+	for _, previous := range []WitMessage{lightsIntent("on", 3), {MsgBody: "file a bug: it crashes", Outcome: WitMessageOutcome{Intent: "create_issue"}},
+		{Outcome: WitMessageOutcome{Intent: "undo"}}, {Outcome: WitMessageOutcome{Intent: "history"}}} {
+		intent := withConversation(thanks, conversation{Intent: previous})
+		if intent.Outcome.Intent != "" || len(desiredLights(intent)) != 0 {
+			t.Errorf("After %s, thanks gave %+v", previous.Outcome.Intent, intent.Outcome)
+		}
+	}
+}
+
+func TestWithConversationIssues(t *testing.T) {
+	var lookup WitMessage
+	lookup.MsgBody = "what is OPS-7 about"
+	lookup.Outcome.Intent = "github"
+	lookup.Outcome.Entities.MultipleNumber = []WitNumber{{Value: 7}}
+
+	var closeIntent WitMessage
+	closeIntent.MsgBody = "close it"
+	closeIntent.Outcome.Intent = "github_close"
+	closeIntent = withConversation(closeIntent, conversation{Intent: lookup})
+	ret := ProcessIntent(context.Background(), closeIntent)
+	if !reflect.DeepEqual(ret.Issues.keys, []string{"OPS-7"}) || ret.Issues.Action != "close" {
+		t.Errorf("ProcessIntent gave %+v", ret.Issues)
+	}
+}
+
+func TestConversationAnswersQuestion(t *testing.T) {
+	conversations := newConversationLog()
+	keys := []string{"fake\x00C1\x00U1"}
+
+	_, question := conversations.resolve(keys, lightsIntent("on"))
+	if question != "Which light?" {
+		t.Errorf("resolve asked %q", question)
+	}
+
+	//Wit isn't sure what "3" is
+	var answer WitMessage
+	answer.Outcome.Intent = "github"
+	answer.Outcome.Confidence = 0.3
+	answer.Outcome.Entities.MultipleNumber = []WitNumber{{Value: 3}}
+	intent, question := conversations.resolve(keys, answer)
+	if question != "" || intent.Outcome.Intent != "lights" || intent.Outcome.Entities.OnOff.Value != "on" {
+		t.Errorf("resolve gave %+v, asked %q", intent.Outcome, question)
+	}
+}
+
+func TestConversationExpires(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.ConversationTimeout = "1ms"
+	conversations := newConversationLog()
+	keys := []string{"fake\x00C1\x00U1"}
+	conversations.resolve(keys, lightsIntent("on", 3))
+	time.Sleep(5 * time.Millisecond)
+	_, question := conversations.resolve(keys, lightsIntent("off"))
+	if question != "Which light?" {
+		t.Errorf("resolve used an expired conversation, asked %q", question)
+	}
+}
+
+func TestConversationKeys(t *testing.T) {
+	adapter := &fakeAdapter{}
+	keys := conversationKeys(adapter, ChatMessage{ID: "10", ThreadID: "10", Channel: "C1", Sender: "U1"})
+	if len(keys) != 1 {
+		t.Errorf("A message outside a thread gave keys %q", keys)
+	}
+	keys = conversationKeys(adapter, ChatMessage{ID: "11", ThreadID: "10", Channel: "C1", Sender: "U1"})
+	if len(keys) != 2 || keys[0] != "fake\x00C1\x00U1\x0010" {
+		t.Errorf("A message in a thread gave keys %q", keys)
+	}
+}
+
+func TestHandleChatMessageFollowUp(t *testing.T) {
+	wit := fakeWitLights()
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	lightStates = make(map[int]string)
+	conversations = newConversationLog()
+
+	adapter := &fakeAdapter{}
+	handleChatMessage(adapter, ChatMessage{ID: "20", ThreadID: "20", Channel: "C1", Sender: "U1", Text: "turn light 3 on"})
+	handleChatMessage(adapter, ChatMessage{ID: "21", ThreadID: "21", Channel: "C1", Sender: "U1", Text: "now turn it off"})
+	handleChatMessage(adapter, ChatMessage{ID: "22", ThreadID: "22", Channel: "C1", Sender: "U2", Text: "turn the light on"})
+	expected := []string{"Turning light 3 on", "Turning light 3 off", "Which light?"}
+	if !reflect.DeepEqual(adapter.replies, expected) {
+		t.Errorf("Replies were %q", adapter.replies)
+	}
+}
+
+func TestHandleChatMessageThanks(t *testing.T) {
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query().Get("q")
+		if q == "thanks" {
+			w.Write([]byte(`{"msg_body": "thanks", "outcome": {"confidence": 0.2, "entities": {}}}`))
+			return
+		}
+		w.Write([]byte(`{"msg_body": "turn light 3 on", "outcome": {"intent": "lights", "confidence": 1, "entities": {"on_off": {"value": "on"}, "github_issue": [{"value": 3, "body": "3"}]}}}`))
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	lightStates = make(map[int]string)
+	conversations = newConversationLog()
+
+	adapter := &fakeAdapter{}
+	handleChatMessage(adapter, ChatMessage{ID: "30", ThreadID: "30", Channel: "C1", Sender: "U1", Text: "turn light 3 on"})
+	lightStates[3] = "off"
+	handleChatMessage(adapter, ChatMessage{ID: "31", ThreadID: "31", Channel: "C1", Sender: "U1", Text: "thanks"})
+	if lightState(3) != "off" || len(adapter.replies) != 1 {
+		t.Errorf("thanks ran a command, light 3 is %s and replies were %q", lightState(3), adapter.replies)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//recentCommandsSize is how many commands the dashboard shows
+const recentCommandsSize = 100
+
+var recentCommands = newCommandLog(recentCommandsSize)
+
+//commandRecord is a command from any channel, with what Wit understood and
+//what we answered
+type commandRecord struct {
+	Time       time.Time `json:"time"`
+	Channel    string    `json:"channel"`
+	Sender     string    `json:"sender,omitempty"`
+	Text       string    `json:"text"`
+	Intent     string    `json:"intent"`
+	Confidence float64   `json:"confidence"`
+	Replies    []string  `json:"replies,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func newCommandRecord(channel, sender, text string, intent WitMessage, replies []ChatReply, err error) commandRecord {
+	record := commandRecord{
+		Time:       time.Now(),
+		Channel:    channel,
+		Sender:     sender,
+		Text:       text,
+		Intent:     intent.Outcome.Intent,
+		Confidence: intent.Outcome.Confidence,
+	}
+	for _, reply := range replies {
+		record.Replies = append(record.Replies, reply.Text)
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return record
+}
+
+//commandLog keeps the last size commands
+type commandLog struct {
+	mu      sync.Mutex
+	size    int
+	records []commandRecord
+}
+
+func newCommandLog(size int) *commandLog {
+	return &commandLog{size: size}
+}
+
+func (l *commandLog) add(record commandRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.records = append(l.records, record)
+	if len(l.records) > l.size {
+		l.records = l.records[len(l.records)-l.size:]
+	}
+}
+
+//list gives you the commands, newest first
+func (l *commandLog) list() []commandRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	records := make([]commandRecord, 0, len(l.records))
+	for i := len(l.records) - 1; i >= 0; i-- {
+		records = append(records, l.records[i])
+	}
+	return records
+}
+
+type dashboardLight struct {
+	Number int    `json:"number"`
+	Name   string `json:"name,omitempty"`
+	State  string `json:"state"`
+}
+
+type dashboardDevice struct {
+	Name   string `json:"name"`
+	Port   string `json:"port"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+//dashboardState is everything the dashboard shows, Connections are the same
+//checks /readyz uses
+type dashboardState struct {
+	Lights      []dashboardLight       `json:"lights"`
+	Devices     []dashboardDevice      `json:"devices"`
+	Connections map[string]healthCheck `json:"connections"`
+	Commands    []commandRecord        `json:"commands"`
+}
+
+//dashboardLights are the lights in the Lights setting and the ones we
+//switched since we started, by number
+func dashboardLights() []dashboardLight {
+	names := make(map[int]string)
+	for key, name := range currentConfig().Lights {
+		light, err := strconv.Atoi(key)
+		if err == nil {
+			names[light] = name
+		}
+	}
+	lightStatesMu.Lock()
+	for light := range lightStates {
+		if _, ok := names[light]; !ok {
+			names[light] = ""
+		}
+	}
+	lightStatesMu.Unlock()
+
+	lights := make([]dashboardLight, 0, len(names))
+	for light, name := range names {
+		lights = append(lights, dashboardLight{Number: light, Name: name, State: lightState(light)})
+	}
+	sort.Slice(lights, func(i, j int) bool { return lights[i].Number < lights[j].Number })
+	return lights
+}
+
+func getDashboardState() dashboardState {
+	serial := checkSerial()
+	return dashboardState{
+		Lights:      dashboardLights(),
+		Devices:     []dashboardDevice{{Name: "arduino", Port: c.Name, OK: serial.OK, Detail: serial.Detail}},
+		Connections: healthChecks(),
+		Commands:    recentCommands.list(),
+	}
+}
+
+//DashboardHandler serves the dashboard under /dashboard/, the page, its
+//assets and the json it talks to
+func DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !dashboardAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Cortex"`)
+		http.Error(w, "wrong password", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/dashboard":
+		//relative, so it works behind HttpPathPrefix
+		w.Header().Set("Location", "dashboard/")
+		w.WriteHeader(http.StatusFound)
+	case "/dashboard/":
+		serveDashboardAsset(w, "text/html; charset=utf-8", dashboardHTML)
+	case "/dashboard/app.css":
+		serveDashboardAsset(w, "text/css; charset=utf-8", dashboardCSS)
+	case "/dashboard/app.js":
+		serveDashboardAsset(w, "application/javascript; charset=utf-8", dashboardJS)
+	case "/dashboard/state":
+		writeDashboardJSON(w, http.StatusOK, getDashboardState())
+	case "/dashboard/lights":
+		dashboardLightHandler(w, r)
+	case "/dashboard/command":
+		dashboardCommandHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//dashboardAuthorized checks DashboardPassword with basic auth, any user name
+//works
+func dashboardAuthorized(r *http.Request) bool {
+	password := currentConfig().DashboardPassword
+	if password == "" {
+		return true
+	}
+	_, given, ok := r.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(given), []byte(password)) == 1
+}
+
+//passwordAuthorized is dashboardAuthorized for what shows more than the
+//dashboard, every event and the webhooks. Those are refused until there is a
+//DashboardPassword.
+func passwordAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if currentConfig().DashboardPassword == "" {
+		http.Error(w, "set dashboardPassword to use this", http.StatusForbidden)
+		return false
+	}
+	if !dashboardAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Cortex"`)
+		http.Error(w, "wrong password", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func serveDashboardAsset(w http.ResponseWriter, contentType, asset string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "default-src 'self'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	fmt.Fprint(w, asset)
+}
+
+func writeDashboardJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+type dashboardError struct {
+	Error string `json:"error"`
+}
+
+//readDashboardRequest decodes the json body of a POST. Only taking json
+//means other sites can't send the dashboard a form.
+func readDashboardRequest(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if r.Method != "POST" || mediaType != "application/json" {
+		writeDashboardJSON(w, http.StatusBadRequest, dashboardError{"send a POST with a json body"})
+		return false
+	}
+	err := json.NewDecoder(r.Body).Decode(v)
+	if err != nil {
+		writeDashboardJSON(w, http.StatusBadRequest, dashboardError{"invalid json: " + err.Error()})
+		return false
+	}
+	if !beginCommand() {
+		writeDashboardJSON(w, http.StatusServiceUnavailable, dashboardError{"Cortex is stopping"})
+		return false
+	}
+	return true
+}
+
+type dashboardLightRequest struct {
+	Light int    `json:"light"`
+	State string `json:"state"`
+}
+
+//dashboardLightHandler switches a light, like "turn light 3 on" would
+func dashboardLightHandler(w http.ResponseWriter, r *http.Request) {
+	var req dashboardLightRequest
+	if !readDashboardRequest(w, r, &req) {
+		return
+	}
+	defer endCommand()
+	if req.Light < 1 || (req.State != "on" && req.State != "off") {
+		writeDashboardJSON(w, http.StatusBadRequest, dashboardError{"light should be a number and state on or off"})
+		return
+	}
+	ctx := requestContext(w, r)
+	action := switchLight(ctx, req.Light, req.State)
+	intent := WitMessage{Outcome: WitMessageOutcome{Intent: "lights", Confidence: 1}}
+	countCommand("dashboard", intent, nil)
+	text := fmt.Sprintf("turn light %d %s", req.Light, req.State)
+	recentCommands.add(newCommandRecord("dashboard", r.RemoteAddr, text, intent, lightReplies([]lightAction{action}, nil), nil))
+	writeDashboardJSON(w, http.StatusOK, dashboardLight{Number: req.Light, Name: currentConfig().Lights[strconv.Itoa(req.Light)], State: req.State})
+}
+
+type dashboardCommandRequest struct {
+	Text string `json:"text"`
+}
+
+type dashboardCommandResponse struct {
+	Intent     string   `json:"intent"`
+	Confidence float64  `json:"confidence"`
+	Replies    []string `json:"replies"`
+}
+
+//dashboardCommandHandler runs the text the way /wit does
+func dashboardCommandHandler(w http.ResponseWriter, r *http.Request) {
+	var req dashboardCommandRequest
+	if !readDashboardRequest(w, r, &req) {
+		return
+	}
+	defer endCommand()
+	text := strings.TrimSpace(req.Text)
+	if text == "" {
+		writeDashboardJSON(w, http.StatusBadRequest, dashboardError{"what should I do?"})
+		return
+	}
+	intent, ret, err := runCommand(requestContext(w, r), "dashboard", r.RemoteAddr, text)
+	if err != nil {
+		writeDashboardJSON(w, http.StatusBadGateway, dashboardError{err.Error()})
+		return
+	}
+	res := dashboardCommandResponse{Intent: intent.Outcome.Intent, Confidence: intent.Outcome.Confidence, Replies: []string{}}
+	for _, reply := range commandReplies(ret) {
+		res.Replies = append(res.Replies, reply.Text)
+	}
+	writeDashboardJSON(w, http.StatusOK, res)
+}
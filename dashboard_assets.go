@@ -0,0 +1,252 @@
+package main
+
+//The dashboard page, everything it needs is here so it works without
+//internet access. The paths are relative, so it also works behind
+//HttpPathPrefix.
+
+const dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Cortex</title>
+<link rel="stylesheet" href="app.css">
+</head>
+<body>
+<header>
+  <h1>Cortex</h1>
+  <ul id="connections"></ul>
+</header>
+<main>
+  <section>
+    <h2>Command</h2>
+    <form id="command">
+      <input id="text" type="text" placeholder="turn light 3 on" autocomplete="off" autofocus>
+      <button type="submit">Send</button>
+    </form>
+    <p id="answer"></p>
+  </section>
+  <section>
+    <h2>Lights</h2>
+    <ul id="lights" class="cards"></ul>
+    <p id="no-lights" hidden>No lights yet, add them to the lights setting or switch one with a command.</p>
+  </section>
+  <section>
+    <h2>Devices</h2>
+    <ul id="devices" class="cards"></ul>
+  </section>
+  <section>
+    <h2>Recent commands</h2>
+    <table>
+      <thead><tr><th>Time</th><th>Channel</th><th>Sender</th><th>Command</th><th>Intent</th><th>Confidence</th><th>Answer</th></tr></thead>
+      <tbody id="commands"></tbody>
+    </table>
+  </section>
+</main>
+<script src="app.js"></script>
+</body>
+</html>
+`
+
+const dashboardCSS = `body {
+  font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif;
+  margin: 0;
+  color: #222;
+  background: #f4f5f7;
+}
+header {
+  display: flex;
+  flex-wrap: wrap;
+  align-items: center;
+  justify-content: space-between;
+  padding: 0.5em 1.5em;
+  background: #263238;
+  color: #fff;
+}
+h1 { margin: 0; font-size: 1.4em; }
+h2 { font-size: 1.1em; }
+main { padding: 0 1.5em 2em; }
+ul { list-style: none; padding: 0; margin: 0; }
+#connections li {
+  display: inline-block;
+  margin-left: 0.5em;
+  padding: 0.2em 0.6em;
+  border-radius: 1em;
+  font-size: 0.85em;
+}
+.ok { background: #2e7d32; color: #fff; }
+.down { background: #c62828; color: #fff; }
+.cards { display: flex; flex-wrap: wrap; gap: 0.75em; }
+.cards li {
+  background: #fff;
+  border-radius: 6px;
+  padding: 0.75em 1em;
+  min-width: 9em;
+  box-shadow: 0 1px 2px rgba(0, 0, 0, 0.15);
+}
+.cards .detail { display: block; font-size: 0.8em; color: #666; }
+.switch { margin-top: 0.5em; width: 100%; padding: 0.4em; border: 0; border-radius: 4px; cursor: pointer; }
+.switch.on { background: #fdd835; }
+.switch.off { background: #cfd8dc; }
+form { display: flex; gap: 0.5em; max-width: 40em; }
+input[type=text] { flex: 1; padding: 0.5em; font-size: 1em; }
+button[type=submit] { padding: 0.5em 1em; }
+table { border-collapse: collapse; width: 100%; background: #fff; font-size: 0.9em; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #e0e0e0; }
+.error { color: #c62828; }
+`
+
+const dashboardJS = `(function () {
+  "use strict";
+
+  function el(tag, text, className) {
+    var node = document.createElement(tag);
+    if (text !== undefined) {
+      node.textContent = text;
+    }
+    if (className) {
+      node.className = className;
+    }
+    return node;
+  }
+
+  function replace(id, nodes) {
+    var parent = document.getElementById(id);
+    while (parent.firstChild) {
+      parent.removeChild(parent.firstChild);
+    }
+    nodes.forEach(function (node) { parent.appendChild(node); });
+  }
+
+  function post(path, body) {
+    return fetch(path, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {"Content-Type": "application/json"},
+      body: JSON.stringify(body)
+    }).then(function (res) {
+      return res.json().then(function (data) {
+        if (!res.ok) {
+          throw new Error(data.error || res.statusText);
+        }
+        return data;
+      });
+    });
+  }
+
+  function renderConnections(connections) {
+    replace("connections", Object.keys(connections).sort().map(function (name) {
+      var check = connections[name];
+      var item = el("li", name, check.ok ? "ok" : "down");
+      item.title = check.detail || "";
+      return item;
+    }));
+  }
+
+  function renderLights(lights) {
+    document.getElementById("no-lights").hidden = lights.length > 0;
+    replace("lights", lights.map(function (light) {
+      var item = el("li");
+      item.appendChild(el("strong", light.name || "Light " + light.number));
+      item.appendChild(el("span", light.name ? "light " + light.number : "", "detail"));
+      var on = light.state === "on";
+      var button = el("button", on ? "On" : (light.state === "off" ? "Off" : "Unknown"), "switch " + (on ? "on" : "off"));
+      button.addEventListener("click", function () {
+        post("lights", {light: light.number, state: on ? "off" : "on"}).then(refresh, showError);
+      });
+      item.appendChild(button);
+      return item;
+    }));
+  }
+
+  function renderDevices(devices) {
+    replace("devices", devices.map(function (device) {
+      var item = el("li");
+      item.appendChild(el("strong", device.name));
+      item.appendChild(el("span", device.port || "not plugged in", "detail"));
+      item.appendChild(el("span", device.detail || "", device.ok ? "detail" : "detail error"));
+      return item;
+    }));
+  }
+
+  function renderCommands(commands) {
+    replace("commands", commands.map(function (command) {
+      var row = el("tr");
+      row.appendChild(el("td", new Date(command.time).toLocaleTimeString()));
+      row.appendChild(el("td", command.channel));
+      row.appendChild(el("td", command.sender || ""));
+      row.appendChild(el("td", command.text));
+      row.appendChild(el("td", command.intent || "none"));
+      row.appendChild(el("td", command.confidence ? command.confidence.toFixed(2) : ""));
+      if (command.error) {
+        row.appendChild(el("td", command.error, "error"));
+      } else {
+        row.appendChild(el("td", (command.replies || []).join(" ")));
+      }
+      return row;
+    }));
+  }
+
+  function showError(err) {
+    var answer = document.getElementById("answer");
+    answer.className = "error";
+    answer.textContent = err.message;
+  }
+
+  function refresh() {
+    return fetch("state", {credentials: "same-origin"}).then(function (res) {
+      return res.json();
+    }).then(function (state) {
+      renderConnections(state.connections);
+      renderLights(state.lights);
+      renderDevices(state.devices);
+      renderCommands(state.commands);
+    }).catch(showError);
+  }
+
+  document.getElementById("command").addEventListener("submit", function (event) {
+    event.preventDefault();
+    var input = document.getElementById("text");
+    var answer = document.getElementById("answer");
+    post("command", {text: input.value}).then(function (res) {
+      answer.className = "";
+      answer.textContent = (res.replies.length ? res.replies.join(" ") : "Done") +
+        " (" + (res.intent || "no intent") + ", confidence " + res.confidence.toFixed(2) + ")";
+      input.value = "";
+      refresh();
+    }, showError);
+  });
+
+  //the event stream tells us when something changed, polling is for
+  //browsers without it and for what has no events, like Wit going down
+  var pending = null;
+  function refreshSoon() {
+    if (pending === null) {
+      pending = setTimeout(function () {
+        pending = null;
+        refresh();
+      }, 200);
+    }
+  }
+  var timer = setInterval(refresh, 5000);
+  if (window.EventSource) {
+    //without a dashboardPassword there is no stream, and we keep polling
+    var stream = new EventSource("../events");
+    ["light.changed", "intent.parsed", "chat.connected", "chat.disconnected", "error"].forEach(function (type) {
+      stream.addEventListener(type, refreshSoon);
+    });
+    stream.addEventListener("open", function () {
+      clearInterval(timer);
+      timer = setInterval(refresh, 30000);
+    });
+    stream.addEventListener("error", function () {
+      if (stream.readyState === EventSource.CLOSED) {
+        clearInterval(timer);
+        timer = setInterval(refresh, 5000);
+      }
+    });
+  }
+
+  refresh();
+})();
+`
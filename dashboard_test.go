@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommandLog(t *testing.T) {
+	log := newCommandLog(2)
+	for _, text := range []string{"one", "two", "three"} {
+		log.add(commandRecord{Text: text})
+	}
+	records := log.list()
+	if len(records) != 2 || records[0].Text != "three" || records[1].Text != "two" {
+		t.Errorf("The log has %+v", records)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	wit := fakeWitLights()
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	config.Lights = map[string]string{"2": "kitchen"}
+	lightStates = make(map[int]string)
+	recentCommands = newCommandLog(recentCommandsSize)
+	handler := httpHandler("/cortex", http.HandlerFunc(DashboardHandler))
+
+	serve := func(method, path, contentType, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := serve("GET", "/cortex/dashboard", "", "")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "dashboard/" {
+		t.Errorf("/dashboard gave %d to %s", rec.Code, rec.Header().Get("Location"))
+	}
+	rec = serve("GET", "/cortex/dashboard/", "", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `<script src="app.js">`) {
+		t.Errorf("/dashboard/ gave %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("POST", "/cortex/dashboard/command", "application/json", `{"text": "turn light 4 on"}`)
+	var answer dashboardCommandResponse
+	json.Unmarshal(rec.Body.Bytes(), &answer)
+	if rec.Code != http.StatusOK || answer.Intent != "lights" || strings.Join(answer.Replies, "") != "Turning light 4 on" {
+		t.Errorf("The command gave %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("POST", "/cortex/dashboard/lights", "text/plain", `{"light": 2, "state": "on"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("A form post gave %d", rec.Code)
+	}
+	rec = serve("POST", "/cortex/dashboard/lights", "application/json", `{"light": 2, "state": "on"}`)
+	if rec.Code != http.StatusOK || lightState(2) != "on" {
+		t.Errorf("Switching light 2 gave %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = serve("GET", "/cortex/dashboard/state", "", "")
+	var state dashboardState
+	json.Unmarshal(rec.Body.Bytes(), &state)
+	if len(state.Lights) != 2 || state.Lights[0] != (dashboardLight{2, "kitchen", "on"}) || state.Lights[1] != (dashboardLight{4, "", "on"}) {
+		t.Errorf("The lights are %+v", state.Lights)
+	}
+	if len(state.Commands) != 2 || state.Commands[0].Text != "turn light 2 on" || state.Commands[1].Confidence != 1 || state.Commands[1].Channel != "dashboard" {
+		t.Errorf("The commands are %+v", state.Commands)
+	}
+	if _, ok := state.Connections["nlu"]; !ok || len(state.Devices) != 1 {
+		t.Errorf("The state is %s", rec.Body.String())
+	}
+
+	config.DashboardPassword = "secret"
+	rec = serve("GET", "/cortex/dashboard/state", "", "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Without the password we got %d", rec.Code)
+	}
+	r := httptest.NewRequest("GET", "/cortex/dashboard/state", nil)
+	r.SetBasicAuth("me", "secret")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK {
+		t.Errorf("With the password we got %d", rec.Code)
+	}
+}
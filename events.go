@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The types of events Cortex publishes, subsystems publish them on the event
+//bus and /events streams them
+const (
+	eventCommandReceived  = "command.received"
+	eventIntentParsed     = "intent.parsed"
+	eventLightChanged     = "light.changed"
+	eventSensorTriggered  = "sensor.triggered"
+	eventChatConnected    = "chat.connected"
+	eventChatDisconnected = "chat.disconnected"
+	eventError            = "error"
+)
+
+var eventTypes = []string{
+	eventCommandReceived, eventIntentParsed, eventLightChanged, eventSensorTriggered,
+	eventChatConnected, eventChatDisconnected, eventError,
+}
+
+//eventReplaySize is how many events we keep for clients that reconnect with
+//Last-Event-ID, and eventBufferSize how many can wait for a slow subscriber
+//before we drop them
+const eventReplaySize = 256
+const eventBufferSize = 64
+
+//eventHeartbeat keeps idle streams open through proxies
+var eventHeartbeat = 15 * time.Second
+
+var events = newEventBus()
+
+//eventStreamsDone is closed when Cortex stops, so the open streams end and
+//don't hold up the http server
+var eventStreamsDone = make(chan struct{})
+var stopEventStreamsOnce sync.Once
+
+func stopEventStreams() {
+	stopEventStreamsOnce.Do(func() { close(eventStreamsDone) })
+}
+
+//cortexEvent is something that happened, Data is one of the event structs
+//below, depending on Type
+type cortexEvent struct {
+	ID            uint64      `json:"id"`
+	Type          string      `json:"type"`
+	Time          time.Time   `json:"time"`
+	CorrelationID string      `json:"cid,omitempty"`
+	Data          interface{} `json:"data"`
+}
+
+type commandReceivedEvent struct {
+	Channel string `json:"channel"`
+	Sender  string `json:"sender,omitempty"`
+	Text    string `json:"text"`
+}
+
+type intentParsedEvent struct {
+	Channel    string             `json:"channel"`
+	Text       string             `json:"text"`
+	Intent     string             `json:"intent"`
+	Confidence float64            `json:"confidence"`
+	Entities   WitMessageEntities `json:"entities"`
+}
+
+type lightChangedEvent struct {
+	Light    int    `json:"light"`
+	State    string `json:"state"`
+	Previous string `json:"previous,omitempty"`
+}
+
+type sensorTriggeredEvent struct {
+	Sensor string `json:"sensor"`
+	Value  string `json:"value"`
+}
+
+type chatEvent struct {
+	Adapter string `json:"adapter"`
+	Error   string `json:"error,omitempty"`
+}
+
+type errorEvent struct {
+	Subsystem string `json:"subsystem"`
+	Message   string `json:"message"`
+}
+
+//eventBus sends every event to the subscribers that want its type
+type eventBus struct {
+	mu          sync.Mutex
+	nextID      uint64
+	recent      []cortexEvent
+	subscribers map[*eventSubscription]bool
+}
+
+//eventSubscription gets the events on Events, types empty means all of them.
+//When the subscriber is too far behind, dropped gets the events it misses.
+type eventSubscription struct {
+	Events  chan cortexEvent
+	types   map[string]bool
+	dropped func(cortexEvent)
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[*eventSubscription]bool)}
+}
+
+func (s *eventSubscription) wants(event cortexEvent) bool {
+	return len(s.types) == 0 || s.types[event.Type]
+}
+
+//publish never blocks, a subscriber that is too far behind misses events,
+//and hears about them on dropped when it has one
+func (b *eventBus) publish(ctx context.Context, typ string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.nextID++
+	event := cortexEvent{ID: b.nextID, Type: typ, Time: time.Now().UTC(), CorrelationID: correlationID(ctx), Data: data}
+	b.recent = append(b.recent, event)
+	if len(b.recent) > eventReplaySize {
+		b.recent = b.recent[len(b.recent)-eventReplaySize:]
+	}
+	for sub := range b.subscribers {
+		if !sub.wants(event) {
+			continue
+		}
+		select {
+		case sub.Events <- event:
+		default:
+			eventsDropped.inc(typ)
+			if sub.dropped != nil {
+				//not under the lock, it could be slow
+				go sub.dropped(event)
+			}
+		}
+	}
+}
+
+//subscribe gives you the events of those types from now on, and the ones we
+//still have after lastID
+func (b *eventBus) subscribe(types []string, lastID uint64) (*eventSubscription, []cortexEvent) {
+	sub := &eventSubscription{Events: make(chan cortexEvent, eventBufferSize), types: make(map[string]bool)}
+	for _, typ := range types {
+		sub.types[typ] = true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var missed []cortexEvent
+	if lastID > 0 {
+		for _, event := range b.recent {
+			if event.ID > lastID && sub.wants(event) {
+				missed = append(missed, event)
+			}
+		}
+	}
+	b.subscribers[sub] = true
+	return sub, missed
+}
+
+//subscribeDropped is subscribe for the subscribers that can't miss an event
+//without saying so, like the webhooks
+func (b *eventBus) subscribeDropped(types []string, dropped func(cortexEvent)) *eventSubscription {
+	sub, _ := b.subscribe(types, 0)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sub.dropped = dropped
+	return sub
+}
+
+func (b *eventBus) unsubscribe(sub *eventSubscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subscribers, sub)
+}
+
+//publishIntent tells the subscribers what Wit understood
+func publishIntent(ctx context.Context, channel, text string, intent WitMessage) {
+	events.publish(ctx, eventIntentParsed, intentParsedEvent{
+		Channel:    channel,
+		Text:       text,
+		Intent:     intent.Outcome.Intent,
+		Confidence: intent.Outcome.Confidence,
+		Entities:   intent.Outcome.Entities,
+	})
+}
+
+//parseEventTypes reads ?types=light.changed,error
+func parseEventTypes(setting string) ([]string, error) {
+	if setting == "" {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, typ := range eventTypes {
+		known[typ] = true
+	}
+	var types []string
+	for _, typ := range strings.Split(setting, ",") {
+		typ = strings.TrimSpace(typ)
+		if !known[typ] {
+			return nil, fmt.Errorf("unknown event type %q, use %s", typ, strings.Join(eventTypes, ", "))
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+//EventsHandler streams the events as server-sent events. ?types= picks the
+//types you want, and a client that reconnects with Last-Event-ID gets what
+//it missed, if we still have it.
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	if !passwordAuthorized(w, r) {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	types, err := parseEventTypes(r.FormValue("types"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lastID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+
+	//the stream is open for as long as the client wants, not HttpWriteTimeout
+	err = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		mainLog.Debugf("Could not remove the write deadline for /events: %v", err)
+	}
+	sub, missed := events.subscribe(types, lastID)
+	defer events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	//nginx buffers responses otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	out := bufio.NewWriter(w)
+	for _, event := range missed {
+		writeEvent(out, event)
+	}
+	out.Flush()
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event := <-sub.Events:
+			writeEvent(out, event)
+		case <-heartbeat.C:
+			fmt.Fprint(out, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-eventStreamsDone:
+			return
+		}
+		if out.Flush() != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, event cortexEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		mainLog.Warnf("Could not encode the %s event: %v", event.Type, err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//nextEvent waits a bit for an event on the subscription
+func nextEvent(t *testing.T, sub *eventSubscription) cortexEvent {
+	select {
+	case event := <-sub.Events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("No event")
+	}
+	return cortexEvent{}
+}
+
+func TestEventBus(t *testing.T) {
+	bus := newEventBus()
+	bus.publish(context.Background(), eventError, errorEvent{"wit", "before"})
+	lights, missed := bus.subscribe([]string{eventLightChanged}, 0)
+	if len(missed) != 0 {
+		t.Errorf("A new subscriber got %+v", missed)
+	}
+	all, _ := bus.subscribe(nil, 0)
+	ctx := withCorrelationID(context.Background(), "abc")
+	bus.publish(ctx, eventLightChanged, lightChangedEvent{Light: 3, State: "on"})
+	bus.publish(ctx, eventChatConnected, chatEvent{Adapter: "irc"})
+
+	event := nextEvent(t, lights)
+	if event.Type != eventLightChanged || event.ID != 2 || event.CorrelationID != "abc" || event.Data.(lightChangedEvent).Light != 3 {
+		t.Errorf("Got %+v", event)
+	}
+	if len(lights.Events) != 0 {
+		t.Errorf("The lights subscriber got a chat event")
+	}
+	if nextEvent(t, all).Type != eventLightChanged || nextEvent(t, all).Type != eventChatConnected {
+		t.Errorf("The events are out of order")
+	}
+
+	bus.unsubscribe(lights)
+	bus.publish(ctx, eventLightChanged, lightChangedEvent{Light: 4, State: "on"})
+	if len(lights.Events) != 0 {
+		t.Errorf("Got an event after unsubscribing")
+	}
+
+	_, missed = bus.subscribe([]string{eventLightChanged, eventError}, 1)
+	if len(missed) != 2 || missed[0].ID != 2 || missed[1].ID != 4 {
+		t.Errorf("Replaying after 1 gave %+v", missed)
+	}
+
+	for i := 0; i < eventBufferSize+1; i++ {
+		bus.publish(ctx, eventLightChanged, lightChangedEvent{Light: 1, State: "on"})
+	}
+	if eventsDropped.get(eventLightChanged) == 0 {
+		t.Errorf("A full subscriber should drop events")
+	}
+}
+
+func TestSubsystemsPublish(t *testing.T) {
+	sub, _ := events.subscribe(nil, 0)
+	defer events.unsubscribe(sub)
+
+	previous := lightState(5)
+	Arduino(context.Background(), "on", 5)
+	event := nextEvent(t, sub)
+	if event.Type != eventLightChanged || event.Data.(lightChangedEvent) != (lightChangedEvent{Light: 5, State: "on", Previous: previous}) {
+		t.Errorf("Switching a light gave %+v", event)
+	}
+
+	chatStatusesMu.Lock()
+	delete(chatStatuses, "events-test")
+	chatStatusesMu.Unlock()
+	setChatStatus("events-test", nil)
+	setChatStatus("events-test", errors.New("connection reset"))
+	setChatStatus("events-test", errors.New("connection refused"))
+	if event := nextEvent(t, sub); event.Type != eventChatConnected {
+		t.Errorf("Connecting gave %+v", event)
+	}
+	if event := nextEvent(t, sub); event.Type != eventChatDisconnected || event.Data.(chatEvent).Error != "connection reset" {
+		t.Errorf("Disconnecting gave %+v", event)
+	}
+	if len(sub.Events) != 0 {
+		t.Errorf("Failing to reconnect is not a new disconnection")
+	}
+
+	_, restore := captureLogs()
+	trackerLog.withContext(withCorrelationID(context.Background(), "cid1")).Errorf("Could not close %s", "OPS-1")
+	restore()
+	event = nextEvent(t, sub)
+	if event.Type != eventError || event.CorrelationID != "cid1" || event.Data.(errorEvent) != (errorEvent{"tracker", "Could not close OPS-1"}) {
+		t.Errorf("Logging an error gave %+v", event)
+	}
+
+	watchSensors(strings.NewReader("1\r\n\r\nnoise\r\n"))
+	event = nextEvent(t, sub)
+	if event.Type != eventSensorTriggered || event.Data.(sensorTriggeredEvent).Sensor != "ultrasonic" || len(sub.Events) != 0 {
+		t.Errorf("The sensor gave %+v", event)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.DashboardPassword = ""
+	rec := httptest.NewRecorder()
+	EventsHandler(rec, httptest.NewRequest("GET", "/events", nil))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Without a password /events gave %d", rec.Code)
+	}
+	config.DashboardPassword = "secret"
+	rec = httptest.NewRecorder()
+	EventsHandler(rec, httptest.NewRequest("GET", "/events", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Without basic auth /events gave %d", rec.Code)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(EventsHandler))
+	defer server.Close()
+	events.publish(context.Background(), eventLightChanged, lightChangedEvent{Light: 1, State: "off"})
+	events.mu.Lock()
+	lastID := events.nextID
+	events.mu.Unlock()
+	events.publish(context.Background(), eventLightChanged, lightChangedEvent{Light: 2, State: "on"})
+
+	req, _ := http.NewRequest("GET", server.URL+"?types=nope", nil)
+	req.SetBasicAuth("cortex", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("An unknown type gave %v %v", res, err)
+	}
+
+	req, _ = http.NewRequest("GET", server.URL+"?types=light.changed", nil)
+	req.SetBasicAuth("cortex", "secret")
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(lastID, 10))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Got %s", res.Header.Get("Content-Type"))
+	}
+	lines := bufio.NewReader(res.Body)
+	readEvent := func() string {
+		var event []string
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil || line == "\n" {
+				return strings.Join(event, "")
+			}
+			event = append(event, line)
+		}
+	}
+	if event := readEvent(); !strings.Contains(event, "event: light.changed\n") || !strings.Contains(event, `"light":2`) {
+		t.Errorf("The missed event is %q", event)
+	}
+	events.publish(context.Background(), eventChatConnected, chatEvent{Adapter: "irc"})
+	events.publish(context.Background(), eventLightChanged, lightChangedEvent{Light: 3, State: "on"})
+	if event := readEvent(); !strings.Contains(event, `"light":3`) {
+		t.Errorf("The live event is %q", event)
+	}
+}
+
+func TestEventBusDropped(t *testing.T) {
+	bus := newEventBus()
+	dropped := make(chan cortexEvent, 1)
+	sub := bus.subscribeDropped([]string{eventLightChanged}, func(event cortexEvent) { dropped <- event })
+	defer bus.unsubscribe(sub)
+	for i := 0; i <= eventBufferSize; i++ {
+		bus.publish(context.Background(), eventLightChanged, lightChangedEvent{Light: i, State: "on"})
+	}
+	select {
+	case event := <-dropped:
+		if event.ID != eventBufferSize+1 {
+			t.Errorf("Dropped %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Error("Nobody heard about the dropped event")
+	}
+}
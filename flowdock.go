@@ -7,303 +7,628 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 var availableFlows []flows
+
+//availableFlowsMu guards availableFlows, Connect fetches them again while
+//we look up the flows of the messages we got
+var availableFlowsMu sync.RWMutex
 var currentUsers []user
+var currentUsersMu sync.RWMutex
 
 func tokenFlowdock() string {
-	return base64.StdEncoding.EncodeToString([]byte(config.FlowdockAccessToken))
+	return base64.StdEncoding.EncodeToString([]byte(currentConfig().FlowdockAccessToken))
 }
 
-//ListenStream starts pulling the flowdock stream api
-func listenStream() {
-	fetchFlows()
-	go fetchUserSchedule()
-	res := connectToFlow()
-	defer res.Body.Close()
+//flowdockAPIURL and flowdockStreamURL are used when the config doesn't
+//set FlowdockAPIURL or FlowdockStreamURL
+const flowdockAPIURL = "https://api.flowdock.com"
+const flowdockStreamURL = "https://stream.flowdock.com"
+
+//flowdockStreamTimeout is how long we wait for a row or a keep-alive before
+//we give up on the stream and reconnect
+var flowdockStreamTimeout = 90 * time.Second
+
+var fetchUserScheduleOnce sync.Once
+
+//flowdockAdapter reads the Flowdock streaming api and replies using
+//comments on the original message
+type flowdockAdapter struct {
+	mu       sync.Mutex
+	res      *http.Response
+	reader   *bufio.Reader
+	watchdog *time.Timer
+	stopped  bool
+	//seen are the messages we already handed out, a mention arrives as the
+	//message and again as a mention
+	seen map[string]time.Time
+}
+
+func (f *flowdockAdapter) Name() string {
+	return "flowdock"
+}
+
+//Connect fetches the flows we can see and opens the stream, it is called
+//again every time the stream drops
+func (f *flowdockAdapter) Connect() error {
+	f.close()
+	err := fetchFlows()
+	if err != nil {
+		return err
+	}
+	err = fetchUsers()
+	if err != nil {
+		return err
+	}
+	if email := currentConfig().CortexEmail; getCortexUserID(email) == 0 {
+		flowdockLog.Warnf("Could not find a Flowdock user with email %q, set cortexEmail so Cortex can ignore its own messages", email)
+	}
+	fetchUserScheduleOnce.Do(func() {
+		go fetchUserSchedule()
+	})
+	res, err := connectToFlow()
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	if f.stopped {
+		f.mu.Unlock()
+		res.Body.Close()
+		return errors.New("Cortex is stopping")
+	}
+	f.res = res
+	f.mu.Unlock()
+	f.reader = bufio.NewReader(res.Body)
+	//closing the body makes the blocked read fail, so listenChat reconnects
+	f.watchdog = time.AfterFunc(flowdockStreamTimeout, func() {
+		flowdockLog.Warnf("No data from the Flowdock stream in %v, closing it", flowdockStreamTimeout)
+		res.Body.Close()
+	})
+	return nil
+}
+
+func (f *flowdockAdapter) close() {
+	if f.watchdog != nil {
+		f.watchdog.Stop()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.res != nil {
+		f.res.Body.Close()
+	}
+}
+
+//Close closes the stream, when Cortex stops
+func (f *flowdockAdapter) Close() error {
+	f.mu.Lock()
+	f.stopped = true
+	f.mu.Unlock()
+	f.close()
+	return nil
+}
+
+//reloadConfig closes the stream when the flows change, listenChat connects
+//again with the new ones
+func (f *flowdockAdapter) reloadConfig(old, current CortexConfig) {
+	if old.Flows == current.Flows {
+		return
+	}
+	flowdockLog.Infof("Flows changed to %s, reconnecting to Flowdock", current.Flows)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.res != nil {
+		f.res.Body.Close()
+	}
+}
+
+//Receive blocks until we get a row from the stream that Cortex should look at
+func (f *flowdockAdapter) Receive() (ChatMessage, error) {
 	for {
-		processFlowRow(parseFlowRow(bufio.NewReader(res.Body)))
+		flowMessage, line, err := parseFlowRow(f.reader)
+		if err != nil {
+			f.close()
+			return ChatMessage{}, err
+		}
+		//anything we read, including keep-alives, means the stream is alive
+		f.watchdog.Reset(flowdockStreamTimeout)
+		if flowMessage.Event == "action" {
+			welcomeToFlow(flowMessage, line)
+			continue
+		}
+		msg, ok := flowdockToChatMessage(flowMessage, line)
+		if ok && (flowMessage.Event == "message" || flowMessage.Event == "mention") && f.alreadySeen(flowMessage) {
+			continue
+		}
+		if ok {
+			return msg, nil
+		}
+	}
+}
+
+//alreadySeen tells you if we got the message before, by its id or its uuid,
+//and remembers it for a minute
+func (f *flowdockAdapter) alreadySeen(flowMessage flowdockMsg) bool {
+	var keys []string
+	if flowMessage.Id != 0 {
+		keys = append(keys, fmt.Sprintf("id:%s:%d", flowMessage.Flow, flowMessage.Id))
+	}
+	if flowMessage.Uuid != "" {
+		keys = append(keys, "uuid:"+flowMessage.Uuid)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen == nil {
+		f.seen = make(map[string]time.Time)
+	}
+	now := time.Now()
+	for k, t := range f.seen {
+		if now.Sub(t) > time.Minute {
+			delete(f.seen, k)
+		}
+	}
+	seen := false
+	for _, key := range keys {
+		if _, ok := f.seen[key]; ok {
+			seen = true
+		}
+		f.seen[key] = now
 	}
+	return seen
+}
+
+//Reply answers in the thread of the original message. Flowdock thread ids
+//are strings, while comments point to the numeric id of the parent message.
+//Private messages have no threads, we just answer to the sender.
+func (f *flowdockAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	var id int64
+	parentID, err := strconv.ParseInt(msg.ThreadID, 10, 64)
+	if msg.Private {
+		id, err = flowdockPostPrivate(reply, msg.Sender)
+	} else if err != nil {
+		id, err = flowdockPostToThread(reply, msg.ThreadID, msg.Channel)
+	} else {
+		id, err = flowdockPost(reply, parentID, msg.Channel)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+//EditReply changes the content of a comment or message we sent before
+func (f *flowdockAdapter) EditReply(msg ChatMessage, replyID string, reply ChatReply) error {
+	var url string
+	if msg.Private {
+		url = flowdockURL(currentConfig().FlowdockAPIURL, flowdockAPIURL, fmt.Sprintf("private/%s/messages/%s", msg.Sender, replyID))
+	} else {
+		flowURL, err := getFlowURL(msg.Channel)
+		if err != nil {
+			return err
+		}
+		url = fmt.Sprintf("%+v/messages/%+v", flowURL, replyID)
+	}
+	payload, err := json.Marshal(flowdockOutgoing{Content: reply.Text, Tags: reply.Tags})
+	if err != nil {
+		return err
+	}
+	req, _ := http.NewRequest("PUT", url, bytes.NewReader(payload))
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", tokenFlowdock()))
+	req.Header.Add("Content-type", "application/json")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error editing a message on Flowdock: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 && res.StatusCode != 204 {
+		return fmt.Errorf("We got a non 200 code: %+v", res.StatusCode)
+	}
+	return nil
+}
+
+//FetchAttachment downloads a file uploaded to a flow
+func (f *flowdockAdapter) FetchAttachment(attachment ChatAttachment) (io.ReadCloser, error) {
+	url := flowdockURL(currentConfig().FlowdockAPIURL, flowdockAPIURL, strings.TrimPrefix(attachment.URL, "/"))
+	req, _ := http.NewRequest("GET", url, nil)
+	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", tokenFlowdock()))
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("got status code %+v downloading %+v", res.StatusCode, attachment.URL)
+	}
+	return res.Body, nil
 }
 
 //fetchFlows fetches all the flows we have access to
-func fetchFlows() {
-	performGet("flows", parseAvailableFlows())
+func fetchFlows() error {
+	return performGet("flows", parseAvailableFlows())
 }
 
 func parseAvailableFlows() parseCallback {
 	return func(payload []byte) {
-		err := json.Unmarshal(payload, &availableFlows)
+		var parsed []flows
+		err := json.Unmarshal(payload, &parsed)
 		if err != nil {
-			log.Fatalf("Error parsing flows data %+v", err)
+			flowdockLog.Errorf("Error parsing flows data %+v", err)
+			return
 		}
+		availableFlowsMu.Lock()
+		availableFlows = parsed
+		availableFlowsMu.Unlock()
 	}
 }
 
-func connectToFlow() *http.Response {
-	url := fmt.Sprintf("https://%s@stream.flowdock.com/flows?filter=%s", config.FlowdockAccessToken, config.Flows)
+func connectToFlow() (*http.Response, error) {
+	//user=1 adds our private messages to the stream
+	current := currentConfig()
+	url := flowdockURL(current.FlowdockStreamURL, flowdockStreamURL, "flows?user=1&filter="+current.Flows)
 	req, _ := http.NewRequest("GET", url, nil)
 	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", tokenFlowdock()))
 	client := &http.Client{}
 	res, err := client.Do(req)
 	if err != nil {
-		log.Fatalln("could not fetch streaming api ", err)
+		return nil, fmt.Errorf("could not fetch streaming api: %v", err)
 	} else if res.StatusCode != 200 {
-		log.Fatalf("got error code: %+v from flowdock.\n", res.StatusCode)
+		res.Body.Close()
+		return nil, fmt.Errorf("got error code: %+v from flowdock", res.StatusCode)
 	}
 
-	return res
+	return res, nil
 }
 
-func parseFlowRow(reader *bufio.Reader) (flowdockMsg, []byte) {
+//parseFlowRow reads one row from the stream, keep-alives come back as an
+//empty flowdockMsg
+func parseFlowRow(reader *bufio.Reader) (flowdockMsg, []byte, error) {
+	var message flowdockMsg
 	line, err := reader.ReadBytes('\r')
 	if err != nil {
-		log.Fatalf("something went wrong reading the payload: %s", err)
+		return message, nil, fmt.Errorf("something went wrong reading the payload: %s", err)
 	}
 	line = bytes.TrimSpace(line)
-	jsonString := string(line[:])
-	if len(jsonString) < 4 {
-		log.Fatalln("got empty response from flowdock, shutting down")
-		os.Exit(1)
+	if len(line) < 4 {
+		return message, line, nil
 	}
-	var message flowdockMsg
 	json.Unmarshal(line, &message)
-	return message, line
+	return message, line, nil
 }
 
-func processFlowRow(flowMessage flowdockMsg, line []byte) {
+//flowdockToChatMessage converts a row from the stream into a ChatMessage,
+//the bool is false for rows Cortex should not answer to
+func flowdockToChatMessage(flowMessage flowdockMsg, line []byte) (ChatMessage, bool) {
 	var flowUpdatedMessage flowdockUpdatedMsg
 	var flowComment flowdockComment
 
+	msg := ChatMessage{
+		ID:      strconv.FormatInt(flowMessage.Id, 10),
+		Channel: flowMessage.Flow,
+		Sender:  flowMessage.User,
+	}
+	msg.ThreadID = msg.ID
+	if flowMessage.Thread_id != "" {
+		msg.ThreadID = flowMessage.Thread_id
+	}
+	msg.ChannelName, _ = getFlowName(flowMessage.Flow)
+	msg.SenderName = getFlowdockNick(flowMessage.User)
+	if webURL := getFlowWebURL(flowMessage.Flow); webURL != "" && flowMessage.Id != 0 {
+		msg.URL = fmt.Sprintf("%s/messages/%d", webURL, flowMessage.Id)
+	}
+
+	if isCortexUser(flowMessage.User) {
+		return msg, false
+	}
+
+	if flowMessage.Flow == "" && flowMessage.To != "" {
+		msg.Private = true
+		msg.ChannelName = ""
+	}
+
 	switch flowMessage.Event {
 	case "message":
-		intent, err := FetchIntent(flowMessage.Content)
-		if err != nil {
-			witErrorResponseToFlowdock(flowMessage, err)
-		} else {
-			ret := ProcessIntent(intent)
-			replyToFlow(ret, flowMessage.Id, flowMessage.Flow)
+		msg.Text, msg.Mentioned = flowdockMentioned(flowMessage.Content, flowMessage.Tags)
+		return msg, true
+
+	case "mention":
+		msg.Text, _ = flowdockMentioned(flowMessage.Content, flowMessage.Tags)
+		msg.Mentioned = true
+		return msg, true
+
+	case "file":
+		var flowFile flowdockFile
+		json.Unmarshal(line, &flowFile)
+		msg.Attachment = &ChatAttachment{
+			Name:        flowFile.Content.File_name,
+			ContentType: flowFile.Content.Content_type,
+			URL:         flowFile.Content.Path,
 		}
+		//uploads have no text, but they can be tagged with @cortex
+		_, msg.Mentioned = flowdockMentioned("", flowMessage.Tags)
+		return msg, true
 
 	case "message-edit":
 		json.Unmarshal(line, &flowUpdatedMessage)
-		intent, err := FetchIntent(flowUpdatedMessage.Content.Updated_content)
-		if err != nil {
-			witErrorResponseToFlowdock(flowMessage, err)
-		} else {
-			ret := ProcessIntent(intent)
-			replyToFlow(ret, flowUpdatedMessage.Id, flowUpdatedMessage.Flow)
-		}
+		msg.Text, msg.Mentioned = flowdockMentioned(flowUpdatedMessage.Content.Updated_content, flowUpdatedMessage.Tags)
+		msg.ID = strconv.FormatInt(int64(flowUpdatedMessage.Content.Message), 10)
+		msg.ThreadID = msg.ID
+		msg.Edited = true
+		return msg, true
 
 	case "comment":
-		if flowMessage.User != "77156" {
-			var parentMessageID int64
-			json.Unmarshal(line, &flowComment)
-			intent, err := FetchIntent(flowComment.Content.Text)
-			if err != nil {
-				flowMessage.Id = parentMessageID
-				witErrorResponseToFlowdock(flowMessage, err)
-			} else {
-				ret := ProcessIntent(intent)
-				for _, v := range flowComment.Tags {
-					if strings.Contains(v, "influx") {
-						parentID, _ := strconv.ParseInt(strings.Split(v, ":")[1], 0, 64)
-						parentMessageID = parentID
-					}
-				}
-				replyToFlow(ret, parentMessageID, flowComment.Flow)
+		json.Unmarshal(line, &flowComment)
+		msg.Text, msg.Mentioned = flowdockMentioned(flowComment.Content.Text, flowComment.Tags)
+		msg.ThreadID = "0"
+		//the comment is on the message in its influx:<id> tag, other tags
+		//like "influxdb" are just tags
+		for _, v := range flowComment.Tags {
+			parts := strings.SplitN(v, ":", 2)
+			if strings.HasPrefix(v, "influx:") && len(parts) == 2 && parts[1] != "" {
+				msg.ThreadID = parts[1]
 			}
-
-		} else {
-			//log.Println("skipping Cortex's message.")
 		}
+		return msg, true
 	}
+	return msg, false
 }
 
-func witErrorResponseToFlowdock(flowMessage flowdockMsg, err error) {
-	ret :=
-		WitResponse{
-			WitArduinoResponse{},
-			WitTemperatureResponse{},
-			WitGithubResponse{},
-			witError{fmt.Sprintf("Error: %+v", err)},
+//findFlow looks up one of the flows we can see by its id
+func findFlow(id string) (flows, bool) {
+	availableFlowsMu.RLock()
+	defer availableFlowsMu.RUnlock()
+	for _, flow := range availableFlows {
+		if flow.Id == id {
+			return flow, true
 		}
-	replyToFlow(ret, flowMessage.Id, flowMessage.Flow)
+	}
+	return flows{}, false
 }
 
 //getFlowURL given a flow id as string, return the url for the flow
 func getFlowURL(id string) (string, error) {
-	for _, flow := range availableFlows {
-		if flow.Id == id {
-			return flow.Url, nil
-		}
+	if flow, ok := findFlow(id); ok {
+		return flow.Url, nil
 	}
 	return "", errors.New("Flow url not found by key " + id)
 }
 
 //getFlowName given a flow id as string, return the name of the flow
 func getFlowName(id string) (string, error) {
-	for _, flow := range availableFlows {
-		if flow.Id == id {
-			return flow.Parameterized_name, nil
-		}
+	if flow, ok := findFlow(id); ok {
+		return flow.Parameterized_name, nil
 	}
 	return "", errors.New("Flow url not found by key " + id)
 }
 
-//getIssueURLForFlowName given a flow name, return the issues url for it
-func getIssueURLForFlowName(parametizedName string) (string, error) {
-	for _, row := range config.FlowsTicketsUrls {
-		url, ok := row[parametizedName]
-		if ok {
-			return url, nil
-		}
+//getFlowWebURL gives you the link to the flow on flowdock.com, or an empty string
+func getFlowWebURL(id string) string {
+	if flow, ok := findFlow(id); ok {
+		return strings.TrimSuffix(flow.Web_url, "/")
 	}
-	return "", errors.New("Could not find issue url for flow: " + parametizedName)
+	return ""
 }
 
-func replyToFlow(ret WitResponse, originalMessageID int64, flowID string) {
-	if ret.Temperature.Unit != "" {
-		handleTemperature(ret, originalMessageID, flowID)
-	} else if len(ret.Github.issues) > 0 {
-		handleGithub(ret, originalMessageID, flowID)
-	} else if ret.Error.msg != "" {
-		flowdockPost(ret.Error.msg, originalMessageID, flowID)
+//flowdockPost adds a comment to the message originalMessageID and returns
+//the id of the new comment
+func flowdockPost(reply ChatReply, originalMessageID int64, flowID string) (int64, error) {
+	flowURL, err := getFlowURL(flowID)
+	if err != nil {
+		return 0, err
 	}
-
+	url := fmt.Sprintf("%+v/messages/%+v/comments", flowURL, originalMessageID)
+	return flowdockSend(url, flowdockOutgoing{Event: "comment", Content: reply.Text, Tags: reply.Tags})
 }
 
-func handleTemperature(ret WitResponse, originalMessageID int64, flowID string) {
-	temperature := ret.Temperature.Degrees
-	switch ret.Temperature.Unit {
-	case "C":
-		flowdockPost(fmt.Sprintf("Which is %+vF", cToF(temperature)), originalMessageID, flowID)
-	case "F":
-		flowdockPost(fmt.Sprintf("Which is %+vC", fToC(temperature)), originalMessageID, flowID)
-	}
+//flowdockPostPrivate sends a private message to the user
+func flowdockPostPrivate(reply ChatReply, userID string) (int64, error) {
+	url := flowdockURL(currentConfig().FlowdockAPIURL, flowdockAPIURL, fmt.Sprintf("private/%s/messages", userID))
+	return flowdockSend(url, flowdockOutgoing{Event: "message", Content: reply.Text, Tags: reply.Tags})
 }
 
-func handleGithub(ret WitResponse, originalMessageID int64, flowID string) {
-	for _, issue := range ret.Github.issues {
-		flowParametizedName, error := getFlowName(flowID)
-		if error != nil {
-			log.Printf("Error trying to get parametized flow name for id %v", flowID)
-		}
-		issueURL, error := getIssueURLForFlowName(flowParametizedName)
-		if error != nil {
-			log.Printf("%s", error)
+//welcomeToFlow greets people who join a flow, if you set WelcomeMessage
+func welcomeToFlow(flowMessage flowdockMsg, line []byte) {
+	var action flowdockAction
+	json.Unmarshal(line, &action)
+	welcome := currentConfig().WelcomeMessage
+	if welcome == "" || action.Content.Type != "join" || isCortexUser(flowMessage.User) {
+		return
+	}
+	text := welcome
+	currentUsersMu.RLock()
+	for _, u := range currentUsers {
+		if strconv.FormatInt(u.ID, 10) == flowMessage.User {
+			text = "@" + u.Nick + " " + text
 		}
-
-		url := fmt.Sprintf("just click here: %+v%+v", issueURL, issue)
-		flowdockPost(url, originalMessageID, flowID)
+	}
+	currentUsersMu.RUnlock()
+	_, err := flowdockPostToThread(textReply(text), "", flowMessage.Flow)
+	if err != nil {
+		flowdockLog.Errorf("Could not welcome user %s, got: %v", flowMessage.User, err)
 	}
 }
 
-func flowdockPost(message string, originalMessageID int64, flowID string) {
+//flowdockPostToThread sends a message to the thread and returns its id,
+//with an empty threadID it starts a new thread
+func flowdockPostToThread(reply ChatReply, threadID string, flowID string) (int64, error) {
 	flowURL, err := getFlowURL(flowID)
 	if err != nil {
-		log.Printf("Error getting flow id, got %v", err)
-		return
+		return 0, err
 	}
-	url := fmt.Sprintf("%+v/messages/%+v/comments", flowURL, originalMessageID)
-	client := &http.Client{}
-	payload := []byte(`{
-	  "event": "comment",
-	  "content":"` + message + `"}`)
+	url := fmt.Sprintf("%+v/messages", flowURL)
+	return flowdockSend(url, flowdockOutgoing{Event: "message", Content: reply.Text, Tags: reply.Tags, ThreadID: threadID})
+}
 
+func flowdockSend(url string, message flowdockOutgoing) (int64, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return 0, err
+	}
+	client := &http.Client{}
 	req, _ := http.NewRequest("POST", url, bytes.NewReader(payload))
 	req.Header.Add("Authorization", fmt.Sprintf("Basic %s", tokenFlowdock()))
 	req.Header.Add("Content-type", "application/json")
 	res, err := client.Do(req)
 	if err != nil {
-		log.Printf("Error posting a message to Flowdock: %v", err)
-		return
-	} else if res.StatusCode != 200 {
-		log.Printf("We got a non 200 code: %+v\n", res.StatusCode)
-		return
+		return 0, fmt.Errorf("Error posting a message to Flowdock: %v", err)
 	}
-
 	defer res.Body.Close()
-	value, err := ioutil.ReadAll(res.Body)
-	_ = value
-	if err != nil {
-		log.Fatalf("Could not read body, got: %v", err)
+	if res.StatusCode != 200 && res.StatusCode != 201 {
+		return 0, fmt.Errorf("We got a non 200 code: %+v", res.StatusCode)
 	}
-}
-
-func fToC(f int) int {
-	return (f - 32) * 5 / 9
-}
 
-func cToF(c int) int {
-	return c*9/5 + 32
+	var comment flowdockMsg
+	err = json.NewDecoder(res.Body).Decode(&comment)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read body, got: %v", err)
+	}
+	return comment.Id, nil
 }
 
 func fetchUserSchedule() {
 	for _ = range time.Tick(1 * time.Minute) {
-		fetchUsers()
+		err := fetchUsers()
+		if err != nil {
+			flowdockLog.Errorf("Could not refresh the Flowdock users: %v", err)
+		}
 	}
 
 }
 
-func fetchUsers() {
-	performGet("users", parseUsers())
+func fetchUsers() error {
+	return performGet("users", parseUsers())
 }
 
-func performGet(path string, f parseCallback) {
-	url := fmt.Sprintf("https://%s@api.flowdock.com/%s", config.FlowdockAccessToken, path)
+func performGet(path string, f parseCallback) error {
+	url := flowdockURL(currentConfig().FlowdockAPIURL, flowdockAPIURL, path)
 	res, err := http.Get(url)
 	if err != nil {
-		log.Fatalf("Error getting %+v: %v", path, err)
-	} else if res.StatusCode != 200 {
-		log.Fatalf("got status code %+v", res.StatusCode)
+		return fmt.Errorf("Error getting %+v: %v", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("got status code %+v getting %+v", res.StatusCode, path)
 	}
 	dataAsJson, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Fatalf("error reading body, got: %+v", err)
+		return fmt.Errorf("error reading body, got: %+v", err)
 	}
 	f(dataAsJson)
-	res.Body.Close()
+	return nil
+}
+
+//flowdockURL joins the path to the configured base url, or to fallback when
+//there is none, and adds the access token as the user
+func flowdockURL(base, fallback, path string) string {
+	if base == "" {
+		base = fallback
+	}
+	u, err := url.Parse(strings.TrimSuffix(base, "/") + "/" + path)
+	if err != nil {
+		return ""
+	}
+	u.User = url.User(currentConfig().FlowdockAccessToken)
+	return u.String()
 }
 
 func parseUsers() parseCallback {
 	return func(payload []byte) {
-		err := json.Unmarshal(payload, &currentUsers)
+		var users []user
+		err := json.Unmarshal(payload, &users)
 		if err != nil {
-			log.Printf("Unabled to parse users list, got %+v", err)
+			flowdockLog.Errorf("Unabled to parse users list, got %+v", err)
+			return
 		}
-		return
+		currentUsersMu.Lock()
+		currentUsers = users
+		currentUsersMu.Unlock()
 	}
 }
 
 func getCortexUserID(email string) int64 {
+	return getCortexUser(email).ID
+}
+
+//getCortexUser gives you the Flowdock user with the email, or an empty user
+func getCortexUser(email string) user {
+	if email == "" {
+		return user{}
+	}
+	currentUsersMu.RLock()
+	defer currentUsersMu.RUnlock()
 	for _, value := range currentUsers {
 		if value.Email == email {
-			return value.ID
+			return value
+		}
+	}
+	return user{}
+}
+
+//getFlowdockNick gives you the nick of the user id, or an empty string
+func getFlowdockNick(userID string) string {
+	currentUsersMu.RLock()
+	defer currentUsersMu.RUnlock()
+	for _, value := range currentUsers {
+		if strconv.FormatInt(value.ID, 10) == userID {
+			return value.Nick
 		}
 	}
-	return 0
+	return ""
+}
+
+//flowdockMentioned looks for @nick in the text, or a tag for our user id,
+//and returns the text without the mention
+func flowdockMentioned(text string, tags []string) (string, bool) {
+	cortex := getCortexUser(currentConfig().CortexEmail)
+	if cortex.ID == 0 {
+		return text, false
+	}
+	text, mentioned := stripMention(text, "@"+cortex.Nick)
+	for _, tag := range tags {
+		if tag == fmt.Sprintf(":user:%d", cortex.ID) {
+			mentioned = true
+		}
+	}
+	return text, mentioned
+}
+
+//isCortexUser tells you if the Flowdock user id belongs to Cortex, using
+//the user with the configured CortexEmail
+func isCortexUser(userID string) bool {
+	cortexID := getCortexUserID(currentConfig().CortexEmail)
+	return cortexID != 0 && userID == strconv.FormatInt(cortexID, 10)
+}
+
+//flowdockOutgoing is what we send to Flowdock for comments and messages,
+//Content is markdown
+type flowdockOutgoing struct {
+	Event    string   `json:"event,omitempty"`
+	Content  string   `json:"content"`
+	Tags     []string `json:"tags,omitempty"`
+	ThreadID string   `json:"thread_id,omitempty"`
 }
 
 //flowdockMsg struct all the information we care about from flowdock message of type message
 type flowdockMsg struct {
-	Event   string
-	Tags    []string
-	Uuid    string
-	Persist bool
-	Id      int64
-	Flow    string
-	Content string
-	Sent    int64
-	User    string
+	Event     string
+	Tags      []string
+	Uuid      string
+	Persist   bool
+	Id        int64
+	Flow      string
+	Content   string
+	Sent      int64
+	User      string
+	Thread_id string
+	To        string
 }
 
 //flowdockUpdatedMsg struct all the information we care about from flowdock message of type update message
@@ -342,6 +667,23 @@ type flowdockCommentContent struct {
 	Text  string
 }
 
+//flowdockFile struct all the information we care about from a file upload
+type flowdockFile struct {
+	Content struct {
+		Path         string
+		File_name    string
+		Content_type string
+	}
+}
+
+//flowdockAction is sent when people join or leave a flow, among others
+type flowdockAction struct {
+	Content struct {
+		Type        string
+		Description string
+	}
+}
+
 //flows struct that holds information about all the flows we can access
 type flows struct {
 	Id                 string
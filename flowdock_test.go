@@ -1,7 +1,14 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestFlowsParse(t *testing.T) {
@@ -11,6 +18,23 @@ func TestFlowsParse(t *testing.T) {
 	}
 }
 
+func TestFlowsReloadWhileReading(t *testing.T) {
+	parseAvailableFlows()([]byte(mockedFlows))
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			parseAvailableFlows()([]byte(mockedFlows))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		if name, _ := getFlowName("aaaaaaaa-d97b-0000-1111-555598671f8c"); name != "huston" {
+			t.Errorf("getFlowName gave %q while the flows reloaded", name)
+		}
+	}
+	<-done
+}
+
 func TestGetFlowUrl(t *testing.T) {
 	url, _ := getFlowURL("aaaaaaaa-d97b-0000-1111-555598671f8c")
 	if url != "https://api.flowdock.com/flows/fmpwizard/huston" {
@@ -111,3 +135,312 @@ const mockedUsers = (`
     }
 ]
 `)
+
+func TestFlowdockToChatMessageComment(t *testing.T) {
+	parseAvailableFlows()([]byte(mockedFlows))
+	line := []byte(mockedComment)
+	var flowMessage flowdockMsg
+	json.Unmarshal(line, &flowMessage)
+	msg, ok := flowdockToChatMessage(flowMessage, line)
+	if !ok {
+		t.Fatal("flowdockToChatMessage skipped a comment")
+	}
+	if msg.ThreadID != "3816534" || msg.Text != "turn light 3 on" || msg.ChannelName != "huston" {
+		t.Errorf("flowdockToChatMessage gave %+v", msg)
+	}
+
+	//tags that look like influx but are not
+	line = []byte(strings.Replace(mockedComment, `"influx:3816534"`, `"influxdb", "influx", "influx:", "influx:3816534"`, 1))
+	json.Unmarshal(line, &flowMessage)
+	msg, ok = flowdockToChatMessage(flowMessage, line)
+	if !ok || msg.ThreadID != "3816534" {
+		t.Errorf("flowdockToChatMessage gave %+v", msg)
+	}
+}
+
+const mockedComment = (`{
+    "event": "comment",
+    "tags": ["influx:3816534"],
+    "uuid": "abc",
+    "id": 3816540,
+    "flow": "aaaaaaaa-d97b-0000-1111-555598671f8c",
+    "content": {"title": "original", "text": "turn light 3 on"},
+    "sent": 1317715364447,
+    "user": "31347"
+}`)
+
+func TestFlowdockStreamReconnects(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			w.Write([]byte(mockedUsers))
+			return
+		}
+		w.Write([]byte(mockedFlows))
+	}))
+	defer api.Close()
+	connections := 0
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("filter") != "fmpwizard/huston" {
+			t.Errorf("Stream opened with filter %q", r.URL.Query().Get("filter"))
+		}
+		connections++
+		w.Write([]byte("\r\n"))
+		w.Write([]byte(`{"event": "activity.user", "flow": "aaaaaaaa-d97b-0000-1111-555598671f8c"}` + "\r\n"))
+		w.Write([]byte(fmt.Sprintf(`{"event": "message", "id": %d, "flow": "aaaaaaaa-d97b-0000-1111-555598671f8c", "content": "message %d", "user": "31347"}`, connections, connections) + "\r\n"))
+	}))
+	defer stream.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.FlowdockAPIURL = api.URL
+	config.FlowdockStreamURL = stream.URL
+	config.Flows = "fmpwizard/huston"
+
+	f := &flowdockAdapter{}
+	for i := 1; i <= 2; i++ {
+		err := f.Connect()
+		if err != nil {
+			t.Fatalf("Connect gave %v", err)
+		}
+		msg, err := f.Receive()
+		if err != nil || msg.Text != fmt.Sprintf("message %d", i) {
+			t.Errorf("Receive gave %+v, %v", msg, err)
+		}
+		_, err = f.Receive()
+		if err == nil {
+			t.Error("Receive on a closed stream didn't give an error")
+		}
+	}
+}
+
+func TestFlowdockMentionOnce(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			w.Write([]byte(mockedUsers))
+			return
+		}
+		w.Write([]byte(mockedFlows))
+	}))
+	defer api.Close()
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flow := "aaaaaaaa-d97b-0000-1111-555598671f8c"
+		w.Write([]byte(`{"event": "message", "id": 7, "uuid": "u7", "flow": "` + flow + `", "content": "@cortex turn light 3 on", "user": "31347"}` + "\r\n"))
+		w.Write([]byte(`{"event": "mention", "id": 7, "uuid": "u7", "flow": "` + flow + `", "content": "@cortex turn light 3 on", "user": "31347"}` + "\r\n"))
+		w.Write([]byte(`{"event": "mention", "id": 8, "uuid": "u8", "flow": "` + flow + `", "content": "@cortex turn light 4 on", "user": "31347"}` + "\r\n"))
+		w.Write([]byte(`{"event": "message", "id": 8, "uuid": "u8", "flow": "` + flow + `", "content": "@cortex turn light 4 on", "user": "31347"}` + "\r\n"))
+	}))
+	defer stream.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.FlowdockAPIURL = api.URL
+	config.FlowdockStreamURL = stream.URL
+	config.Flows = "fmpwizard/huston"
+
+	f := &flowdockAdapter{}
+	err := f.Connect()
+	if err != nil {
+		t.Fatalf("Connect gave %v", err)
+	}
+	var ids []string
+	for {
+		msg, err := f.Receive()
+		if err != nil {
+			break
+		}
+		ids = append(ids, msg.ID)
+	}
+	if strings.Join(ids, ",") != "7,8" {
+		t.Errorf("Receive gave messages %v", ids)
+	}
+}
+
+func TestFlowdockStreamWatchdog(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			w.Write([]byte(mockedUsers))
+			return
+		}
+		w.Write([]byte(mockedFlows))
+	}))
+	defer api.Close()
+	done := make(chan bool)
+	stream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\r\n"))
+		w.(http.Flusher).Flush()
+		<-done
+	}))
+	defer stream.Close()
+	defer close(done)
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.FlowdockAPIURL = api.URL
+	config.FlowdockStreamURL = stream.URL
+	flowdockStreamTimeout = 100 * time.Millisecond
+	defer func() { flowdockStreamTimeout = 90 * time.Second }()
+
+	f := &flowdockAdapter{}
+	f.Connect()
+	_, err := f.Receive()
+	if err == nil {
+		t.Error("Receive on a silent stream didn't give an error")
+	}
+}
+
+func TestFlowdockToChatMessageSkipsCortex(t *testing.T) {
+	parseUsers()([]byte(mockedUsers))
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.CortexEmail = "diego+cortex@fmpwizard.com"
+	for _, event := range []string{"message", "message-edit", "comment"} {
+		flowMessage := flowdockMsg{Event: event, Flow: "aaaaaaaa-d97b-0000-1111-555598671f8c", User: "4877", Content: "Which is 100C"}
+		if _, ok := flowdockToChatMessage(flowMessage, nil); ok {
+			t.Errorf("flowdockToChatMessage didn't skip Cortex's own %s", event)
+		}
+	}
+	flowMessage := flowdockMsg{Event: "message", Flow: "aaaaaaaa-d97b-0000-1111-555598671f8c", User: "31347", Content: "hi"}
+	if _, ok := flowdockToChatMessage(flowMessage, nil); !ok {
+		t.Error("flowdockToChatMessage skipped somebody else's message")
+	}
+}
+
+func TestFlowdockMentioned(t *testing.T) {
+	parseUsers()([]byte(mockedUsers))
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.CortexEmail = "diego+cortex@fmpwizard.com"
+	text, ok := flowdockMentioned("@Cortex, look at #45", nil)
+	if !ok || text != "look at #45" {
+		t.Errorf("flowdockMentioned gave %q, %v", text, ok)
+	}
+	text, ok = flowdockMentioned("look at #45", []string{":user:4877"})
+	if !ok || text != "look at #45" {
+		t.Errorf("flowdockMentioned with a user tag gave %q, %v", text, ok)
+	}
+	if _, ok := flowdockMentioned("look at #45", []string{":user:31347"}); ok {
+		t.Error("flowdockMentioned matched another user")
+	}
+}
+
+func TestFlowdockReplyEncoding(t *testing.T) {
+	posted := make(chan flowdockOutgoing, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message flowdockOutgoing
+		err := json.NewDecoder(r.Body).Decode(&message)
+		if err != nil {
+			t.Errorf("Flowdock got invalid json: %v", err)
+		}
+		if message.Event == "comment" && r.URL.Path != "/flows/fmpwizard/huston/messages/3816534/comments" ||
+			message.Event == "message" && r.URL.Path != "/flows/fmpwizard/huston/messages" {
+			t.Errorf("Posted %s to %v", message.Event, r.URL.Path)
+		}
+		posted <- message
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 3816600}`))
+	}))
+	defer api.Close()
+	availableFlows = []flows{{Id: "aaaaaaaa-d97b-0000-1111-555598671f8c", Url: api.URL + "/flows/fmpwizard/huston"}}
+	defer parseAvailableFlows()([]byte(mockedFlows))
+
+	f := &flowdockAdapter{}
+	reply := ChatReply{Text: "Error: \"quotes\"\nand a new line", Tags: []string{"cortex"}}
+	msg := ChatMessage{Channel: "aaaaaaaa-d97b-0000-1111-555598671f8c", ThreadID: "3816534"}
+	id, err := f.Reply(msg, reply)
+	if err != nil || id != "3816600" {
+		t.Errorf("Reply gave %v, %v", id, err)
+	}
+	if message := <-posted; message.Content != reply.Text || message.Tags[0] != "cortex" {
+		t.Errorf("Flowdock got %+v", message)
+	}
+
+	msg.ThreadID = "NuwjBUOL2rgsfIsrX3vmCspESiG"
+	f.Reply(msg, reply)
+	if message := <-posted; message.ThreadID != msg.ThreadID {
+		t.Errorf("Flowdock got %+v", message)
+	}
+}
+
+func TestFlowdockToChatMessagePrivate(t *testing.T) {
+	line := []byte(`{"event": "message", "id": 12, "to": "4877", "user": "31347", "content": "turn light 3 on"}`)
+	var flowMessage flowdockMsg
+	json.Unmarshal(line, &flowMessage)
+	msg, ok := flowdockToChatMessage(flowMessage, line)
+	if !ok || !msg.Private || msg.Text != "turn light 3 on" || msg.Sender != "31347" {
+		t.Errorf("flowdockToChatMessage gave %+v, %v", msg, ok)
+	}
+}
+
+func TestFlowdockVoiceMemo(t *testing.T) {
+	posted := make(chan flowdockOutgoing, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/flows/fmpwizard/huston/files/abc/memo.wav":
+			w.Write([]byte("RIFF fake wav"))
+		case "/flows/fmpwizard/huston/messages/3816534/comments":
+			var message flowdockOutgoing
+			json.NewDecoder(r.Body).Decode(&message)
+			posted <- message
+			w.Write([]byte(`{"id": 3816600}`))
+		default:
+			t.Errorf("Unexpected Flowdock call %v", r.URL)
+		}
+	}))
+	defer api.Close()
+	var witCalls int
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		witCalls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/speech" || string(body) != "RIFF fake wav" || r.Header.Get("Content-Type") != "audio/wav" {
+			t.Errorf("Wit got %v %q %v", r.URL, body, r.Header)
+		}
+		w.Write([]byte(`{"outcome": {"intent": "temperature", "entities": {"temperature": {"value": {"unit": "F", "temperature": 212}}}}}`))
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.FlowdockAPIURL = api.URL
+	config.WitAPIURL = wit.URL
+	availableFlows = []flows{{Id: "aaaaaaaa-d97b-0000-1111-555598671f8c", Url: api.URL + "/flows/fmpwizard/huston"}}
+	defer parseAvailableFlows()([]byte(mockedFlows))
+	config.Activation = map[string]string{"*": "mention"}
+
+	line := []byte(`{"event": "file", "id": 3816534, "flow": "aaaaaaaa-d97b-0000-1111-555598671f8c", "user": "31347",
+		"content": {"path": "/flows/fmpwizard/huston/files/abc/memo.wav", "file_name": "memo.wav", "content_type": "audio/wav"}}`)
+	var flowMessage flowdockMsg
+	json.Unmarshal(line, &flowMessage)
+	msg, ok := flowdockToChatMessage(flowMessage, line)
+	if !ok || msg.Attachment == nil || msg.Attachment.Name != "memo.wav" {
+		t.Fatalf("flowdockToChatMessage gave %+v, %v", msg, ok)
+	}
+	//nobody mentioned Cortex, so the memo is not for us
+	handleChatMessage(&flowdockAdapter{}, msg)
+	if witCalls != 0 {
+		t.Errorf("A voice memo nobody sent to Cortex went to Wit")
+	}
+
+	//tagged with @cortex
+	parseUsers()([]byte(mockedUsers))
+	config.CortexEmail = "diego+cortex@fmpwizard.com"
+	flowMessage.Tags = []string{":user:4877"}
+	msg, _ = flowdockToChatMessage(flowMessage, line)
+	handleChatMessage(&flowdockAdapter{}, msg)
+	if message := <-posted; message.Content != "Which is 100C" || witCalls != 1 {
+		t.Errorf("Voice memo reply was %+v", message)
+	}
+
+	config.Activation = map[string]string{"*": "always"}
+	msg.Mentioned = false
+	handleChatMessage(&flowdockAdapter{}, msg)
+	if message := <-posted; message.Content != "Which is 100C" || witCalls != 2 {
+		t.Errorf("Voice memo reply was %+v", message)
+	}
+}
+
+func TestFlowdockToChatMessageEdit(t *testing.T) {
+	line := []byte(`{"event": "message-edit", "id": 3816600, "flow": "aaaaaaaa-d97b-0000-1111-555598671f8c", "user": "31347",
+		"content": {"message": 3816534, "updated_content": "turn light 4 on"}}`)
+	var flowMessage flowdockMsg
+	json.Unmarshal(line, &flowMessage)
+	msg, ok := flowdockToChatMessage(flowMessage, line)
+	if !ok || !msg.Edited || msg.ID != "3816534" || msg.Text != "turn light 4 on" {
+		t.Errorf("flowdockToChatMessage gave %+v, %v", msg, ok)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+//ChatReply is what Cortex answers with. Text is markdown, built with the
+//md helpers below, and each adapter renders it the way its chat understands.
+//Tags are only used where the chat supports them, like Flowdock.
+type ChatReply struct {
+	Text string
+	Tags []string
+}
+
+//textReply is a reply without tags
+func textReply(text string) ChatReply {
+	return ChatReply{Text: text}
+}
+
+//mdLink escapes the brackets in the title, an issue called "[bug] crash"
+//would end the link text otherwise
+func mdLink(title, url string) string {
+	return fmt.Sprintf("[%s](%s)", mdLinkTitleEscaper.Replace(title), url)
+}
+
+var mdLinkTitleEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`)
+var mdLinkTitleUnescaper = strings.NewReplacer(`\\`, `\`, `\[`, "[", `\]`, "]")
+
+func mdBold(text string) string {
+	return "**" + text + "**"
+}
+
+//mdCode gives you inline code for a single line, and a code block otherwise.
+//The fence has more backticks than the code, so backticks in it are fine.
+func mdCode(code string) string {
+	fence := strings.Repeat("`", longestBacktickRun(code)+1)
+	if strings.Contains(code, "\n") {
+		if len(fence) < 3 {
+			fence = "```"
+		}
+		return fence + "\n" + strings.TrimRight(code, "\n") + "\n" + fence
+	}
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") {
+		//so the backticks of the code are not part of the fence
+		code = " " + code + " "
+	}
+	return fence + code + fence
+}
+
+func longestBacktickRun(text string) int {
+	var longest int
+	for i := 0; i < len(text); {
+		n := backtickRun(text[i:])
+		if n > longest {
+			longest = n
+		}
+		i += n + 1
+	}
+	return longest
+}
+
+//backtickRun is how many backticks text starts with
+func backtickRun(text string) int {
+	n := 0
+	for n < len(text) && text[n] == '`' {
+		n++
+	}
+	return n
+}
+
+var mdLinkRegexp = regexp.MustCompile(`\[((?:\\.|[^\]\\])+)\]\(([^)\s]+)\)`)
+var mdBoldRegexp = regexp.MustCompile(`\*\*(.+?)\*\*`)
+
+//mdCodeSpan is code we took out of the markdown, so the rest can be converted
+//without touching it
+type mdCodeSpan struct {
+	code  string
+	block bool
+}
+
+//extractCode replaces the code in the markdown with placeholders, and gives
+//you the code. A block starts with a line of three or more backticks and
+//ends with the same line, inline code ends with as many backticks as it
+//started with.
+func extractCode(markdown string) (string, []mdCodeSpan) {
+	var text strings.Builder
+	var spans []mdCodeSpan
+	add := func(span mdCodeSpan) {
+		spans = append(spans, span)
+		fmt.Fprintf(&text, "\x00%d\x00", len(spans)-1)
+	}
+	for i := 0; i < len(markdown); {
+		if markdown[i] != '`' {
+			text.WriteByte(markdown[i])
+			i++
+			continue
+		}
+		n := backtickRun(markdown[i:])
+		rest := markdown[i+n:]
+		if n >= 3 && strings.HasPrefix(rest, "\n") {
+			if end := closingFence(rest, n); end >= 0 {
+				add(mdCodeSpan{code: rest[1:end], block: true})
+				i += n + end + 1 + n
+				continue
+			}
+		}
+		if end := closingBackticks(rest, n); end >= 0 {
+			code := rest[:end]
+			if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+				code = code[1 : len(code)-1]
+			}
+			add(mdCodeSpan{code: code})
+			i += n + end + n
+			continue
+		}
+		text.WriteString(markdown[i : i+n])
+		i += n
+	}
+	return text.String(), spans
+}
+
+//closingFence finds the \n and n backticks that end a code block
+func closingFence(text string, n int) int {
+	fence := "\n" + strings.Repeat("`", n)
+	for i := 0; i < len(text); {
+		end := strings.Index(text[i:], fence)
+		if end < 0 {
+			return -1
+		}
+		end += i
+		if backtickRun(text[end+1:]) == n {
+			return end
+		}
+		i = end + 1
+	}
+	return -1
+}
+
+//closingBackticks finds the n backticks that end inline code, on the same line
+func closingBackticks(text string, n int) int {
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case '\n':
+			return -1
+		case '`':
+			m := backtickRun(text[i:])
+			if m == n {
+				return i
+			}
+			i += m
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+//restoreCode puts the code back where extractCode took it from
+func restoreCode(text string, spans []mdCodeSpan, render func(mdCodeSpan) string) string {
+	for i, span := range spans {
+		text = strings.Replace(text, fmt.Sprintf("\x00%d\x00", i), render(span), 1)
+	}
+	return text
+}
+
+//renderLinks converts the links, title gets the text without the escapes
+func renderLinks(text string, render func(title, url string) string) string {
+	return mdLinkRegexp.ReplaceAllStringFunc(text, func(link string) string {
+		parts := mdLinkRegexp.FindStringSubmatch(link)
+		return render(mdLinkTitleUnescaper.Replace(parts[1]), parts[2])
+	})
+}
+
+//renderPlain is for chats without any formatting, like IRC and SMS
+func renderPlain(markdown string) string {
+	text, spans := extractCode(markdown)
+	text = renderLinks(text, func(title, url string) string {
+		if title == url {
+			return url
+		}
+		return fmt.Sprintf("%s (%s)", title, url)
+	})
+	text = mdBoldRegexp.ReplaceAllString(text, "$1")
+	return restoreCode(text, spans, func(span mdCodeSpan) string {
+		return span.code
+	})
+}
+
+//slackEscaper escapes what Slack's mrkdwn uses for links and mentions
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+//renderSlack converts to Slack's mrkdwn, code is written the same way
+func renderSlack(markdown string) string {
+	text, spans := extractCode(markdown)
+	text = slackEscaper.Replace(text)
+	text = renderLinks(text, func(title, url string) string {
+		return "<" + url + "|" + title + ">"
+	})
+	text = mdBoldRegexp.ReplaceAllString(text, "*$1*")
+	return restoreCode(text, spans, func(span mdCodeSpan) string {
+		if span.block {
+			return mdCode(slackEscaper.Replace(span.code) + "\n")
+		}
+		return mdCode(slackEscaper.Replace(span.code))
+	})
+}
+
+//renderHTML is for chats that take html, like Matrix's formatted_body
+func renderHTML(markdown string) string {
+	text, spans := extractCode(markdown)
+	text = html.EscapeString(text)
+	text = renderLinks(text, func(title, url string) string {
+		return `<a href="` + url + `">` + title + "</a>"
+	})
+	text = mdBoldRegexp.ReplaceAllString(text, "<strong>$1</strong>")
+	text = strings.Replace(text, "\n", "<br>", -1)
+	return restoreCode(text, spans, func(span mdCodeSpan) string {
+		if span.block {
+			return "<pre><code>" + html.EscapeString(span.code) + "</code></pre>"
+		}
+		return "<code>" + html.EscapeString(span.code) + "</code>"
+	})
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+const formattedReply = "Issue " + "[#45](https://github.com/fmpwizard/go-cortex/issues/45)" + " is **open**, run `go test`:\n```\ngo test ./...\n```"
+
+func TestRenderPlain(t *testing.T) {
+	want := "Issue #45 (https://github.com/fmpwizard/go-cortex/issues/45) is open, run go test:\ngo test ./..."
+	if got := renderPlain(formattedReply); got != want {
+		t.Errorf("renderPlain gave %q", got)
+	}
+}
+
+func TestRenderSlack(t *testing.T) {
+	want := "Issue <https://github.com/fmpwizard/go-cortex/issues/45|#45> is *open*, run `go test`:\n```\ngo test ./...\n```"
+	if got := renderSlack(formattedReply); got != want {
+		t.Errorf("renderSlack gave %q", got)
+	}
+}
+
+func TestRenderHTML(t *testing.T) {
+	want := `Issue <a href="https://github.com/fmpwizard/go-cortex/issues/45">#45</a> is <strong>open</strong>, run <code>go test</code>:<br><pre><code>go test ./...</code></pre>`
+	if got := renderHTML(formattedReply); got != want {
+		t.Errorf("renderHTML gave %q", got)
+	}
+	if got := renderHTML(`<script> & "quotes"`); got != "&lt;script&gt; &amp; &#34;quotes&#34;" {
+		t.Errorf("renderHTML didn't escape, gave %q", got)
+	}
+}
+
+func TestMdCode(t *testing.T) {
+	if got := mdCode("go test"); got != "`go test`" {
+		t.Errorf("mdCode gave %q", got)
+	}
+	if got := mdCode("line 1\nline 2\n"); got != "```\nline 1\nline 2\n```" {
+		t.Errorf("mdCode gave %q", got)
+	}
+}
+
+func TestMdLinkBrackets(t *testing.T) {
+	reply := "Created " + mdLink(`#7 [bug] crash in C:\temp`, "https://github.com/fmpwizard/go-cortex/issues/7")
+	if got := renderPlain(reply); got != `Created #7 [bug] crash in C:\temp (https://github.com/fmpwizard/go-cortex/issues/7)` {
+		t.Errorf("renderPlain gave %q", got)
+	}
+	if got := renderSlack(reply); got != `Created <https://github.com/fmpwizard/go-cortex/issues/7|#7 [bug] crash in C:\temp>` {
+		t.Errorf("renderSlack gave %q", got)
+	}
+	if got := renderHTML(reply); got != `Created <a href="https://github.com/fmpwizard/go-cortex/issues/7">#7 [bug] crash in C:\temp</a>` {
+		t.Errorf("renderHTML gave %q", got)
+	}
+}
+
+func TestMdCodeBackticks(t *testing.T) {
+	code := mdCode("echo `date`")
+	if code != "`` echo `date` ``" {
+		t.Errorf("mdCode gave %q", code)
+	}
+	if got := renderPlain("run " + code); got != "run echo `date`" {
+		t.Errorf("renderPlain gave %q", got)
+	}
+	if got := renderHTML("run " + mdCode("`x` **y**")); got != "run <code>`x` **y**</code>" {
+		t.Errorf("renderHTML gave %q", got)
+	}
+	block := mdCode("```\nnested\n```\n")
+	if got := renderPlain(block); got != "```\nnested\n```" {
+		t.Errorf("renderPlain of a block with a fence gave %q", got)
+	}
+}
+
+func TestRenderSlackEscapes(t *testing.T) {
+	got := renderSlack("Tom & Jerry <!channel> " + mdLink("a < b", "https://example.com/?a=1&b=2") + " " + mdCode("x > 1"))
+	want := "Tom &amp; Jerry &lt;!channel&gt; <https://example.com/?a=1&amp;b=2|a &lt; b> `x &gt; 1`"
+	if got != want {
+		t.Errorf("renderSlack gave %q", got)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//giteaTracker is the Tracker for Gitea, its api looks a lot like GitHub's,
+//so we reuse githubIssue. URL is the api, like https://gitea.example.com/api/v1
+type giteaTracker struct {
+	client trackerClient
+	repo   githubRepo
+}
+
+func newGiteaTracker(trackerConfig TrackerConfig) (*giteaTracker, error) {
+	repo, err := parseGithubRepo(trackerConfig.Project)
+	if err != nil {
+		return nil, err
+	}
+	if trackerConfig.URL == "" {
+		return nil, fmt.Errorf("Gitea trackers need the url of the api")
+	}
+	token := trackerConfig.Token
+	return &giteaTracker{
+		client: trackerClient{
+			name: "Gitea",
+			base: strings.TrimSuffix(trackerConfig.URL, "/"),
+			auth: func(req *http.Request) {
+				if token != "" {
+					req.Header.Add("Authorization", fmt.Sprintf("token %s", token))
+				}
+			},
+		},
+		repo: repo,
+	}, nil
+}
+
+func (g *giteaTracker) issuesPath() string {
+	return fmt.Sprintf("/repos/%s/%s/issues", g.repo.Owner, g.repo.Name)
+}
+
+func (g *giteaTracker) issuePath(key string) (string, error) {
+	number, err := issueNumber(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", g.issuesPath(), number), nil
+}
+
+func (g *giteaTracker) Lookup(key string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	var issue githubIssue
+	err = g.client.call("GET", path, nil, &issue)
+	return issue.trackerIssue(), err
+}
+
+//Create opens the issue, Gitea wants label ids instead of names, so labels
+//are left out
+func (g *giteaTracker) Create(issue trackerIssue) (trackerIssue, error) {
+	payload := map[string]string{
+		"title": issue.Title,
+		"body":  issue.Body,
+	}
+	var created githubIssue
+	err := g.client.call("POST", g.issuesPath(), payload, &created)
+	return created.trackerIssue(), err
+}
+
+func (g *giteaTracker) Comment(key, text string) error {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return err
+	}
+	return g.client.call("POST", path+"/comments", map[string]string{"body": text}, nil)
+}
+
+func (g *giteaTracker) Transition(key, state string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	state = strings.ToLower(state)
+	if state != "closed" && state != "open" {
+		return trackerIssue{}, fmt.Errorf("Gitea issues can only be open or closed, not %s", state)
+	}
+	var issue githubIssue
+	err = g.client.call("PATCH", path, map[string]string{"state": state}, &issue)
+	return issue.trackerIssue(), err
+}
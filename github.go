@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+//githubDefaultAPIURL is used when the config doesn't set the api url, for
+//GitHub Enterprise it looks like https://github.example.com/api/v3
+const githubDefaultAPIURL = "https://api.github.com"
+
+//githubIssue is the part of an issue, or pull request, we tell people about.
+//Gitea uses the same fields.
+type githubIssue struct {
+	Number    int
+	Title     string
+	Body      string
+	State     string
+	HTMLURL   string `json:"html_url"`
+	Assignees []struct {
+		Login string
+	}
+	Labels []struct {
+		Name string
+	}
+	PullRequest *struct{} `json:"pull_request"`
+}
+
+func (issue githubIssue) trackerIssue() trackerIssue {
+	ret := trackerIssue{
+		Key:   strconv.Itoa(issue.Number),
+		Kind:  "Issue",
+		Title: issue.Title,
+		Body:  issue.Body,
+		State: issue.State,
+		URL:   issue.HTMLURL,
+	}
+	if issue.PullRequest != nil {
+		ret.Kind = "Pull request"
+	}
+	for _, assignee := range issue.Assignees {
+		ret.Assignees = append(ret.Assignees, "@"+assignee.Login)
+	}
+	for _, label := range issue.Labels {
+		ret.Labels = append(ret.Labels, label.Name)
+	}
+	return ret
+}
+
+//githubRepo is the owner/name pair the GitHub and Gitea apis want
+type githubRepo struct {
+	Owner string
+	Name  string
+}
+
+//parseGithubRepo finds the repo in an issues url from FlowsTicketsUrls,
+//like https://github.com/fmpwizard/go-cortex/issues/, or in owner/repo
+func parseGithubRepo(issuesURL string) (githubRepo, error) {
+	u, err := url.Parse(issuesURL)
+	if err != nil {
+		return githubRepo{}, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		return githubRepo{}, fmt.Errorf("Could not find a repo in %s", issuesURL)
+	}
+	return githubRepo{parts[0], parts[1]}, nil
+}
+
+//githubTracker is the Tracker for GitHub and GitHub Enterprise
+type githubTracker struct {
+	client trackerClient
+	repo   githubRepo
+}
+
+func newGithubTracker(trackerConfig TrackerConfig) (*githubTracker, error) {
+	repo, err := parseGithubRepo(trackerConfig.Project)
+	if err != nil {
+		return nil, err
+	}
+	base := githubDefaultAPIURL
+	if trackerConfig.URL != "" {
+		base = strings.TrimSuffix(trackerConfig.URL, "/")
+	}
+	token := trackerConfig.Token
+	return &githubTracker{
+		client: trackerClient{
+			name: "GitHub",
+			base: base,
+			auth: func(req *http.Request) {
+				req.Header.Set("Accept", "application/vnd.github+json")
+				if token != "" {
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+				}
+			},
+		},
+		repo: repo,
+	}, nil
+}
+
+func (g *githubTracker) issuesPath() string {
+	return fmt.Sprintf("/repos/%s/%s/issues", g.repo.Owner, g.repo.Name)
+}
+
+func (g *githubTracker) issuePath(key string) (string, error) {
+	number, err := issueNumber(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", g.issuesPath(), number), nil
+}
+
+//Lookup gets an issue or pull request
+func (g *githubTracker) Lookup(key string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	var issue githubIssue
+	err = g.client.call("GET", path, nil, &issue)
+	return issue.trackerIssue(), err
+}
+
+func (g *githubTracker) Create(issue trackerIssue) (trackerIssue, error) {
+	payload := map[string]interface{}{
+		"title": issue.Title,
+		"body":  issue.Body,
+	}
+	if len(issue.Labels) > 0 {
+		payload["labels"] = issue.Labels
+	}
+	var created githubIssue
+	err := g.client.call("POST", g.issuesPath(), payload, &created)
+	return created.trackerIssue(), err
+}
+
+func (g *githubTracker) Comment(key, text string) error {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return err
+	}
+	return g.client.call("POST", path+"/comments", map[string]string{"body": text}, nil)
+}
+
+//Transition closes or opens the issue and gives you how it looks now
+func (g *githubTracker) Transition(key, state string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	state = strings.ToLower(state)
+	if state != "closed" && state != "open" {
+		return trackerIssue{}, fmt.Errorf("GitHub issues can only be open or closed, not %s", state)
+	}
+	var issue githubIssue
+	err = g.client.call("PATCH", path, map[string]string{"state": state}, &issue)
+	return issue.trackerIssue(), err
+}
+
+//Label adds the labels to the issue, keeping the ones it had
+func (g *githubTracker) Label(key string, labels ...string) error {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return err
+	}
+	return g.client.call("POST", path+"/labels", map[string][]string{"labels": labels}, nil)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//fakeGithub serves issue 45 of fmpwizard/go-cortex and records what we
+//change on it
+type fakeGithub struct {
+	state   string
+	labels  []string
+	auth    string
+	created map[string]interface{}
+}
+
+func (f *fakeGithub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.auth = r.Header.Get("Authorization")
+	switch r.Method + " " + r.URL.Path {
+	case "GET /repos/fmpwizard/go-cortex/issues/45":
+	case "PATCH /repos/fmpwizard/go-cortex/issues/45":
+		var patch map[string]string
+		json.NewDecoder(r.Body).Decode(&patch)
+		f.state = patch["state"]
+	case "POST /repos/fmpwizard/go-cortex/issues":
+		var created map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&created)
+		f.created = created
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"number": 46, "title": %q, "state": "open", "html_url": "https://github.com/fmpwizard/go-cortex/issues/46"}`, created["title"])
+		return
+	case "POST /repos/fmpwizard/go-cortex/issues/45/labels":
+		var labels struct {
+			Labels []string
+		}
+		json.NewDecoder(r.Body).Decode(&labels)
+		f.labels = append(f.labels, labels.Labels...)
+		fmt.Fprint(w, `[]`)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"message": "Not Found"}`)
+		return
+	}
+	var labels []string
+	for _, label := range f.labels {
+		labels = append(labels, fmt.Sprintf(`{"name": %q}`, label))
+	}
+	fmt.Fprintf(w, `{"number": 45, "title": "Lights stay on", "state": %q, "html_url": "https://github.com/fmpwizard/go-cortex/issues/45",
+		"assignees": [{"login": "fmpwizard"}], "labels": [%s]}`, f.state, strings.Join(labels, ","))
+}
+
+func withFakeGithub() (*fakeGithub, func()) {
+	fake := &fakeGithub{state: "open", labels: []string{"lights"}}
+	server := httptest.NewServer(fake)
+	oldConfig := config
+	config.GithubAPIURL = server.URL
+	config.GithubToken = "s3cret"
+	config.GithubAllowedUsers = []string{"flowdock:diego"}
+	config.FlowsTicketsUrls = []map[string]string{{"huston": "https://github.com/fmpwizard/go-cortex/issues/"}}
+	return fake, func() {
+		server.Close()
+		config = oldConfig
+	}
+}
+
+func TestParseGithubRepo(t *testing.T) {
+	repo, err := parseGithubRepo("https://github.com/fmpwizard/go-cortex/issues/")
+	if err != nil || repo != (githubRepo{"fmpwizard", "go-cortex"}) {
+		t.Errorf("parseGithubRepo gave %+v, %v", repo, err)
+	}
+	_, err = parseGithubRepo("https://github.com/")
+	if err == nil {
+		t.Error("parseGithubRepo should fail without a repo")
+	}
+}
+
+func TestGithubRepliesSummary(t *testing.T) {
+	fake, done := withFakeGithub()
+	defer done()
+
+	ret := WitResponse{Issues: WitIssuesResponse{keys: []string{"45"}}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston"})
+	expected := "Issue [#45 Lights stay on](https://github.com/fmpwizard/go-cortex/issues/45) is **open**, assigned to @fmpwizard, labeled `lights`"
+	if len(replies) != 1 || replies[0].Text != expected {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+	if fake.auth != "Bearer s3cret" {
+		t.Errorf("GitHub got Authorization %q", fake.auth)
+	}
+}
+
+func TestGithubRepliesClose(t *testing.T) {
+	fake, done := withFakeGithub()
+	defer done()
+
+	ret := WitResponse{Issues: WitIssuesResponse{keys: []string{"45"}, Action: "close"}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston", Sender: "12", SenderName: "mallory", Adapter: "flowdock"})
+	if len(replies) != 1 || replies[0].Text != "Sorry, you are not allowed to close issues." || fake.state != "open" {
+		t.Errorf("chatReplies gave %+v, state %s", replies, fake.state)
+	}
+
+	//anybody can be diego on IRC
+	replies = chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston", Sender: "diego", SenderName: "diego", Adapter: "irc"})
+	if len(replies) != 1 || replies[0].Text != "Sorry, you are not allowed to close issues." || fake.state != "open" {
+		t.Errorf("chatReplies gave %+v, state %s", replies, fake.state)
+	}
+
+	replies = chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston", Sender: "11", SenderName: "diego", Adapter: "flowdock"})
+	if len(replies) != 1 || replies[0].Text != "Closed [#45 Lights stay on](https://github.com/fmpwizard/go-cortex/issues/45)" || fake.state != "closed" {
+		t.Errorf("chatReplies gave %+v, state %s", replies, fake.state)
+	}
+}
+
+func TestGithubRepliesLabel(t *testing.T) {
+	fake, done := withFakeGithub()
+	defer done()
+
+	ret := WitResponse{Issues: WitIssuesResponse{keys: []string{"45"}, Action: "label", Label: "bug"}}
+	replies := chatReplies(context.Background(), ret, ChatMessage{ChannelName: "huston", Sender: "11", SenderName: "diego", Adapter: "flowdock"})
+	if len(replies) != 1 || replies[0].Text != "Labeled [#45](https://github.com/fmpwizard/go-cortex/issues/45) as `bug`" {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+	if len(fake.labels) != 2 || fake.labels[1] != "bug" {
+		t.Errorf("GitHub has labels %+v", fake.labels)
+	}
+}
+
+func TestProcessWitResponseGithubLabel(t *testing.T) {
+	var intent WitMessage
+	intent.Outcome.Intent = "github_label"
+	intent.Outcome.Entities.MultipleNumber = []WitNumber{{Value: 45}}
+	intent.Outcome.Entities.Label.Value = "bug"
+	ret := ProcessIntent(context.Background(), intent)
+	if ret.Issues.Action != "label" || ret.Issues.Label != "bug" || len(ret.Issues.keys) != 1 {
+		t.Errorf("ProcessIntent gave %+v", ret.Issues)
+	}
+}
+
+func TestGithubRepliesCreate(t *testing.T) {
+	fake, done := withFakeGithub()
+	defer done()
+
+	ret := ProcessIntent(context.Background(), WitMessage{MsgBody: "file a bug: the deploy script fails on arm", Outcome: WitMessageOutcome{Intent: "create_issue"}})
+	msg := ChatMessage{ChannelName: "huston", Sender: "11", SenderName: "diego", URL: "https://www.flowdock.com/app/fmpwizard/huston/messages/7"}
+	replies := chatReplies(context.Background(), ret, msg)
+	if len(replies) != 1 || replies[0].Text != "Created [#46 the deploy script fails on arm](https://github.com/fmpwizard/go-cortex/issues/46)" {
+		t.Errorf("chatReplies gave %+v", replies)
+	}
+	expectedBody := "Reported by diego in huston, see [the original message](https://www.flowdock.com/app/fmpwizard/huston/messages/7)"
+	if fake.created["body"] != expectedBody || fmt.Sprint(fake.created["labels"]) != "[bug]" {
+		t.Errorf("GitHub got %+v", fake.created)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const gitlabDefaultAPIURL = "https://gitlab.com/api/v4"
+
+//gitlabIssue is the part of a GitLab issue we tell people about
+type gitlabIssue struct {
+	IID         int `json:"iid"`
+	Title       string
+	Description string
+	State       string
+	WebURL      string `json:"web_url"`
+	Assignees   []struct {
+		Username string
+	}
+	Labels []string
+}
+
+func (issue gitlabIssue) trackerIssue() trackerIssue {
+	ret := trackerIssue{
+		Key:    strconv.Itoa(issue.IID),
+		Kind:   "Issue",
+		Title:  issue.Title,
+		Body:   issue.Description,
+		State:  issue.State,
+		URL:    issue.WebURL,
+		Labels: issue.Labels,
+	}
+	if ret.State == "opened" {
+		ret.State = "open"
+	}
+	for _, assignee := range issue.Assignees {
+		ret.Assignees = append(ret.Assignees, "@"+assignee.Username)
+	}
+	return ret
+}
+
+//gitlabTracker is the Tracker for gitlab.com and self hosted GitLab, the
+//project is its path, like group/project, or its numeric id
+type gitlabTracker struct {
+	client  trackerClient
+	project string
+}
+
+func newGitlabTracker(trackerConfig TrackerConfig) *gitlabTracker {
+	base := gitlabDefaultAPIURL
+	if trackerConfig.URL != "" {
+		base = strings.TrimSuffix(trackerConfig.URL, "/")
+	}
+	token := trackerConfig.Token
+	return &gitlabTracker{
+		client: trackerClient{
+			name: "GitLab",
+			base: base,
+			auth: func(req *http.Request) {
+				if token != "" {
+					req.Header.Add("PRIVATE-TOKEN", token)
+				}
+			},
+		},
+		project: trackerConfig.Project,
+	}
+}
+
+func (g *gitlabTracker) issuesPath() string {
+	return fmt.Sprintf("/projects/%s/issues", url.PathEscape(g.project))
+}
+
+func (g *gitlabTracker) issuePath(key string) (string, error) {
+	number, err := issueNumber(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%d", g.issuesPath(), number), nil
+}
+
+func (g *gitlabTracker) Lookup(key string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	var issue gitlabIssue
+	err = g.client.call("GET", path, nil, &issue)
+	return issue.trackerIssue(), err
+}
+
+func (g *gitlabTracker) Create(issue trackerIssue) (trackerIssue, error) {
+	payload := map[string]string{
+		"title":       issue.Title,
+		"description": issue.Body,
+	}
+	if len(issue.Labels) > 0 {
+		payload["labels"] = strings.Join(issue.Labels, ",")
+	}
+	var created gitlabIssue
+	err := g.client.call("POST", g.issuesPath(), payload, &created)
+	return created.trackerIssue(), err
+}
+
+func (g *gitlabTracker) Comment(key, text string) error {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return err
+	}
+	return g.client.call("POST", path+"/notes", map[string]string{"body": text}, nil)
+}
+
+//Transition closes or reopens the issue
+func (g *gitlabTracker) Transition(key, state string) (trackerIssue, error) {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	var event string
+	switch strings.ToLower(state) {
+	case "closed", "close":
+		event = "close"
+	case "open", "opened", "reopen":
+		event = "reopen"
+	default:
+		return trackerIssue{}, fmt.Errorf("GitLab issues can only be open or closed, not %s", state)
+	}
+	var issue gitlabIssue
+	err = g.client.call("PUT", path, map[string]string{"state_event": event}, &issue)
+	return issue.trackerIssue(), err
+}
+
+//Label adds the labels to the issue, keeping the ones it had
+func (g *gitlabTracker) Label(key string, labels ...string) error {
+	path, err := g.issuePath(key)
+	if err != nil {
+		return err
+	}
+	return g.client.call("PUT", path, map[string]string{"add_labels": strings.Join(labels, ",")}, nil)
+}
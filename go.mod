@@ -1,5 +1,9 @@
 module github.com/fmpwizard/go-cortex
 
-go 1.12
+go 1.20
 
-require github.com/huin/goserial v0.0.0-20121012073615-7b90efdb22b1
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/huin/goserial v0.0.0-20121012073615-7b90efdb22b1
+	gopkg.in/yaml.v3 v3.0.1
+)
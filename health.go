@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//nluHealthTTL is how long we trust the last request to Wit before we check
+//again that we can reach it
+const nluHealthTTL = 30 * time.Second
+
+//chatStuckAfter is how long a chat can be disconnected before /healthz says
+//Cortex needs a restart, listenChat should have connected again by then
+var chatStuckAfter = 2 * chatMaxRetryWait
+
+var startedAt = time.Now()
+
+//healthCheck is how a subsystem is doing, Detail says what is wrong
+type healthCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+var nluHealthMu sync.Mutex
+var nluHealth healthCheck
+var nluCheckedAt time.Time
+
+//setNLUHealth remembers how the last request to Wit went
+func setNLUHealth(err error) {
+	nluHealthMu.Lock()
+	defer nluHealthMu.Unlock()
+	nluHealth = healthCheck{OK: err == nil}
+	if err != nil {
+		nluHealth.Detail = err.Error()
+	}
+	nluCheckedAt = time.Now()
+}
+
+//checkNLU uses the last request to Wit, when there is no recent one we see
+//if Wit answers at all, any http response is fine
+func checkNLU() healthCheck {
+	nluHealthMu.Lock()
+	if time.Since(nluCheckedAt) < nluHealthTTL {
+		defer nluHealthMu.Unlock()
+		return nluHealth
+	}
+	nluHealthMu.Unlock()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Get(witAPIURL())
+	if err == nil {
+		res.Body.Close()
+	}
+	setNLUHealth(err)
+	nluHealthMu.Lock()
+	defer nluHealthMu.Unlock()
+	return nluHealth
+}
+
+//checkSerial is fine when we have the Arduino port open, or when there is
+//no Arduino plugged in at all
+func checkSerial() healthCheck {
+	serialMu.Lock()
+	port := s
+	serialMu.Unlock()
+	switch {
+	case c.Name == "":
+		return healthCheck{OK: true, Detail: "no Arduino found"}
+	case port == nil:
+		return healthCheck{OK: false, Detail: fmt.Sprintf("could not open %s", c.Name)}
+	}
+	return healthCheck{OK: true, Detail: c.Name}
+}
+
+//healthChecks gives you how every subsystem is doing, chats show up as
+//chat:flowdock, chat:slack and so on
+func healthChecks() map[string]healthCheck {
+	checks := processChecks()
+	checks["nlu"] = checkNLU()
+	return checks
+}
+
+//processChecks are the checks that don't call out, the serial port and
+//the chats, for /healthz
+func processChecks() map[string]healthCheck {
+	checks := map[string]healthCheck{
+		"serial": checkSerial(),
+	}
+	for name, status := range getChatStatuses() {
+		check := healthCheck{OK: status.Connected}
+		if !status.Connected && status.Since.IsZero() {
+			check.Detail = "never connected: " + status.LastError
+		} else if !status.Connected {
+			check.Detail = fmt.Sprintf("disconnected since %s: %s", status.Since.Format(time.RFC3339), status.LastError)
+		}
+		checks["chat:"+name] = check
+	}
+	return checks
+}
+
+func writeHealth(w http.ResponseWriter, checks map[string]healthCheck, ok bool) {
+	report := healthReport{Status: "ok", Checks: checks}
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		report.Status = "unavailable"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+//ReadyzHandler answers 200 when every subsystem works, and 503 with the
+//ones that don't
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := healthChecks()
+	ok := true
+	for _, check := range checks {
+		ok = ok && check.OK
+	}
+	writeHealth(w, checks, ok)
+}
+
+//HealthzHandler answers 503 only when Cortex needs a restart, a chat that
+//has been disconnected for longer than listenChat should take to reconnect.
+//Wit or a chat being down for a bit is for /readyz, a Wit outage should not
+//get Cortex restarted, so we don't even ask Wit here.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	checks := processChecks()
+	ok := true
+	for name, status := range getChatStatuses() {
+		since := status.Since
+		if since.IsZero() {
+			since = startedAt
+		}
+		if !status.Connected && time.Since(since) > chatStuckAfter {
+			ok = false
+			check := checks["chat:"+name]
+			check.Detail = "stuck, " + check.Detail
+			checks["chat:"+name] = check
+		}
+	}
+	writeHealth(w, checks, ok)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	wit := httptest.NewServer(http.NotFoundHandler())
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	nluCheckedAt = time.Time{}
+	chatStatusesMu.Lock()
+	oldStatuses := chatStatuses
+	chatStatuses = make(map[string]chatStatus)
+	chatStatusesMu.Unlock()
+	defer func() {
+		chatStatusesMu.Lock()
+		chatStatuses = oldStatuses
+		chatStatusesMu.Unlock()
+	}()
+
+	setChatStatus("health-test", nil)
+	rec := httptest.NewRecorder()
+	ReadyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	var report healthReport
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusOK || report.Status != "ok" || !report.Checks["nlu"].OK || !report.Checks["chat:health-test"].OK {
+		t.Errorf("/readyz gave %d %s", rec.Code, rec.Body.String())
+	}
+
+	setChatStatus("health-test", errors.New("connection reset"))
+	rec = httptest.NewRecorder()
+	ReadyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	report = healthReport{}
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if rec.Code != http.StatusServiceUnavailable || report.Checks["chat:health-test"].OK {
+		t.Errorf("/readyz gave %d %s", rec.Code, rec.Body.String())
+	}
+
+	//not stuck yet, so Cortex is still alive
+	rec = httptest.NewRecorder()
+	HealthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz gave %d %s", rec.Code, rec.Body.String())
+	}
+	defer func(old time.Duration) { chatStuckAfter = old }(chatStuckAfter)
+	chatStuckAfter = 0
+	rec = httptest.NewRecorder()
+	HealthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz gave %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHealthzWithoutWit(t *testing.T) {
+	var calls int
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	nluCheckedAt = time.Time{}
+
+	rec := httptest.NewRecorder()
+	HealthzHandler(rec, httptest.NewRequest("GET", "/healthz", nil))
+	var report healthReport
+	json.Unmarshal(rec.Body.Bytes(), &report)
+	if _, ok := report.Checks["nlu"]; ok || calls != 0 {
+		t.Errorf("/healthz asked Wit, %d calls and %s", calls, rec.Body.String())
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+//historyTTL is how long we remember what somebody did, and historySize how
+//many commands per person
+const historyTTL = 24 * time.Hour
+const historySize = 50
+
+var userHistories = newHistoryLog()
+
+//historyEntry is a command that switched lights, Actions know how the
+//lights were before so we can undo it
+type historyEntry struct {
+	ID      string
+	Text    string
+	Actions []lightAction
+	Undone  bool
+	at      time.Time
+}
+
+type historyLog struct {
+	mu      sync.Mutex
+	entries map[string][]historyEntry
+}
+
+func newHistoryLog() *historyLog {
+	return &historyLog{entries: make(map[string][]historyEntry)}
+}
+
+//historyKey is per person, no matter the channel they talked to us in
+func historyKey(adapter ChatAdapter, msg ChatMessage) string {
+	return adapter.Name() + "\x00" + msg.Sender
+}
+
+//callerHistoryKey is historyKey for /wit, /sms and the dashboard, per
+//address or phone number
+func callerHistoryKey(channel, sender string) string {
+	if host, _, err := net.SplitHostPort(sender); err == nil {
+		sender = host
+	}
+	return channel + "\x00" + sender
+}
+
+//record adds what the message did, an edited message replaces what the
+//original did
+func (l *historyLog) record(key string, entry historyEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry.at = time.Now()
+	var entries []historyEntry
+	for _, old := range l.entries[key] {
+		if time.Since(old.at) > historyTTL || (entry.ID != "" && old.ID == entry.ID) {
+			continue
+		}
+		entries = append(entries, old)
+	}
+	if len(entry.Actions) > 0 {
+		entries = append(entries, entry)
+	}
+	if len(entries) > historySize {
+		entries = entries[len(entries)-historySize:]
+	}
+	l.entries[key] = entries
+}
+
+//undo reverts the last count commands that are not undone yet, newest
+//first, and gives you the lights it switched
+func (l *historyLog) undo(ctx context.Context, key string, count int) []lightAction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := l.entries[key]
+	var reverted []lightAction
+	for i := len(entries) - 1; i >= 0 && count > 0; i-- {
+		if entries[i].Undone || time.Since(entries[i].at) > historyTTL {
+			continue
+		}
+		actions := entries[i].Actions
+		for j := len(actions) - 1; j >= 0; j-- {
+			reverted = append(reverted, revertLight(ctx, actions[j]))
+		}
+		entries[i].Undone = true
+		count--
+	}
+	return reverted
+}
+
+//recent gives you up to count commands, oldest first
+func (l *historyLog) recent(key string, count int) []historyEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []historyEntry
+	for _, entry := range l.entries[key] {
+		if time.Since(entry.at) <= historyTTL {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) > count {
+		entries = entries[len(entries)-count:]
+	}
+	return entries
+}
+
+//historyReplies answers the undo and history intents, the bool is false
+//for every other intent
+func historyReplies(ctx context.Context, key string, intent WitMessage) ([]ChatReply, bool) {
+	switch intent.Outcome.Intent {
+	case "undo":
+		count := 1
+		entities := intent.Outcome.Entities
+		if len(entities.MultipleNumber) > 0 {
+			count = entities.MultipleNumber[0].Value
+		} else if entities.SingleNumber.Body != "" {
+			count = entities.SingleNumber.Value
+		}
+		if count < 1 {
+			count = 1
+		}
+		reverted := userHistories.undo(ctx, key, count)
+		if len(reverted) == 0 {
+			return []ChatReply{textReply("There is nothing to undo.")}, true
+		}
+		return lightReplies(nil, reverted), true
+	case "history":
+		entries := userHistories.recent(key, 10)
+		if len(entries) == 0 {
+			return []ChatReply{textReply("You haven't asked me to do anything yet.")}, true
+		}
+		var lines []string
+		for _, entry := range entries {
+			var lights []string
+			for _, action := range entry.Actions {
+				lights = append(lights, fmt.Sprintf("light %v %s", action.Light, action.Action))
+			}
+			line := fmt.Sprintf("%s %s: %s", entry.at.Format("15:04"), mdCode(entry.Text), strings.Join(lights, ", "))
+			if entry.Undone {
+				line += " (undone)"
+			}
+			lines = append(lines, line)
+		}
+		return []ChatReply{textReply(strings.Join(lines, "\n"))}, true
+	}
+	return nil, false
+}
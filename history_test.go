@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func undoIntent(count int) WitMessage {
+	var intent WitMessage
+	intent.Outcome.Intent = "undo"
+	if count > 0 {
+		intent.Outcome.Entities.SingleNumber = WitNumber{Value: count, Body: "3"}
+	}
+	return intent
+}
+
+func TestUndo(t *testing.T) {
+	lightStates = make(map[int]string)
+	userHistories = newHistoryLog()
+	key := "fake\x00U1"
+	userHistories.record(key, historyEntry{ID: "1", Text: "turn light 3 on", Actions: ProcessIntent(context.Background(), lightsIntent("on", 3)).Actions})
+	userHistories.record(key, historyEntry{ID: "2", Text: "turn light 4 and 5 on", Actions: ProcessIntent(context.Background(), lightsIntent("on", 4, 5)).Actions})
+	userHistories.record(key, historyEntry{ID: "3", Text: "turn light 3 off", Actions: ProcessIntent(context.Background(), lightsIntent("off", 3)).Actions})
+
+	replies, ok := historyReplies(context.Background(), key, undoIntent(0))
+	if !ok || len(replies) != 1 || replies[0].Text != "Turning light 3 back on" || lightState(3) != "on" {
+		t.Errorf("undo gave %+v, lights %+v", replies, lightStates)
+	}
+
+	replies, _ = historyReplies(context.Background(), key, undoIntent(3))
+	if len(replies) != 1 || replies[0].Text != "Turning light 5 back off, light 4 back off, light 3 back off" {
+		t.Errorf("undo last 3 gave %+v", replies)
+	}
+	if lightState(3) != "off" || lightState(4) != "off" || lightState(5) != "off" {
+		t.Errorf("Lights are %+v", lightStates)
+	}
+
+	replies, _ = historyReplies(context.Background(), key, undoIntent(0))
+	if len(replies) != 1 || replies[0].Text != "There is nothing to undo." {
+		t.Errorf("undo with nothing left gave %+v", replies)
+	}
+	replies, _ = historyReplies(context.Background(), "fake\x00U2", undoIntent(0))
+	if len(replies) != 1 || replies[0].Text != "There is nothing to undo." {
+		t.Errorf("undo is per user, gave %+v", replies)
+	}
+}
+
+func TestHistoryReplies(t *testing.T) {
+	lightStates = make(map[int]string)
+	userHistories = newHistoryLog()
+	key := "fake\x00U1"
+	userHistories.record(key, historyEntry{ID: "1", Text: "turn light 3 on", Actions: ProcessIntent(context.Background(), lightsIntent("on", 3)).Actions})
+	userHistories.record(key, historyEntry{ID: "2", Text: "turn light 4 on", Actions: ProcessIntent(context.Background(), lightsIntent("on", 4)).Actions})
+	//an edit replaces what the original message did
+	userHistories.record(key, historyEntry{ID: "2", Text: "turn light 5 on", Actions: ProcessIntent(context.Background(), lightsIntent("on", 5)).Actions})
+	historyReplies(context.Background(), key, undoIntent(0))
+
+	var intent WitMessage
+	intent.Outcome.Intent = "history"
+	replies, ok := historyReplies(context.Background(), key, intent)
+	if !ok || len(replies) != 1 {
+		t.Fatalf("history gave %+v", replies)
+	}
+	lines := strings.Split(replies[0].Text, "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " `turn light 3 on`: light 3 on") ||
+		!strings.HasSuffix(lines[1], " `turn light 5 on`: light 5 on (undone)") {
+		t.Errorf("history gave %q", lines)
+	}
+
+	_, ok = historyReplies(context.Background(), key, lightsIntent("on", 3))
+	if ok {
+		t.Error("historyReplies should leave other intents alone")
+	}
+}
+
+func TestWitHandlerUndo(t *testing.T) {
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("q") == "undo" {
+			w.Write([]byte(`{"msg_body": "undo", "outcome": {"intent": "undo", "confidence": 1}}`))
+			return
+		}
+		w.Write([]byte(`{"msg_body": "turn light 3 on", "outcome": {"intent": "lights", "confidence": 1, "entities": {"on_off": {"value": "on"}, "github_issue": [{"value": 3, "body": "3"}]}}}`))
+	}))
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	lightStates = make(map[int]string)
+	userHistories = newHistoryLog()
+
+	ask := func(q, remoteAddr string) string {
+		req := httptest.NewRequest("GET", "/wit?q="+q, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		WitHandler(w, req)
+		return w.Body.String()
+	}
+	ask("turn+light+3+on", "10.0.0.1:5000")
+	if answer := ask("undo", "10.0.0.2:5000"); answer != "There is nothing to undo." {
+		t.Errorf("Somebody else's undo answered %q", answer)
+	}
+	//the same caller, from another port
+	if answer := ask("undo", "10.0.0.1:5001"); answer != "Turning light 3 back off" || lightState(3) != "off" {
+		t.Errorf("undo answered %q, light 3 is %s", answer, lightState(3))
+	}
+}
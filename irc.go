@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+//ircDialTimeout is how long we wait to connect to the server
+const ircDialTimeout = 30 * time.Second
+
+//ircReadTimeout is how long the server can be quiet, servers PING every
+//couple of minutes. After that we PING it, and when it doesn't answer in
+//ircReadTimeout either the connection is gone and we connect again.
+var ircReadTimeout = 4 * time.Minute
+
+//ircMaxLine is the most an IRC line can have, with its \r\n. The server
+//adds our :nick!user@host when it passes a message on, ircPrefixRoom is
+//what we keep for that.
+const ircMaxLine = 512
+const ircPrefixRoom = 100
+
+//ircAdapter joins the configured channels, by default it only answers
+//when somebody mentions its nick, or talks to it in a private message. IRC
+//has no threads, so we answer in the channel, addressing the sender.
+type ircAdapter struct {
+	server   string
+	nick     string
+	password string
+	channels []string
+	useTLS   bool
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newIRCAdapter() *ircAdapter {
+	c := currentConfig()
+	var channels []string
+	for _, channel := range strings.Split(c.IRCChannels, ",") {
+		channel = strings.TrimSpace(channel)
+		if channel == "" {
+			continue
+		}
+		if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+			channel = "#" + channel
+		}
+		channels = append(channels, channel)
+	}
+	nick := c.IRCNick
+	if nick == "" {
+		nick = "cortex"
+	}
+	return &ircAdapter{
+		server:   c.IRCServer,
+		nick:     nick,
+		password: c.IRCPassword,
+		channels: channels,
+		useTLS:   c.IRCUseTLS,
+	}
+}
+
+func (i *ircAdapter) Name() string {
+	return "irc"
+}
+
+//defaultActivation keeps Cortex quiet on busy channels unless you set up
+//the Activation setting
+func (i *ircAdapter) defaultActivation() string {
+	return activationMention + "," + activationPrefix + "," + activationPrivate
+}
+
+//Connect registers with the server and joins our channels
+func (i *ircAdapter) Connect() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: ircDialTimeout}
+	if i.useTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", i.server, &tls.Config{})
+	} else {
+		conn, err = dialer.Dial("tcp", i.server)
+	}
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.conn = conn
+	i.reader = bufio.NewReader(conn)
+	i.mu.Unlock()
+
+	if i.password != "" {
+		i.send("PASS %s", i.password)
+	}
+	i.send("NICK %s", i.nick)
+	i.send("USER %s 0 * :Go Cortex", i.nick)
+	return nil
+}
+
+//Receive reads lines until somebody talks to us. When the connection drops,
+//or the server stops answering, we return the error and listenChat connects
+//again.
+func (i *ircAdapter) Receive() (ChatMessage, error) {
+	pinged := false
+	for {
+		i.conn.SetReadDeadline(time.Now().Add(ircReadTimeout))
+		line, err := i.reader.ReadString('\n')
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() && !pinged {
+			//quiet for a while, see if the server is still there
+			pinged = true
+			i.send("PING :%s", i.server)
+			continue
+		}
+		if err != nil {
+			i.conn.Close()
+			return ChatMessage{}, err
+		}
+		pinged = false
+		msg, ok := i.handleLine(parseIRCLine(line))
+		if ok {
+			return msg, nil
+		}
+	}
+}
+
+//Reply sends the text to the channel, or back to the sender on private
+//messages. A \r or \n would end the PRIVMSG and the rest would be a command
+//of its own, so every line is a PRIVMSG, and the long ones are split.
+func (i *ircAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	var address string
+	if strings.HasPrefix(msg.ThreadID, "#") || strings.HasPrefix(msg.ThreadID, "&") {
+		address = msg.Sender + ": "
+	}
+	room := ircMaxLine - ircPrefixRoom - len("PRIVMSG  :\r\n") - len(msg.ThreadID) - len(address)
+	lines := strings.FieldsFunc(renderPlain(reply.Text), func(r rune) bool {
+		return r == '\r' || r == '\n' || r == 0
+	})
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		for _, part := range splitIRCLine(line, room) {
+			err := i.send("PRIVMSG %s :%s", msg.ThreadID, address+part)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return "", nil
+}
+
+//splitIRCLine cuts the line in parts of at most size bytes, at a space when
+//there is one, and never in the middle of a character
+func splitIRCLine(line string, size int) []string {
+	if size < utf8.UTFMax {
+		size = utf8.UTFMax
+	}
+	var parts []string
+	for len(line) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			//not valid utf8, cut where we have to
+			cut = size
+		}
+		if space := strings.LastIndexByte(line[:cut], ' '); space > 0 {
+			cut = space
+		}
+		parts = append(parts, line[:cut])
+		line = strings.TrimLeft(line[cut:], " ")
+	}
+	return append(parts, line)
+}
+
+//handleLine takes care of the protocol chatter and converts PRIVMSGs that
+//are meant for us into a ChatMessage
+func (i *ircAdapter) handleLine(line ircLine) (ChatMessage, bool) {
+	switch line.command {
+	case "PING":
+		i.send("PONG :%s", line.trailing())
+	case "001":
+		for _, channel := range i.channels {
+			i.send("JOIN %s", channel)
+		}
+	case "433":
+		//nick already in use
+		i.nick = i.nick + "_"
+		i.send("NICK %s", i.nick)
+	case "PRIVMSG":
+		if len(line.params) < 2 {
+			return ChatMessage{}, false
+		}
+		sender := strings.SplitN(line.prefix, "!", 2)[0]
+		if strings.EqualFold(sender, i.nick) {
+			return ChatMessage{}, false
+		}
+		target := line.params[0]
+		msg := ChatMessage{
+			ChannelName: strings.TrimLeft(target, "#&"),
+			Channel:     target,
+			ThreadID:    target,
+			Sender:      sender,
+			Text:        line.trailing(),
+		}
+		if strings.EqualFold(target, i.nick) {
+			//private message, we answer to whoever sent it
+			msg.Channel = sender
+			msg.ChannelName = sender
+			msg.ThreadID = sender
+			msg.Private = true
+		}
+		msg.Text, msg.Mentioned = stripMention(msg.Text, i.nick)
+		return msg, true
+	}
+	return ChatMessage{}, false
+}
+
+func (i *ircAdapter) send(format string, args ...interface{}) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.conn == nil {
+		return fmt.Errorf("not connected to %s", i.server)
+	}
+	_, err := fmt.Fprintf(i.conn, format+"\r\n", args...)
+	return err
+}
+
+//Close says goodbye and closes the connection, when Cortex stops
+func (i *ircAdapter) Close() error {
+	i.send("QUIT :Cortex is stopping")
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.conn == nil {
+		return nil
+	}
+	return i.conn.Close()
+}
+
+//ircLine is a parsed line, :prefix COMMAND param param :trailing
+type ircLine struct {
+	prefix  string
+	command string
+	params  []string
+}
+
+func (l ircLine) trailing() string {
+	if len(l.params) == 0 {
+		return ""
+	}
+	return l.params[len(l.params)-1]
+}
+
+func parseIRCLine(raw string) ircLine {
+	var line ircLine
+	raw = strings.TrimRight(raw, "\r\n")
+	if strings.HasPrefix(raw, ":") {
+		parts := strings.SplitN(raw[1:], " ", 2)
+		line.prefix = parts[0]
+		if len(parts) < 2 {
+			return line
+		}
+		raw = parts[1]
+	}
+	var trailing *string
+	if idx := strings.Index(raw, " :"); idx >= 0 {
+		t := raw[idx+2:]
+		trailing = &t
+		raw = raw[:idx]
+	}
+	fields := strings.Fields(raw)
+	if len(fields) > 0 {
+		line.command = strings.ToUpper(fields[0])
+		line.params = fields[1:]
+	}
+	if trailing != nil {
+		line.params = append(line.params, *trailing)
+	}
+	return line
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+//fakeIRCServer accepts connections and hands each one to the test
+func fakeIRCServer(t *testing.T) (net.Listener, chan net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	conns := make(chan net.Conn)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+	return listener, conns
+}
+
+//expectLine reads from the fake server side until it gets a line with the prefix
+func expectLine(t *testing.T, reader *bufio.Reader, prefix string) string {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Waiting for %q got %v", prefix, err)
+		}
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line)
+		}
+	}
+}
+
+func TestIRCReceiveAndReply(t *testing.T) {
+	listener, conns := fakeIRCServer(t)
+	defer listener.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.IRCServer = listener.Addr().String()
+	config.IRCNick = "cortex"
+	config.IRCChannels = "mission-control"
+	config.IRCUseTLS = false
+
+	i := newIRCAdapter()
+	err := i.Connect()
+	if err != nil {
+		t.Fatalf("Connect gave %v", err)
+	}
+	conn := <-conns
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	server := bufio.NewReader(conn)
+	expectLine(t, server, "NICK cortex")
+	conn.Write([]byte(":irc.local 433 * cortex :Nickname is already in use\r\n"))
+	conn.Write([]byte(":irc.local 001 cortex_ :Welcome\r\n"))
+	conn.Write([]byte("PING :irc.local\r\n"))
+	conn.Write([]byte(":diego!d@host PRIVMSG #mission-control :just chatting\r\n"))
+	conn.Write([]byte(":diego!d@host PRIVMSG #mission-control :cortex_: look at #45\r\n"))
+
+	msg, err := i.Receive()
+	if err != nil {
+		t.Fatalf("Receive gave %v", err)
+	}
+	if msg.Text != "just chatting" || msg.Mentioned {
+		t.Errorf("Receive gave %+v", msg)
+	}
+	msg, _ = i.Receive()
+	if msg.Text != "look at #45" || msg.ChannelName != "mission-control" || msg.Sender != "diego" || !msg.Mentioned {
+		t.Errorf("Receive gave %+v", msg)
+	}
+	expectLine(t, server, "NICK cortex_")
+	expectLine(t, server, "JOIN #mission-control")
+	expectLine(t, server, "PONG :irc.local")
+
+	i.Reply(msg, textReply("just click here: [#45](https://github.com/fmpwizard/go-cortex/issues/45)"))
+	if line := expectLine(t, server, "PRIVMSG"); line != "PRIVMSG #mission-control :diego: just click here: #45 (https://github.com/fmpwizard/go-cortex/issues/45)" {
+		t.Errorf("Reply sent %q", line)
+	}
+
+	conn.Write([]byte(":diego!d@host PRIVMSG cortex_ :turn light 3 on\r\n"))
+	msg, _ = i.Receive()
+	if !msg.Private {
+		t.Errorf("Private message gave %+v", msg)
+	}
+	i.Reply(msg, textReply("done"))
+	if line := expectLine(t, server, "PRIVMSG"); line != "PRIVMSG diego :done" {
+		t.Errorf("Private reply sent %q", line)
+	}
+}
+
+func TestIRCReconnects(t *testing.T) {
+	listener, conns := fakeIRCServer(t)
+	defer listener.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.IRCServer = listener.Addr().String()
+	config.IRCNick = "cortex"
+	config.IRCChannels = ""
+
+	i := newIRCAdapter()
+	i.Connect()
+	first := <-conns
+	first.Close()
+	_, err := i.Receive()
+	if err == nil {
+		t.Fatal("Receive on a dropped connection didn't give an error")
+	}
+
+	err = i.Connect()
+	if err != nil {
+		t.Fatalf("Connect again gave %v", err)
+	}
+	second := <-conns
+	second.Write([]byte(":diego!d@host PRIVMSG cortex :are you back?\r\n"))
+	if msg, _ := i.Receive(); msg.Text != "are you back?" {
+		t.Errorf("Receive after reconnect gave %+v", msg)
+	}
+}
+
+func TestIRCReadTimeout(t *testing.T) {
+	listener, conns := fakeIRCServer(t)
+	defer listener.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.IRCServer = listener.Addr().String()
+	config.IRCNick = "cortex"
+	config.IRCChannels = ""
+	defer func(old time.Duration) { ircReadTimeout = old }(ircReadTimeout)
+	ircReadTimeout = 50 * time.Millisecond
+
+	i := newIRCAdapter()
+	i.Connect()
+	conn := <-conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	server := bufio.NewReader(conn)
+
+	//the server answers our PING, so we wait for the next line
+	received := make(chan error)
+	go func() {
+		_, err := i.Receive()
+		received <- err
+	}()
+	expectLine(t, server, "PING")
+	conn.Write([]byte(":irc.local PONG cortex :irc.local\r\n"))
+	//and then it goes quiet, half open
+	expectLine(t, server, "PING")
+	select {
+	case err := <-received:
+		if err == nil {
+			t.Error("Receive on a quiet connection didn't give an error")
+		}
+	case <-time.After(time.Second):
+		t.Error("Receive is still waiting for a server that doesn't answer")
+	}
+}
+
+func TestIRCReplyLines(t *testing.T) {
+	listener, conns := fakeIRCServer(t)
+	defer listener.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.IRCServer = listener.Addr().String()
+	config.IRCNick = "cortex"
+	config.IRCChannels = ""
+
+	i := newIRCAdapter()
+	i.Connect()
+	conn := <-conns
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	server := bufio.NewReader(conn)
+
+	msg := ChatMessage{ThreadID: "#ops", Sender: "diego"}
+	i.Reply(msg, textReply("Created #7: crash\rQUIT :bye"))
+	if line := expectLine(t, server, "PRIVMSG"); line != "PRIVMSG #ops :diego: Created #7: crash" {
+		t.Errorf("Reply sent %q", line)
+	}
+	if line := expectLine(t, server, "PRIVMSG"); line != "PRIVMSG #ops :diego: QUIT :bye" {
+		t.Errorf("The \r started a new command, %q", line)
+	}
+
+	i.Reply(msg, textReply(strings.Repeat("déjà vu ", 100)))
+	var text []string
+	for len(strings.Join(text, " ")) < len(strings.TrimSpace(strings.Repeat("déjà vu ", 100))) {
+		line := expectLine(t, server, "PRIVMSG")
+		if len(line)+2 > ircMaxLine-ircPrefixRoom {
+			t.Errorf("A line has %d bytes", len(line)+2)
+		}
+		text = append(text, strings.TrimPrefix(line, "PRIVMSG #ops :diego: "))
+	}
+	if strings.Join(text, " ") != strings.TrimSpace(strings.Repeat("déjà vu ", 100)) {
+		t.Errorf("The long reply came out as %q", text)
+	}
+}
+
+func TestSplitIRCLine(t *testing.T) {
+	parts := splitIRCLine("ééé", 5)
+	if len(parts) != 2 || parts[0] != "éé" || parts[1] != "é" {
+		t.Errorf("Got %q", parts)
+	}
+	parts = splitIRCLine("one two three", 8)
+	if len(parts) != 2 || parts[0] != "one two" || parts[1] != "three" {
+		t.Errorf("Got %q", parts)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//jiraIssue is the part of a Jira issue we tell people about
+type jiraIssue struct {
+	Key    string
+	Fields struct {
+		Summary     string
+		Description string
+		Status      struct {
+			Name string
+		}
+		Assignee *struct {
+			DisplayName string
+		}
+		Labels    []string
+		IssueType struct {
+			Name string
+		}
+	}
+}
+
+//jiraTransition is one of the moves the workflow allows for an issue
+type jiraTransition struct {
+	ID   string
+	Name string
+	To   struct {
+		Name           string
+		StatusCategory struct {
+			Key string
+		}
+	}
+}
+
+//jiraTracker is the Tracker for Jira, using version 2 of the rest api, so
+//descriptions and comments are plain text. With a User we use basic auth
+//with the api token, like Jira Cloud wants, otherwise the token is a
+//personal access token.
+type jiraTracker struct {
+	client  trackerClient
+	base    string
+	project string
+}
+
+func newJiraTracker(trackerConfig TrackerConfig) *jiraTracker {
+	base := strings.TrimSuffix(trackerConfig.URL, "/")
+	user := trackerConfig.User
+	token := trackerConfig.Token
+	return &jiraTracker{
+		client: trackerClient{
+			name: "Jira",
+			base: base + "/rest/api/2",
+			auth: func(req *http.Request) {
+				if user != "" {
+					req.SetBasicAuth(user, token)
+				} else if token != "" {
+					req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
+				}
+			},
+		},
+		base:    base,
+		project: trackerConfig.Project,
+	}
+}
+
+//fullKey adds the project key to bare numbers, 123 becomes PROJ-123
+func (j *jiraTracker) fullKey(key string) string {
+	key = strings.TrimPrefix(key, "#")
+	if _, err := issueNumber(key); err == nil && j.project != "" {
+		return j.project + "-" + key
+	}
+	return key
+}
+
+func (j *jiraTracker) issuePath(key string) string {
+	return "/issue/" + url.PathEscape(j.fullKey(key))
+}
+
+func (j *jiraTracker) trackerIssue(issue jiraIssue) trackerIssue {
+	ret := trackerIssue{
+		Key:    issue.Key,
+		Kind:   issue.Fields.IssueType.Name,
+		Title:  issue.Fields.Summary,
+		Body:   issue.Fields.Description,
+		State:  issue.Fields.Status.Name,
+		URL:    j.base + "/browse/" + issue.Key,
+		Labels: issue.Fields.Labels,
+	}
+	if issue.Fields.Assignee != nil {
+		ret.Assignees = []string{issue.Fields.Assignee.DisplayName}
+	}
+	return ret
+}
+
+func (j *jiraTracker) Lookup(key string) (trackerIssue, error) {
+	var issue jiraIssue
+	err := j.client.call("GET", j.issuePath(key)+"?fields=summary,description,status,assignee,labels,issuetype", nil, &issue)
+	return j.trackerIssue(issue), err
+}
+
+//Create makes a Task, unless the issue has a Kind, like Bug
+func (j *jiraTracker) Create(issue trackerIssue) (trackerIssue, error) {
+	if j.project == "" {
+		return trackerIssue{}, fmt.Errorf("Jira trackers need a project key to create issues")
+	}
+	kind := issue.Kind
+	if kind == "" {
+		kind = "Task"
+	}
+	fields := map[string]interface{}{
+		"project":     map[string]string{"key": j.project},
+		"summary":     issue.Title,
+		"description": issue.Body,
+		"issuetype":   map[string]string{"name": kind},
+	}
+	if len(issue.Labels) > 0 {
+		fields["labels"] = issue.Labels
+	}
+	var created struct {
+		Key string
+	}
+	err := j.client.call("POST", "/issue", map[string]interface{}{"fields": fields}, &created)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	issue.Key = created.Key
+	issue.Kind = kind
+	issue.URL = j.base + "/browse/" + created.Key
+	return issue, nil
+}
+
+func (j *jiraTracker) Comment(key, text string) error {
+	return j.client.call("POST", j.issuePath(key)+"/comment", map[string]string{"body": text}, nil)
+}
+
+//Transition looks for a transition, or a status, with the name. For
+//"closed" and "open" any transition into a done or to do status works.
+func (j *jiraTracker) Transition(key, state string) (trackerIssue, error) {
+	var transitions struct {
+		Transitions []jiraTransition
+	}
+	err := j.client.call("GET", j.issuePath(key)+"/transitions", nil, &transitions)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	var found *jiraTransition
+	for i, transition := range transitions.Transitions {
+		if strings.EqualFold(transition.Name, state) || strings.EqualFold(transition.To.Name, state) {
+			found = &transitions.Transitions[i]
+			break
+		}
+	}
+	if found == nil {
+		category := map[string]string{"closed": "done", "open": "new"}[strings.ToLower(state)]
+		for i, transition := range transitions.Transitions {
+			if category != "" && transition.To.StatusCategory.Key == category {
+				found = &transitions.Transitions[i]
+				break
+			}
+		}
+	}
+	if found == nil {
+		return trackerIssue{}, fmt.Errorf("%s can't be moved to %s", j.fullKey(key), state)
+	}
+	payload := map[string]interface{}{"transition": map[string]string{"id": found.ID}}
+	err = j.client.call("POST", j.issuePath(key)+"/transitions", payload, nil)
+	if err != nil {
+		return trackerIssue{}, err
+	}
+	return j.Lookup(key)
+}
+
+//Label adds the labels to the issue, keeping the ones it had
+func (j *jiraTracker) Label(key string, labels ...string) error {
+	var add []map[string]string
+	for _, label := range labels {
+		add = append(add, map[string]string{"add": label})
+	}
+	payload := map[string]interface{}{"update": map[string]interface{}{"labels": add}}
+	return j.client.call("PUT", j.issuePath(key), payload, nil)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//defaultShutdownTimeout is how long we wait for the commands in flight when
+//Cortex stops, set ShutdownTimeout to change it
+const defaultShutdownTimeout = 30 * time.Second
+
+//chatCloser is implemented by adapters that hold a connection open, Close
+//makes a blocked Receive return so listenChat can stop
+type chatCloser interface {
+	Close() error
+}
+
+//commandsMu guards stopping, once Cortex is stopping we don't take new
+//commands, and inFlight has the ones we are still running
+var commandsMu sync.Mutex
+var stopping bool
+var inFlight sync.WaitGroup
+
+//chatListeners are the listenChat goroutines, they stop when the context
+//they got is cancelled
+var chatListeners sync.WaitGroup
+
+//shutdownHooks run after the commands in flight are done and before we
+//switch the lights to their safe state, use them to save what you need
+var shutdownHooks []func()
+
+//beginCommand tells you if Cortex still takes commands, call endCommand
+//when you are done with it
+func beginCommand() bool {
+	commandsMu.Lock()
+	defer commandsMu.Unlock()
+	if stopping {
+		return false
+	}
+	inFlight.Add(1)
+	return true
+}
+
+func endCommand() {
+	inFlight.Done()
+}
+
+func shutdownTimeout() time.Duration {
+	setting := currentConfig().ShutdownTimeout
+	if setting == "" {
+		return defaultShutdownTimeout
+	}
+	timeout, err := time.ParseDuration(setting)
+	if err != nil {
+		mainLog.Warnf("Invalid ShutdownTimeout %s, using %v: %v", setting, defaultShutdownTimeout, err)
+		return defaultShutdownTimeout
+	}
+	return timeout
+}
+
+//waitForShutdown blocks until we get SIGINT or SIGTERM. A second signal
+//stops Cortex right away, for when the clean shutdown gets stuck.
+func waitForShutdown() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	mainLog.Infof("Got %v, shutting down, send it again to stop right away", sig)
+	go func() {
+		<-signals
+		mainLog.Warnf("Stopping without waiting")
+		os.Exit(1)
+	}()
+}
+
+//shutdownCortex stops Cortex in order: no new commands, stop the chats and
+//the http server, wait for the commands in flight, run the shutdownHooks,
+//switch the lights to ShutdownLights and close the serial port
+func shutdownCortex(stopChats context.CancelFunc, server *http.Server) {
+	commandsMu.Lock()
+	stopping = true
+	commandsMu.Unlock()
+
+	timeout := shutdownTimeout()
+	deadline := time.Now().Add(timeout)
+	stopChats()
+	if server != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			mainLog.Errorf("Could not stop the http server cleanly: %v", err)
+		}
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		chatListeners.Wait()
+		inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(time.Until(deadline)):
+		mainLog.Warnf("Commands still running after %v, stopping anyway", timeout)
+	}
+
+	for _, hook := range shutdownHooks {
+		hook()
+	}
+	switchToSafeLights(currentConfig().ShutdownLights)
+	closeArduino()
+	mainLog.Infof("Cortex stopped")
+}
+
+//switchToSafeLights switches the lights as ShutdownLights says, "*" is every
+//light we switched since we started
+func switchToSafeLights(safe map[string]string) {
+	if len(safe) == 0 {
+		return
+	}
+	lights := make(map[int]string)
+	if state, ok := safe["*"]; ok {
+		lightStatesMu.Lock()
+		for light := range lightStates {
+			lights[light] = state
+		}
+		lightStatesMu.Unlock()
+	}
+	for key, state := range safe {
+		light, err := strconv.Atoi(key)
+		if err == nil {
+			lights[light] = state
+		}
+	}
+	var numbers []int
+	for light := range lights {
+		numbers = append(numbers, light)
+	}
+	sort.Ints(numbers)
+	for _, light := range numbers {
+		if lightState(light) == lights[light] {
+			continue
+		}
+		arduinoLog.Infof("Turning light %v %s before stopping", light, lights[light])
+		Arduino(context.Background(), lights[light], light)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+//closingAdapter blocks in Receive until Close
+type closingAdapter struct {
+	closed chan struct{}
+}
+
+func (a *closingAdapter) Name() string {
+	return "closing"
+}
+
+func (a *closingAdapter) Connect() error {
+	return nil
+}
+
+func (a *closingAdapter) Receive() (ChatMessage, error) {
+	<-a.closed
+	return ChatMessage{}, errors.New("closed")
+}
+
+func (a *closingAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	return "", nil
+}
+
+func (a *closingAdapter) Close() error {
+	close(a.closed)
+	return nil
+}
+
+func TestListenChatStops(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		listenChat(ctx, &closingAdapter{closed: make(chan struct{})})
+		close(stopped)
+	}()
+	for !getChatStatuses()["closing"].Connected {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("listenChat didn't stop")
+	}
+	if status := getChatStatuses()["closing"]; status.Connected || status.LastError != "stopped" {
+		t.Errorf("Chat status is %+v", status)
+	}
+}
+
+func TestShutdownCortex(t *testing.T) {
+	defer func() {
+		commandsMu.Lock()
+		stopping = false
+		commandsMu.Unlock()
+	}()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.ShutdownLights = map[string]string{"*": "off", "7": "on"}
+	Arduino(context.Background(), "on", 2)
+	Arduino(context.Background(), "off", 3)
+
+	if !beginCommand() {
+		t.Fatal("beginCommand said no before stopping")
+	}
+	finished := false
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		finished = true
+		endCommand()
+	}()
+	var hooked bool
+	shutdownHooks = []func(){func() { hooked = finished }}
+	defer func() { shutdownHooks = nil }()
+	stoppedChats := false
+	shutdownCortex(func() { stoppedChats = true }, nil)
+
+	if !stoppedChats || !finished || !hooked {
+		t.Errorf("Shutdown didn't wait, chats stopped %v, command finished %v, hooks after it %v", stoppedChats, finished, hooked)
+	}
+	if beginCommand() {
+		t.Error("beginCommand took a command while stopping")
+	}
+	if lightState(2) != "off" || lightState(3) != "off" || lightState(7) != "on" {
+		t.Errorf("Lights are 2 %s, 3 %s and 7 %s", lightState(2), lightState(3), lightState(7))
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//logLevel goes from the chattiest to the most serious, set LogLevel, or
+//LogLevels per subsystem, to pick what Cortex writes
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+func (level logLevel) String() string {
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+	return "info"
+}
+
+//logOutput is where every logger writes, one line per entry
+var logOutput io.Writer = os.Stderr
+var logOutputMu sync.Mutex
+
+//cortexLogger writes leveled, structured lines for one subsystem. Fields
+//go with every line, like the correlation id of the command.
+type cortexLogger struct {
+	subsystem string
+	fields    []logField
+}
+
+type logField struct {
+	key   string
+	value interface{}
+}
+
+//The loggers of each subsystem, their names are what LogLevels uses
+var (
+	mainLog     = newLogger("main")
+	configLog   = newLogger("config")
+	chatLog     = newLogger("chat")
+	flowdockLog = newLogger("flowdock")
+	slackLog    = newLogger("slack")
+	witLog      = newLogger("wit")
+	arduinoLog  = newLogger("arduino")
+	trackerLog  = newLogger("tracker")
+	smsLog      = newLogger("sms")
+	webhookLog  = newLogger("webhook")
+	actionLog   = newLogger("action")
+)
+
+//logSubsystems has the name of every logger, to check LogLevels
+var logSubsystems = make(map[string]bool)
+
+func newLogger(subsystem string) cortexLogger {
+	logSubsystems[subsystem] = true
+	return cortexLogger{subsystem: subsystem}
+}
+
+//with gives you a logger that adds key=value to every line
+func (l cortexLogger) with(key string, value interface{}) cortexLogger {
+	fields := make([]logField, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	l.fields = append(fields, logField{key, value})
+	return l
+}
+
+//withContext adds the correlation id of the command in ctx, if there is one
+func (l cortexLogger) withContext(ctx context.Context) cortexLogger {
+	if id := correlationID(ctx); id != "" {
+		return l.with("cid", id)
+	}
+	return l
+}
+
+func (l cortexLogger) Debugf(format string, args ...interface{}) {
+	l.write(levelDebug, format, args...)
+}
+
+func (l cortexLogger) Infof(format string, args ...interface{}) {
+	l.write(levelInfo, format, args...)
+}
+
+func (l cortexLogger) Warnf(format string, args ...interface{}) {
+	l.write(levelWarn, format, args...)
+}
+
+func (l cortexLogger) Errorf(format string, args ...interface{}) {
+	l.write(levelError, format, args...)
+}
+
+//Fatalf logs the error and stops Cortex
+func (l cortexLogger) Fatalf(format string, args ...interface{}) {
+	l.write(levelError, format, args...)
+	os.Exit(1)
+}
+
+//enabled tells you if the subsystem writes lines of this level
+func (l cortexLogger) enabled(level logLevel) bool {
+	c := currentConfig()
+	setting := c.LogLevels[l.subsystem]
+	if setting == "" {
+		setting = c.LogLevel
+	}
+	minimum, ok := logLevelNames[strings.ToLower(setting)]
+	if !ok {
+		minimum = levelInfo
+	}
+	return level >= minimum
+}
+
+func (l cortexLogger) write(level logLevel, format string, args ...interface{}) {
+	msg := strings.TrimSpace(fmt.Sprintf(format, args...))
+	if level == levelError {
+		l.publishError(msg)
+	}
+	if !l.enabled(level) {
+		return
+	}
+	fields := append([]logField{
+		{"time", time.Now().UTC().Format(time.RFC3339Nano)},
+		{"level", level.String()},
+		{"subsystem", l.subsystem},
+		{"msg", msg},
+	}, l.fields...)
+	var line []byte
+	if strings.ToLower(currentConfig().LogFormat) == "json" {
+		line = formatJSON(fields)
+	} else {
+		line = formatLogfmt(fields)
+	}
+	logOutputMu.Lock()
+	defer logOutputMu.Unlock()
+	logOutput.Write(line)
+}
+
+//publishError sends every error we log to the event bus, with the
+//correlation id of the command when there is one
+func (l cortexLogger) publishError(msg string) {
+	ctx := context.Background()
+	for _, field := range l.fields {
+		if field.key == "cid" {
+			ctx = withCorrelationID(ctx, fmt.Sprint(field.value))
+		}
+	}
+	events.publish(ctx, eventError, errorEvent{Subsystem: l.subsystem, Message: msg})
+}
+
+//formatLogfmt writes key=value pairs, quoting the values that need it
+func formatLogfmt(fields []logField) []byte {
+	var buf bytes.Buffer
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		value := fmt.Sprint(field.value)
+		buf.WriteString(field.key)
+		buf.WriteByte('=')
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = fmt.Sprintf("%q", value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+//formatJSON writes the fields in order, as one json object
+func formatJSON(fields []logField) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.key)
+		value, err := json.Marshal(field.value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(field.value))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+//stdLogWriter sends what other packages write with the log package, like
+//the http server, through our logger
+type stdLogWriter struct {
+	logger cortexLogger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	w.logger.Infof("%s", p)
+	return len(p), nil
+}
+
+type correlationKey struct{}
+
+//newCorrelationID gives every command an id, so you can find all the lines
+//about it, from the chat message to the reply
+func newCorrelationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func withCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+func correlationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+//requestContext gives an http command its correlation id, the one in
+//X-Request-ID when the caller sent one, and tells the caller which it is
+func requestContext(w http.ResponseWriter, r *http.Request) context.Context {
+	id := r.Header.Get("X-Request-ID")
+	if id == "" {
+		id = newCorrelationID()
+	}
+	w.Header().Set("X-Request-ID", id)
+	return withCorrelationID(r.Context(), id)
+}
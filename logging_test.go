@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+//captureLogs sends the log lines to a buffer until you call the function
+//it gives you
+func captureLogs() (*bytes.Buffer, func()) {
+	var buf bytes.Buffer
+	logOutputMu.Lock()
+	old := logOutput
+	logOutput = &buf
+	logOutputMu.Unlock()
+	return &buf, func() {
+		logOutputMu.Lock()
+		logOutput = old
+		logOutputMu.Unlock()
+	}
+}
+
+func TestLogfmt(t *testing.T) {
+	line := string(formatLogfmt([]logField{{"level", "info"}, {"msg", `Lost connection: "reset"`}, {"light", 3}, {"cid", ""}}))
+	if line != `level=info msg="Lost connection: \"reset\"" light=3 cid=""`+"\n" {
+		t.Errorf("formatLogfmt gave %s", line)
+	}
+}
+
+func TestLogLevelsAndJSON(t *testing.T) {
+	buf, restore := captureLogs()
+	defer restore()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.LogFormat = "json"
+	config.LogLevel = "warn"
+	config.LogLevels = map[string]string{"wit": "debug"}
+
+	chatLog.Infof("not written")
+	chatLog.with("adapter", "irc").Warnf("Lost connection to %s", "irc")
+	witLog.Debugf("Wit understood %q", "turn light 3 on")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Got lines\n%s", buf.String())
+	}
+	var entry map[string]interface{}
+	err := json.Unmarshal([]byte(lines[0]), &entry)
+	if err != nil || entry["level"] != "warn" || entry["subsystem"] != "chat" || entry["adapter"] != "irc" || entry["msg"] != "Lost connection to irc" {
+		t.Errorf("First line is %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `"subsystem":"wit"`) || !strings.Contains(lines[1], `"level":"debug"`) {
+		t.Errorf("Second line is %s", lines[1])
+	}
+}
+
+func TestCorrelationIDFollowsTheCommand(t *testing.T) {
+	wit := fakeWitLights()
+	defer wit.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+	config.LogLevel = "debug"
+	buf, restore := captureLogs()
+	defer restore()
+
+	handleChatMessage(&fakeAdapter{}, ChatMessage{ID: "1", ThreadID: "1", Channel: "C1", Text: "turn light 6 on"})
+	restore()
+
+	cids := make(map[string]bool)
+	subsystems := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := strings.Fields(line)
+		for _, field := range fields {
+			if strings.HasPrefix(field, "cid=") {
+				cids[field] = true
+			}
+			if strings.HasPrefix(field, "subsystem=") {
+				subsystems[field] = true
+			}
+		}
+		if !strings.Contains(line, " cid=") {
+			t.Errorf("No correlation id in %s", line)
+		}
+	}
+	if len(cids) != 1 {
+		t.Errorf("The command had correlation ids %v", cids)
+	}
+	for _, subsystem := range []string{"chat", "wit", "arduino"} {
+		if !subsystems["subsystem="+subsystem] {
+			t.Errorf("No lines from %s in\n%s", subsystem, buf.String())
+		}
+	}
+}
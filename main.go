@@ -2,57 +2,145 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 )
 
 var configFile string
+var printConfig bool
 var config CortexConfig
 
 func init() {
-	flag.StringVar(&configFile, "config", "", "path to cortex.config.json file.")
+	flag.StringVar(&configFile, "config", "", "path to cortex.config.json file, it can also be yaml or toml.")
+	flag.BoolVar(&printConfig, "print-config", false, "print the configuration Cortex would use, without secrets, and exit.")
 }
 
 func main() {
 	flag.Parse()
+	//anything else that uses the log package goes through our logger too
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{mainLog})
 	readCortexConfig()
+	if printConfig {
+		text, _ := json.MarshalIndent(redactedConfig(config), "", "  ")
+		fmt.Println(string(text))
+		return
+	}
+	go watchCortexConfig()
+	//the config can reload from now on
+	current := currentConfig()
+
+	if s != nil {
+		go watchSensors(s)
+	}
+	startWebhooks(current.Webhooks)
+	configReloaders = append(configReloaders, reloadWebhooks)
+	shutdownHooks = append(shutdownHooks, stopWebhooks)
 
-	if config.FlowdockAccessToken != "" {
+	ctx, stopChats := context.WithCancel(context.Background())
+	startChat := func(adapter ChatAdapter) {
+		chatListeners.Add(1)
 		go func() {
-			listenStream()
+			defer chatListeners.Done()
+			listenChat(ctx, adapter)
 		}()
-
 	}
-	if config.HttpPort != "" {
-		http.HandleFunc("/wit", WitHandler)
-		http.HandleFunc("/sms", NexmoHandler)
-		http.ListenAndServe(fmt.Sprintf(":%v", config.HttpPort), nil)
+	if current.FlowdockAccessToken != "" {
+		flowdock := &flowdockAdapter{}
+		configReloaders = append(configReloaders, flowdock.reloadConfig)
+		startChat(flowdock)
 	}
-
-}
-
-func readCortexConfig() {
-	configBytes, error := ioutil.ReadFile(configFile)
-	if error != nil {
-		log.Fatalf("Could not read config file, error: %+v", error)
+	mux := http.NewServeMux()
+	if current.SlackBotToken != "" {
+		slack := newSlackAdapter()
+		mux.HandleFunc("/slack/events", slack.EventsHandler)
+		startChat(slack)
+	}
+	if current.MatrixHomeserverURL != "" {
+		startChat(newMatrixAdapter())
 	}
-	error = json.Unmarshal(configBytes, &config)
-	if error != nil {
-		log.Fatalf("Could not parse json file, got: %+v", error)
+	if current.IRCServer != "" {
+		startChat(newIRCAdapter())
 	}
-	log.Printf("Using configuration: %+v", config)
+	var server *http.Server
+	if current.HttpPort != "" {
+		mux.HandleFunc("/wit", WitHandler)
+		mux.HandleFunc("/sms", NexmoHandler)
+		mux.HandleFunc("/healthz", HealthzHandler)
+		mux.HandleFunc("/readyz", ReadyzHandler)
+		mux.HandleFunc("/metrics", MetricsHandler)
+		mux.HandleFunc("/dashboard", DashboardHandler)
+		mux.HandleFunc("/dashboard/", DashboardHandler)
+		mux.HandleFunc("/events", EventsHandler)
+		mux.HandleFunc("/webhooks", WebhooksHandler)
+		mux.HandleFunc("/webhooks/", WebhooksHandler)
+		var err error
+		server, err = newHTTPServer(current, mux)
+		if err != nil {
+			mainLog.Fatalf("Could not start the http server: %v", err)
+		}
+		server.RegisterOnShutdown(stopEventStreams)
+		go serveHTTP(server)
+	}
+
+	waitForShutdown()
+	shutdownCortex(stopChats, server)
 }
 
 //CortexConfig hold the configuration for Cortex to work.
 type CortexConfig struct {
-	HttpPort            string
-	CortexEmail         string
-	FlowdockAccessToken string
-	WitAccessToken      string
-	Flows               string
-	FlowsTicketsUrls    []map[string]string
+	HttpPort              string
+	HttpBindAddress       string
+	HttpPathPrefix        string
+	HttpReadTimeout       string
+	HttpWriteTimeout      string
+	HttpIdleTimeout       string
+	HttpMaxBodyBytes      int64
+	TrustedProxies        []string
+	TLSCertFile           string
+	TLSKeyFile            string
+	CortexEmail           string
+	FlowdockAccessToken   string `cortex:"secret"`
+	FlowdockAPIURL        string
+	FlowdockStreamURL     string
+	WitAccessToken        string `cortex:"secret"`
+	WitAPIURL             string
+	Flows                 string
+	FlowsTicketsUrls      []map[string]string
+	Trackers              map[string]TrackerConfig
+	UnitDecimals          *int
+	ConversationTimeout   string
+	Activation            map[string]string
+	CommandPrefix         string
+	WelcomeMessage        string
+	SlackBotToken         string `cortex:"secret"`
+	SlackSigningSecret    string `cortex:"secret"`
+	SlackChannels         string
+	SlackAPIURL           string
+	MatrixHomeserverURL   string
+	MatrixAccessToken     string `cortex:"secret"`
+	MatrixUserID          string
+	MatrixRooms           string
+	IRCServer             string
+	IRCNick               string
+	IRCPassword           string `cortex:"secret"`
+	IRCChannels           string
+	IRCUseTLS             bool
+	GithubAPIURL          string
+	GithubToken           string `cortex:"secret"`
+	GithubAllowedUsers    []string
+	ShutdownTimeout       string
+	ShutdownLights        map[string]string
+	LogFormat             string
+	LogLevel              string
+	LogLevels             map[string]string
+	Lights                map[string]string
+	DashboardPassword     string `cortex:"secret"`
+	Webhooks              map[string]WebhookConfig
+	Actions               map[string]ActionConfig
+	WebhookDeadLetterFile string
 }
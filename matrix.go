@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//matrixAdapter talks to a Matrix homeserver using the client-server api.
+//Receive long polls /sync and Reply sends an m.thread relation so answers
+//show up in the thread of the original message.
+type matrixAdapter struct {
+	homeserver string
+	token      string
+	userID     string
+	rooms      map[string]string
+	since      string
+	pending    []ChatMessage
+	txnID      int64
+	client     *http.Client
+	//ctx is cancelled by Close, it stops the long running sync
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newMatrixAdapter() *matrixAdapter {
+	c := currentConfig()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &matrixAdapter{
+		homeserver: strings.TrimSuffix(c.MatrixHomeserverURL, "/"),
+		token:      c.MatrixAccessToken,
+		userID:     c.MatrixUserID,
+		rooms:      make(map[string]string),
+		client:     &http.Client{Timeout: 90 * time.Second},
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+func (m *matrixAdapter) Name() string {
+	return "matrix"
+}
+
+//Connect finds out who we are, resolves the room aliases we listen to and
+//does a first sync so we don't answer old messages. When we reconnect we
+//keep the sync token, so nothing sent while we were away gets lost.
+func (m *matrixAdapter) Connect() error {
+	if m.userID == "" {
+		var whoami struct {
+			UserID string `json:"user_id"`
+		}
+		err := m.call("GET", "/account/whoami", nil, &whoami)
+		if err != nil {
+			return err
+		}
+		m.userID = whoami.UserID
+	}
+	for _, room := range strings.Split(currentConfig().MatrixRooms, ",") {
+		room = strings.TrimSpace(room)
+		if room == "" {
+			continue
+		}
+		roomID := room
+		if strings.HasPrefix(room, "#") {
+			var directory struct {
+				RoomID string `json:"room_id"`
+			}
+			err := m.call("GET", "/directory/room/"+url.PathEscape(room), nil, &directory)
+			if err != nil {
+				return err
+			}
+			roomID = directory.RoomID
+		}
+		m.rooms[roomID] = strings.Split(strings.TrimPrefix(room, "#"), ":")[0]
+	}
+	if m.since != "" {
+		return nil
+	}
+	_, err := m.sync(0)
+	return err
+}
+
+//Receive blocks until one of the rooms we listen to gets a new text message
+func (m *matrixAdapter) Receive() (ChatMessage, error) {
+	for len(m.pending) == 0 {
+		messages, err := m.sync(30 * time.Second)
+		if err != nil {
+			return ChatMessage{}, err
+		}
+		m.pending = messages
+	}
+	msg := m.pending[0]
+	m.pending = m.pending[1:]
+	return msg, nil
+}
+
+//Close stops the requests to the homeserver, when Cortex stops
+func (m *matrixAdapter) Close() error {
+	m.cancel()
+	return nil
+}
+
+//Reply sends the text as part of the thread of the original message, with
+//a plain text body and an html formatted_body
+func (m *matrixAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	content := map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           renderPlain(reply.Text),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": renderHTML(reply.Text),
+		"m.relates_to": map[string]interface{}{
+			"rel_type":        "m.thread",
+			"event_id":        msg.ThreadID,
+			"is_falling_back": true,
+			"m.in_reply_to":   map[string]string{"event_id": msg.ID},
+		},
+	}
+	txnID := fmt.Sprintf("cortex%d.%d", time.Now().UnixNano(), atomic.AddInt64(&m.txnID, 1))
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(msg.Channel), txnID)
+	var sent struct {
+		EventID string `json:"event_id"`
+	}
+	err := m.call("PUT", path, content, &sent)
+	if err != nil {
+		return "", err
+	}
+	return sent.EventID, nil
+}
+
+//EditReply replaces a reply we sent before with an m.replace relation
+func (m *matrixAdapter) EditReply(msg ChatMessage, replyID string, reply ChatReply) error {
+	newContent := map[string]interface{}{
+		"msgtype":        "m.text",
+		"body":           renderPlain(reply.Text),
+		"format":         "org.matrix.custom.html",
+		"formatted_body": renderHTML(reply.Text),
+	}
+	content := map[string]interface{}{
+		"msgtype":       "m.text",
+		"body":          "* " + renderPlain(reply.Text),
+		"m.new_content": newContent,
+		"m.relates_to": map[string]interface{}{
+			"rel_type": "m.replace",
+			"event_id": replyID,
+		},
+	}
+	txnID := fmt.Sprintf("cortex%d.%d", time.Now().UnixNano(), atomic.AddInt64(&m.txnID, 1))
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(msg.Channel), txnID)
+	var sent struct {
+		EventID string `json:"event_id"`
+	}
+	return m.call("PUT", path, content, &sent)
+}
+
+//sync gets everything that happened since the last call, waiting up to
+//timeout for something new
+func (m *matrixAdapter) sync(timeout time.Duration) ([]ChatMessage, error) {
+	query := url.Values{"timeout": {fmt.Sprintf("%d", timeout/time.Millisecond)}}
+	if m.since != "" {
+		query.Set("since", m.since)
+	}
+	var res matrixSync
+	err := m.call("GET", "/sync?"+query.Encode(), nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	first := m.since == ""
+	m.since = res.NextBatch
+	if first {
+		return nil, nil
+	}
+	var messages []ChatMessage
+	for roomID, room := range res.Rooms.Join {
+		name, ok := m.rooms[roomID]
+		if len(m.rooms) > 0 && !ok {
+			continue
+		}
+		if name == "" {
+			name = roomID
+		}
+		for _, event := range room.Timeline.Events {
+			msg, ok := m.toChatMessage(roomID, name, event)
+			if ok {
+				messages = append(messages, msg)
+			}
+		}
+	}
+	return messages, nil
+}
+
+func (m *matrixAdapter) toChatMessage(roomID, roomName string, event matrixEvent) (ChatMessage, bool) {
+	if event.Type != "m.room.message" || event.Sender == m.userID {
+		return ChatMessage{}, false
+	}
+	if event.Content.MsgType != "m.text" {
+		return ChatMessage{}, false
+	}
+	msg := ChatMessage{
+		ID:          event.EventID,
+		ThreadID:    event.EventID,
+		Channel:     roomID,
+		ChannelName: roomName,
+		Sender:      event.Sender,
+		URL:         "https://matrix.to/#/" + roomID + "/" + event.EventID,
+	}
+	body := event.Content.Body
+	if event.Content.RelatesTo.RelType == "m.replace" {
+		msg.ID = event.Content.RelatesTo.EventID
+		msg.ThreadID = msg.ID
+		msg.Edited = true
+		body = event.Content.NewContent.Body
+	}
+	localpart := strings.Split(strings.TrimPrefix(m.userID, "@"), ":")[0]
+	msg.Text, msg.Mentioned = stripMention(body, m.userID, localpart)
+	for _, userID := range event.Content.Mentions.UserIDs {
+		if userID == m.userID {
+			msg.Mentioned = true
+		}
+	}
+	if event.Content.RelatesTo.RelType == "m.thread" {
+		msg.ThreadID = event.Content.RelatesTo.EventID
+	}
+	return msg, true
+}
+
+//call sends a request to the client-server api and decodes the json answer
+func (m *matrixAdapter) call(method, path string, payload interface{}, result interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	req, _ := http.NewRequest(method, m.homeserver+"/_matrix/client/v3"+path, bytes.NewReader(body))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", m.token))
+	req.Header.Add("Content-type", "application/json")
+	res, err := m.client.Do(req.WithContext(m.ctx))
+	if err != nil {
+		return fmt.Errorf("Error calling Matrix %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		var matrixErr struct {
+			Errcode string
+			Error   string
+		}
+		json.NewDecoder(res.Body).Decode(&matrixErr)
+		return fmt.Errorf("Matrix %s gave status code %+v: %s %s", path, res.StatusCode, matrixErr.Errcode, matrixErr.Error)
+	}
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("Could not parse Matrix %s response, got: %v", path, err)
+	}
+	return nil
+}
+
+//matrixSync is the part of the /sync response we care about
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []matrixEvent
+			}
+		}
+	}
+}
+
+//matrixEvent is a room event, we only look at text messages
+type matrixEvent struct {
+	Type    string
+	Sender  string
+	EventID string `json:"event_id"`
+	Content struct {
+		MsgType   string
+		Body      string
+		RelatesTo struct {
+			RelType string `json:"rel_type"`
+			EventID string `json:"event_id"`
+		} `json:"m.relates_to"`
+		Mentions struct {
+			UserIDs []string `json:"user_ids"`
+		} `json:"m.mentions"`
+		NewContent struct {
+			Body string
+		} `json:"m.new_content"`
+	}
+}
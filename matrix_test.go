@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func fakeHomeserver(t *testing.T, sent chan map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer matrix-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"errcode": "M_UNKNOWN_TOKEN", "error": "bad token"}`))
+			return
+		}
+		switch {
+		case r.URL.Path == "/_matrix/client/v3/account/whoami":
+			w.Write([]byte(`{"user_id": "@cortex:example.org"}`))
+		case r.URL.Path == "/_matrix/client/v3/directory/room/#mission-control:example.org":
+			w.Write([]byte(`{"room_id": "!mc:example.org"}`))
+		case r.URL.Path == "/_matrix/client/v3/sync" && r.URL.Query().Get("since") == "":
+			w.Write([]byte(`{"next_batch": "s1", "rooms": {"join": {"!mc:example.org": {"timeline": {"events": [
+				{"type": "m.room.message", "sender": "@diego:example.org", "event_id": "$old", "content": {"msgtype": "m.text", "body": "old message"}}
+			]}}}}}`))
+		case r.URL.Path == "/_matrix/client/v3/sync" && r.URL.Query().Get("since") == "s1":
+			w.Write([]byte(`{"next_batch": "s2", "rooms": {"join": {
+				"!other:example.org": {"timeline": {"events": [
+					{"type": "m.room.message", "sender": "@diego:example.org", "event_id": "$3", "content": {"msgtype": "m.text", "body": "wrong room"}}
+				]}},
+				"!mc:example.org": {"timeline": {"events": [
+					{"type": "m.room.message", "sender": "@cortex:example.org", "event_id": "$1", "content": {"msgtype": "m.text", "body": "my own"}},
+					{"type": "m.room.message", "sender": "@diego:example.org", "event_id": "$2", "content": {"msgtype": "m.text", "body": "look at #45",
+						"m.relates_to": {"rel_type": "m.thread", "event_id": "$root"}}}
+				]}}
+			}}}`))
+		case strings.HasPrefix(r.URL.Path, "/_matrix/client/v3/rooms/!mc:example.org/send/m.room.message/"):
+			body, _ := ioutil.ReadAll(r.Body)
+			var content map[string]interface{}
+			json.Unmarshal(body, &content)
+			sent <- content
+			w.Write([]byte(`{"event_id": "$reply"}`))
+		default:
+			t.Errorf("Unexpected Matrix call %v %v", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errcode": "M_NOT_FOUND"}`))
+		}
+	}))
+}
+
+func TestMatrixReceiveAndReply(t *testing.T) {
+	sent := make(chan map[string]interface{}, 1)
+	server := fakeHomeserver(t, sent)
+	defer server.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.MatrixHomeserverURL = server.URL
+	config.MatrixAccessToken = "matrix-token"
+	config.MatrixUserID = ""
+	config.MatrixRooms = "#mission-control:example.org"
+
+	m := newMatrixAdapter()
+	err := m.Connect()
+	if err != nil {
+		t.Fatalf("Connect gave %v", err)
+	}
+	msg, err := m.Receive()
+	if err != nil {
+		t.Fatalf("Receive gave %v", err)
+	}
+	if msg.Text != "look at #45" || msg.ThreadID != "$root" || msg.ChannelName != "mission-control" {
+		t.Errorf("Receive gave %+v", msg)
+	}
+	if len(m.pending) != 0 {
+		t.Errorf("Expected one message, got %+v more", m.pending)
+	}
+
+	id, err := m.Reply(msg, textReply("just click here: [#45](https://github.com/fmpwizard/go-cortex/issues/45)"))
+	if err != nil || id != "$reply" {
+		t.Errorf("Reply gave %v, %v", id, err)
+	}
+	content := <-sent
+	relation := content["m.relates_to"].(map[string]interface{})
+	if content["body"] != "just click here: #45 (https://github.com/fmpwizard/go-cortex/issues/45)" ||
+		content["formatted_body"] != `just click here: <a href="https://github.com/fmpwizard/go-cortex/issues/45">#45</a>` ||
+		relation["rel_type"] != "m.thread" || relation["event_id"] != "$root" {
+		t.Errorf("Reply sent %+v", content)
+	}
+}
+
+func TestMatrixBadToken(t *testing.T) {
+	server := fakeHomeserver(t, nil)
+	defer server.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.MatrixHomeserverURL = server.URL
+	config.MatrixAccessToken = "wrong"
+	err := newMatrixAdapter().Connect()
+	if err == nil || !strings.Contains(err.Error(), "M_UNKNOWN_TOKEN") {
+		t.Errorf("Connect with a bad token gave %v", err)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The metrics Cortex exports on /metrics, in the Prometheus text format.
+//Channel is the chat adapter the command came from, or http and sms.
+var (
+	commandsTotal = newCounterVec("cortex_commands_total",
+		"Commands Cortex got, by channel and intent.", "channel", "intent")
+	nluDuration = newHistogramVec("cortex_nlu_request_duration_seconds",
+		"How long Wit took to answer, by endpoint.", nluBuckets, "endpoint")
+	nluErrors = newCounterVec("cortex_nlu_errors_total",
+		"Requests to Wit that failed, by endpoint.", "endpoint")
+	serialWrites = newCounterVec("cortex_serial_writes_total",
+		"Commands sent to the Arduino, by result.", "result")
+	eventsDropped = newCounterVec("cortex_events_dropped_total",
+		"Events a subscriber was too slow to get, by type.", "type")
+	webhookDeliveries = newCounterVec("cortex_webhook_deliveries_total",
+		"Attempts to deliver events to webhooks, by webhook and result.", "webhook", "result")
+)
+
+var nluBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//counterVec is a counter with labels, each set of label values is its own
+//series
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+//inc adds one to the series, labelValues go in the order of the labels
+func (c *counterVec) inc(labelValues ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[metricLabels(c.labels, labelValues)]++
+}
+
+func (c *counterVec) get(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[metricLabels(c.labels, labelValues)]
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, labels := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labels, c.values[labels])
+	}
+}
+
+//histogramVec counts observations in buckets, Prometheus style, where each
+//bucket also counts everything below it
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\x00")
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = series
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			series.counts[i]++
+		}
+	}
+	series.count++
+	series.sum += value
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		series := h.series[key]
+		values := strings.Split(key, "\x00")
+		labels := append(append([]string{}, h.labels...), "le")
+		bucket := func(le string) string {
+			return metricLabels(labels, append(append([]string{}, values...), le))
+		}
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket(fmt.Sprintf("%v", bound)), series.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, bucket("+Inf"), series.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, metricLabels(h.labels, values), series.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, metricLabels(h.labels, values), series.count)
+	}
+}
+
+//metricLabels formats the labels the way Prometheus wants them, {a="1",b="2"}
+func metricLabels(labels, values []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for i, label := range labels {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//countCommand records a command and the intent Wit found, err is the error
+//FetchIntent gave us
+func countCommand(channel string, intent WitMessage, err error) {
+	name := intent.Outcome.Intent
+	if err != nil {
+		name = "error"
+	} else if name == "" {
+		name = "none"
+	}
+	commandsTotal.inc(channel, name)
+}
+
+//timeNLU records how long a request to Wit took, and if it failed, which
+//is also what /readyz goes by
+func timeNLU(endpoint string, start time.Time, err error) {
+	nluDuration.observe(time.Since(start).Seconds(), endpoint)
+	if err != nil {
+		nluErrors.inc(endpoint)
+	}
+	setNLUHealth(err)
+}
+
+//MetricsHandler serves every metric, the chat ones come from the status of
+//the adapters
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	commandsTotal.write(w)
+	nluDuration.write(w)
+	nluErrors.write(w)
+	serialWrites.write(w)
+	eventsDropped.write(w)
+	webhookDeliveries.write(w)
+
+	statuses := getChatStatuses()
+	names := make([]string, 0, len(statuses))
+	for name := range statuses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprint(w, "# HELP cortex_chat_connected Whether Cortex is connected to the chat, by adapter.\n# TYPE cortex_chat_connected gauge\n")
+	for _, name := range names {
+		connected := 0
+		if statuses[name].Connected {
+			connected = 1
+		}
+		fmt.Fprintf(w, "cortex_chat_connected%s %d\n", metricLabels([]string{"adapter"}, []string{name}), connected)
+	}
+	fmt.Fprint(w, "# HELP cortex_chat_reconnects_total Times Cortex connected to the chat again after losing the connection, by adapter.\n# TYPE cortex_chat_reconnects_total counter\n")
+	for _, name := range names {
+		fmt.Fprintf(w, "cortex_chat_reconnects_total%s %d\n", metricLabels([]string{"adapter"}, []string{name}), statuses[name].Reconnects)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	counter := newCounterVec("cortex_test_total", "Test counter.", "channel", "intent")
+	counter.inc("slack", "lights")
+	counter.inc("slack", "lights")
+	counter.inc("irc", `say "hi"`)
+	var out strings.Builder
+	counter.write(&out)
+	expected := `# HELP cortex_test_total Test counter.
+# TYPE cortex_test_total counter
+cortex_test_total{channel="irc",intent="say \"hi\""} 1
+cortex_test_total{channel="slack",intent="lights"} 2
+`
+	if out.String() != expected {
+		t.Errorf("counterVec wrote\n%s", out.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	histogram := newHistogramVec("cortex_test_seconds", "Test histogram.", []float64{0.1, 1}, "endpoint")
+	histogram.observe(0.05, "message")
+	histogram.observe(0.5, "message")
+	histogram.observe(3, "message")
+	var out strings.Builder
+	histogram.write(&out)
+	expected := `# HELP cortex_test_seconds Test histogram.
+# TYPE cortex_test_seconds histogram
+cortex_test_seconds_bucket{endpoint="message",le="0.1"} 1
+cortex_test_seconds_bucket{endpoint="message",le="1"} 2
+cortex_test_seconds_bucket{endpoint="message",le="+Inf"} 3
+cortex_test_seconds_sum{endpoint="message"} 3.55
+cortex_test_seconds_count{endpoint="message"} 3
+`
+	if out.String() != expected {
+		t.Errorf("histogramVec wrote\n%s", out.String())
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	before := commandsTotal.get("metrics-test", "error")
+	countCommand("metrics-test", WitMessage{}, errors.New("Wit is down"))
+	if commandsTotal.get("metrics-test", "error") != before+1 {
+		t.Error("countCommand didn't count the error")
+	}
+	setChatStatus("metrics-test", nil)
+	rec := httptest.NewRecorder()
+	MetricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`cortex_commands_total{channel="metrics-test",intent="error"} 1`,
+		"# TYPE cortex_nlu_request_duration_seconds histogram",
+		`cortex_chat_connected{adapter="metrics-test"} 1`,
+		`cortex_chat_reconnects_total{adapter="metrics-test"} 0`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("/metrics doesn't have %s, got\n%s", line, body)
+		}
+	}
+}
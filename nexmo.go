@@ -1,7 +1,6 @@
 package main
 
 import (
-	"log"
 	"net/http"
 )
 
@@ -16,18 +15,24 @@ func NexmoHandler(w http.ResponseWriter, r *http.Request) {
 	text := r.FormValue("text")
 	typ := r.FormValue("type")
 	timestamp := r.FormValue("message-timestamp=")
+	if !beginCommand() {
+		http.Error(w, "Cortex is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	defer endCommand()
+	ctx := requestContext(w, r)
+	logger := smsLog.withContext(ctx).with("messageID", messageID).with("client", r.RemoteAddr)
 	if len(text) > 0 && typ == "text" {
-		intent, err := FetchIntent(text)
+		_, ret, err := runCommand(ctx, "sms", r.FormValue("msisdn"), text)
 		if err != nil {
-			log.Printf("Error: %+v", err)
+			logger.Errorf("Error: %+v", err)
 		} else {
-			ret := ProcessIntent(intent)
-			log.Printf("We got messageID: %v on %v ", messageID, timestamp)
-			log.Printf("Wit gave us: %+v ", ret)
+			logger.Infof("We got messageID: %v on %v", messageID, timestamp)
+			logger.Debugf("Wit gave us: %+v", ret)
 		}
 
 	} else {
-		log.Print("Error: we got a blank text message")
+		logger.Warnf("Error: we got a blank text message")
 	}
 	w.WriteHeader(http.StatusOK)
 }
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//The limits of the http server, the timeouts can be changed with
+//HttpReadTimeout, HttpWriteTimeout and HttpIdleTimeout, and the size of the
+//body with HttpMaxBodyBytes
+const (
+	defaultHTTPReadTimeout  = 10 * time.Second
+	defaultHTTPWriteTimeout = 30 * time.Second
+	defaultHTTPIdleTimeout  = 2 * time.Minute
+	defaultHTTPMaxBodyBytes = 1 << 20
+	httpMaxHeaderBytes      = 64 << 10
+)
+
+//certCheckInterval is how often we look at the certificate files for changes
+var certCheckInterval = configPollInterval
+
+//newHTTPServer gives you the server for httpPort, with our timeouts, TLS when
+//there is a certificate, and the handler behind HttpPathPrefix
+func newHTTPServer(c CortexConfig, mux http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:           net.JoinHostPort(c.HttpBindAddress, c.HttpPort),
+		Handler:        httpHandler(strings.TrimSuffix(c.HttpPathPrefix, "/"), mux),
+		ReadTimeout:    httpTimeout("HttpReadTimeout", c.HttpReadTimeout, defaultHTTPReadTimeout),
+		WriteTimeout:   httpTimeout("HttpWriteTimeout", c.HttpWriteTimeout, defaultHTTPWriteTimeout),
+		IdleTimeout:    httpTimeout("HttpIdleTimeout", c.HttpIdleTimeout, defaultHTTPIdleTimeout),
+		MaxHeaderBytes: httpMaxHeaderBytes,
+	}
+	if c.TLSCertFile != "" {
+		certs, err := newCertReloader(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{GetCertificate: certs.GetCertificate, MinVersion: tls.VersionTLS12}
+	}
+	return server, nil
+}
+
+//serveHTTP runs the server until shutdownCortex stops it
+func serveHTTP(server *http.Server) {
+	var err error
+	if server.TLSConfig != nil {
+		mainLog.Infof("Listening on https://%s", server.Addr)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		mainLog.Infof("Listening on http://%s", server.Addr)
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		mainLog.Fatalf("Could not start the http server: %v", err)
+	}
+}
+
+func httpTimeout(name, setting string, fallback time.Duration) time.Duration {
+	if setting == "" {
+		return fallback
+	}
+	timeout, err := time.ParseDuration(setting)
+	if err != nil {
+		mainLog.Warnf("Invalid %s %s, using %v: %v", name, setting, fallback, err)
+		return fallback
+	}
+	return timeout
+}
+
+//httpHandler limits the size of the requests, finds out who sent them when
+//they come through a proxy we trust, and strips the path prefix nginx leaves
+//in the url
+func httpHandler(prefix string, mux http.Handler) http.Handler {
+	if prefix != "" {
+		mux = http.StripPrefix(prefix, mux)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := currentConfig()
+		limit := c.HttpMaxBodyBytes
+		if limit == 0 {
+			limit = defaultHTTPMaxBodyBytes
+		}
+		if r.ContentLength > limit {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		trusted, _ := parseTrustedProxies(c.TrustedProxies)
+		r.RemoteAddr = clientIP(r, trusted)
+		mainLog.Debugf("%s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		mux.ServeHTTP(w, r)
+	})
+}
+
+//parseTrustedProxies reads TrustedProxies, each one is an ip or a range like
+//10.0.0.0/8
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an ip or a range", proxy)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ip or a range", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func trustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//clientIP gives you the ip of whoever sent the request. We only believe
+//X-Forwarded-For and X-Real-IP when the request comes from a trusted proxy,
+//and we read X-Forwarded-For from the right, so a client can't make up the
+//addresses before the first proxy.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !trustedProxy(ip, trusted) {
+		return host
+	}
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	if len(r.Header["X-Forwarded-For"]) == 0 {
+		forwarded = []string{r.Header.Get("X-Real-IP")}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if next == nil {
+			break
+		}
+		ip = next
+		if !trustedProxy(ip, trusted) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+//certReloader keeps the TLS certificate, and loads it again when the files
+//change, so a renewed certificate works without a restart
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	err := certs.load()
+	if err != nil {
+		return nil, err
+	}
+	return certs, nil
+}
+
+func (c *certReloader) load() error {
+	modTime := c.filesModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Could not load the TLS certificate %s: %v", c.certFile, err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+//filesModTime is the last time the certificate or the key changed
+func (c *certReloader) filesModTime() time.Time {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+//GetCertificate is for tls.Config, when the new files don't load we keep
+//using the certificate we have
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checkedAt) >= certCheckInterval {
+		c.checkedAt = time.Now()
+		if modTime := c.filesModTime(); !modTime.Equal(c.modTime) {
+			err := c.load()
+			if err != nil {
+				//don't try again until the files change again
+				c.modTime = modTime
+				mainLog.Errorf("%v, using the one we have", err)
+			} else {
+				mainLog.Infof("Loaded the new TLS certificate %s", c.certFile)
+			}
+		}
+	}
+	return c.cert, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		remote    string
+		forwarded string
+		realIP    string
+		expected  string
+	}{
+		{"203.0.113.7:5555", "198.51.100.1", "", "203.0.113.7"},
+		{"10.0.0.2:5555", "", "", "10.0.0.2"},
+		{"10.0.0.2:5555", "198.51.100.1", "", "198.51.100.1"},
+		{"10.0.0.2:5555", "1.2.3.4, 198.51.100.1, 192.168.1.5", "", "198.51.100.1"},
+		{"10.0.0.2:5555", "", "198.51.100.9", "198.51.100.9"},
+		{"10.0.0.2:5555", "junk, 10.0.0.3", "", "10.0.0.3"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/wit", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if ip := clientIP(r, trusted); ip != test.expected {
+			t.Errorf("clientIP for %s with %q gave %s, expected %s", test.remote, test.forwarded, ip, test.expected)
+		}
+	}
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	if err == nil {
+		t.Errorf("10.0.0.0/33 should not be a valid range")
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.HttpMaxBodyBytes = 16
+	config.TrustedProxies = []string{"127.0.0.1"}
+
+	var remote string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sms", func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+		_, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		}
+	})
+	handler := httpHandler("/cortex", mux)
+
+	r := httptest.NewRequest("POST", "/cortex/sms", strings.NewReader("text=hi"))
+	r.RemoteAddr = "127.0.0.1:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusOK || remote != "198.51.100.1" {
+		t.Errorf("/cortex/sms gave %d from %s", rec.Code, remote)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/sms", strings.NewReader("text=hi")))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("/sms without the prefix gave %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/cortex/sms", strings.NewReader("text=a very long message")))
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("A large body gave %d", rec.Code)
+	}
+
+	//without Content-Length we find out while reading it
+	r = httptest.NewRequest("POST", "/cortex/sms", strings.NewReader("text=a very long message"))
+	r.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("A large chunked body gave %d", rec.Code)
+	}
+}
+
+//writeCert writes a self signed certificate for name
+func writeCert(t *testing.T, certFile, keyFile, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cortex-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	oldInterval := certCheckInterval
+	certCheckInterval = 0
+	defer func() { certCheckInterval = oldInterval }()
+
+	writeCert(t, certFile, keyFile, "first")
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commonName := func() string {
+		cert, _ := certs.GetCertificate(nil)
+		parsed, _ := x509.ParseCertificate(cert.Certificate[0])
+		return parsed.Subject.CommonName
+	}
+	if name := commonName(); name != "first" {
+		t.Errorf("Got the certificate for %s", name)
+	}
+
+	writeCert(t, certFile, keyFile, "renewed")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := commonName(); name != "renewed" {
+		t.Errorf("Got the certificate for %s after it changed", name)
+	}
+
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyFile, later, later)
+	if name := commonName(); name != "renewed" {
+		t.Errorf("Got the certificate for %s after a bad key", name)
+	}
+
+	_, err = newCertReloader(certFile, keyFile)
+	if err == nil {
+		t.Errorf("A broken key should not load")
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const slackDefaultAPIURL = "https://slack.com/api"
+
+//slackAdapter gets messages from the Slack Events API, Slack POSTs them to
+//EventsHandler and Receive hands them to Cortex. Replies go out using
+//chat.postMessage in the thread of the original message.
+type slackAdapter struct {
+	apiURL    string
+	token     string
+	secret    string
+	filter    []string
+	messages  chan ChatMessage
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	//mu guards what Connect finds out, EventsHandler reads it
+	mu        sync.Mutex
+	botUserID string
+	teamURL   string
+	channels  map[string]string
+	seen      map[string]time.Time
+}
+
+func newSlackAdapter() *slackAdapter {
+	c := currentConfig()
+	apiURL := c.SlackAPIURL
+	if apiURL == "" {
+		apiURL = slackDefaultAPIURL
+	}
+	var filter []string
+	for _, name := range strings.Split(c.SlackChannels, ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "#")
+		if name != "" {
+			filter = append(filter, name)
+		}
+	}
+	return &slackAdapter{
+		apiURL:   strings.TrimSuffix(apiURL, "/"),
+		token:    c.SlackBotToken,
+		secret:   c.SlackSigningSecret,
+		filter:   filter,
+		messages: make(chan ChatMessage, 100),
+		closed:   make(chan struct{}),
+		channels: make(map[string]string),
+		seen:     make(map[string]time.Time),
+	}
+}
+
+func (s *slackAdapter) Name() string {
+	return "slack"
+}
+
+//Connect finds out who we are and which channels we can see
+func (s *slackAdapter) Connect() error {
+	var auth struct {
+		slackResponse
+		UserID string `json:"user_id"`
+		URL    string
+	}
+	err := s.call("auth.test", nil, &auth)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.botUserID = auth.UserID
+	s.teamURL = auth.URL
+	s.mu.Unlock()
+	return s.fetchChannels()
+}
+
+func (s *slackAdapter) fetchChannels() error {
+	var list struct {
+		slackResponse
+		Channels []struct {
+			ID   string
+			Name string
+		}
+	}
+	err := s.call("conversations.list", url.Values{"types": {"public_channel,private_channel"}}, &list)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, channel := range list.Channels {
+		s.channels[channel.ID] = channel.Name
+	}
+	return nil
+}
+
+//Receive blocks until Slack sends us a message we care about
+func (s *slackAdapter) Receive() (ChatMessage, error) {
+	select {
+	case msg := <-s.messages:
+		return msg, nil
+	case <-s.closed:
+		return ChatMessage{}, errors.New("slack event stream closed")
+	}
+}
+
+//Close makes Receive return, when Cortex stops
+func (s *slackAdapter) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+//Reply posts the text in the thread of the original message
+func (s *slackAdapter) Reply(msg ChatMessage, reply ChatReply) (string, error) {
+	var posted struct {
+		slackResponse
+		Ts string
+	}
+	params := url.Values{
+		"channel":   {msg.Channel},
+		"text":      {renderSlack(reply.Text)},
+		"thread_ts": {msg.ThreadID},
+	}
+	err := s.call("chat.postMessage", params, &posted)
+	if err != nil {
+		return "", err
+	}
+	return posted.Ts, nil
+}
+
+//EditReply changes a reply we sent before using chat.update
+func (s *slackAdapter) EditReply(msg ChatMessage, replyID string, reply ChatReply) error {
+	var updated slackResponse
+	params := url.Values{
+		"channel": {msg.Channel},
+		"ts":      {replyID},
+		"text":    {renderSlack(reply.Text)},
+	}
+	return s.call("chat.update", params, &updated)
+}
+
+//EventsHandler is the request url we configure on the Slack app for the
+//Events API
+func (s *slackAdapter) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "could not read body", http.StatusBadRequest)
+		return
+	}
+	if !s.validSignature(r.Header, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var envelope slackEnvelope
+	err = json.Unmarshal(body, &envelope)
+	if err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	switch envelope.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, envelope.Challenge)
+		return
+	case "event_callback":
+		msg, ok := s.toChatMessage(envelope.Event)
+		if ok {
+			select {
+			case s.messages <- msg:
+			default:
+				slackLog.Warnf("Dropping Slack message %s, too many pending messages", msg.ID)
+			}
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+//validSignature checks the X-Slack-Signature header, see
+//https://api.slack.com/authentication/verifying-requests-from-slack.
+//validateConfig asks for the secret, without one nothing is valid.
+func (s *slackAdapter) validSignature(header http.Header, body []byte) bool {
+	if s.secret == "" {
+		return false
+	}
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Now().Unix() - ts; age > 300 || age < -300 {
+		return false
+	}
+	expected := slackSignature(s.secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//toChatMessage converts a message or app_mention event, the bool is false
+//for events Cortex should not answer to
+func (s *slackAdapter) toChatMessage(event slackEvent) (ChatMessage, bool) {
+	if event.Type != "message" && event.Type != "app_mention" {
+		return ChatMessage{}, false
+	}
+	edited := false
+	if event.Subtype == "message_changed" && event.Message != nil {
+		edited = true
+		changed := *event.Message
+		changed.Type = event.Type
+		changed.Channel = event.Channel
+		changed.ChannelType = event.ChannelType
+		event = changed
+	}
+	s.mu.Lock()
+	botUserID, teamURL := s.botUserID, s.teamURL
+	s.mu.Unlock()
+	//edits, joins, bot messages, etc all come with a subtype
+	if event.Subtype != "" || event.BotID != "" || event.User == botUserID {
+		return ChatMessage{}, false
+	}
+	private := event.ChannelType == "im"
+	if !private && !s.channelAllowed(event.Channel) {
+		return ChatMessage{}, false
+	}
+	//a mention arrives twice, once as message and once as app_mention
+	if !edited && s.alreadySeen(event.Channel+event.Ts) {
+		return ChatMessage{}, false
+	}
+	msg := ChatMessage{
+		ID:          event.Ts,
+		ThreadID:    event.ThreadTs,
+		Channel:     event.Channel,
+		ChannelName: s.channelName(event.Channel),
+		Sender:      event.User,
+		Private:     private,
+		Edited:      edited,
+	}
+	msg.Text, msg.Mentioned = stripMention(event.Text, "<@"+botUserID+">")
+	if event.Type == "app_mention" {
+		msg.Mentioned = true
+	}
+	if msg.ThreadID == "" {
+		msg.ThreadID = event.Ts
+	}
+	if teamURL != "" {
+		//permalinks are the ts without the dot
+		msg.URL = fmt.Sprintf("%s/archives/%s/p%s", strings.TrimSuffix(teamURL, "/"), event.Channel, strings.Replace(event.Ts, ".", "", 1))
+	}
+	return msg, true
+}
+
+func (s *slackAdapter) channelName(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name, ok := s.channels[id]; ok {
+		return name
+	}
+	return id
+}
+
+//channelAllowed works like the Flows setting, an empty list means every channel
+func (s *slackAdapter) channelAllowed(id string) bool {
+	if len(s.filter) == 0 {
+		return true
+	}
+	name := s.channelName(id)
+	for _, allowed := range s.filter {
+		if allowed == id || allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *slackAdapter) alreadySeen(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, t := range s.seen {
+		if now.Sub(t) > time.Minute {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[key]; ok {
+		return true
+	}
+	s.seen[key] = now
+	return false
+}
+
+//call POSTs the params to a Slack web api method and decodes the answer
+func (s *slackAdapter) call(method string, params url.Values, result slackResult) error {
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/%s", s.apiURL, method), strings.NewReader(params.Encode()))
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", s.token))
+	req.Header.Add("Content-type", "application/x-www-form-urlencoded")
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error calling Slack's %s: %v", method, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("Slack's %s gave status code %+v", method, res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("Could not parse Slack's %s response, got: %v", method, err)
+	}
+	if !result.ok() {
+		return fmt.Errorf("Slack's %s gave error: %s", method, result.errorMessage())
+	}
+	return nil
+}
+
+type slackResult interface {
+	ok() bool
+	errorMessage() string
+}
+
+//slackResponse is the part every Slack web api answer has in common
+type slackResponse struct {
+	OK    bool
+	Error string
+}
+
+func (r slackResponse) ok() bool {
+	return r.OK
+}
+
+func (r slackResponse) errorMessage() string {
+	return r.Error
+}
+
+//slackEnvelope is the outer payload Slack POSTs to the Events API url
+type slackEnvelope struct {
+	Type      string
+	Challenge string
+	Event     slackEvent
+}
+
+//slackEvent holds what we care about from message and app_mention events
+type slackEvent struct {
+	Type        string
+	Subtype     string
+	Channel     string
+	ChannelType string `json:"channel_type"`
+	User        string
+	BotID       string `json:"bot_id"`
+	Text        string
+	Ts          string
+	ThreadTs    string `json:"thread_ts"`
+	//Message is the new version of the message on message_changed events
+	Message *slackEvent
+}
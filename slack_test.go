@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func fakeSlackAPI(t *testing.T, posted chan url.Values) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			t.Errorf("Slack call without token: %+v", r.Header)
+		}
+		r.ParseForm()
+		switch r.URL.Path {
+		case "/auth.test":
+			w.Write([]byte(`{"ok": true, "user_id": "UCORTEX", "url": "https://cortex.slack.com/"}`))
+		case "/conversations.list":
+			w.Write([]byte(`{"ok": true, "channels": [{"id": "C1", "name": "mission-control"}, {"id": "C2", "name": "random"}]}`))
+		case "/chat.postMessage":
+			posted <- r.PostForm
+			w.Write([]byte(`{"ok": true, "ts": "1500000000.000200"}`))
+		default:
+			w.Write([]byte(`{"ok": false, "error": "unknown_method"}`))
+		}
+	}))
+}
+
+//newTestSlackAdapter changes the config, restore it when the test ends
+func newTestSlackAdapter(apiURL string) *slackAdapter {
+	config.SlackAPIURL = apiURL
+	config.SlackBotToken = "xoxb-test"
+	config.SlackSigningSecret = "secret"
+	config.SlackChannels = "#mission-control"
+	return newSlackAdapter()
+}
+
+func postSlackEvent(s *slackAdapter, body string) *httptest.ResponseRecorder {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req := httptest.NewRequest("POST", "/slack/events", bytes.NewBufferString(body))
+	req.Header.Set("X-Slack-Request-Timestamp", timestamp)
+	req.Header.Set("X-Slack-Signature", slackSignature("secret", timestamp, []byte(body)))
+	w := httptest.NewRecorder()
+	s.EventsHandler(w, req)
+	return w
+}
+
+func TestSlackURLVerification(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	s := newTestSlackAdapter("http://127.0.0.1:0")
+	w := postSlackEvent(s, `{"type": "url_verification", "challenge": "abc123"}`)
+	if w.Code != 200 || w.Body.String() != "abc123" {
+		t.Errorf("url_verification gave %v %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSlackRejectsBadSignature(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	s := newTestSlackAdapter("http://127.0.0.1:0")
+	req := httptest.NewRequest("POST", "/slack/events", bytes.NewBufferString(`{"type": "url_verification"}`))
+	req.Header.Set("X-Slack-Request-Timestamp", strconv.FormatInt(time.Now().Unix(), 10))
+	req.Header.Set("X-Slack-Signature", "v0=nope")
+	w := httptest.NewRecorder()
+	s.EventsHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Bad signature gave %v", w.Code)
+	}
+}
+
+func TestSlackReceiveAndReply(t *testing.T) {
+	posted := make(chan url.Values, 1)
+	api := fakeSlackAPI(t, posted)
+	defer api.Close()
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	s := newTestSlackAdapter(api.URL)
+	err := s.Connect()
+	if err != nil {
+		t.Fatalf("Connect gave %v", err)
+	}
+
+	postSlackEvent(s, `{"type": "event_callback", "event": {"type": "message", "channel": "C2", "user": "U1", "text": "ignored", "ts": "1.1"}}`)
+	postSlackEvent(s, `{"type": "event_callback", "event": {"type": "message", "channel": "C1", "user": "UCORTEX", "text": "my own", "ts": "1.2"}}`)
+	postSlackEvent(s, `{"type": "event_callback", "event": {"type": "app_mention", "channel": "C1", "user": "U1", "text": "look at #45", "ts": "1.3"}}`)
+	postSlackEvent(s, `{"type": "event_callback", "event": {"type": "message", "channel": "C1", "user": "U1", "text": "look at #45", "ts": "1.3"}}`)
+
+	msg, _ := s.Receive()
+	if msg.Text != "look at #45" || msg.ChannelName != "mission-control" || msg.ThreadID != "1.3" || msg.URL != "https://cortex.slack.com/archives/C1/p13" {
+		t.Errorf("Receive gave %+v", msg)
+	}
+	if len(s.messages) != 0 {
+		t.Errorf("Expected one message, %v more are pending", len(s.messages))
+	}
+
+	id, err := s.Reply(msg, textReply("just click here: [#45](https://github.com/fmpwizard/go-cortex/issues/45)"))
+	if err != nil || id != "1500000000.000200" {
+		t.Errorf("Reply gave %v, %v", id, err)
+	}
+	form := <-posted
+	if form.Get("channel") != "C1" || form.Get("thread_ts") != "1.3" || form.Get("text") != "just click here: <https://github.com/fmpwizard/go-cortex/issues/45|#45>" {
+		t.Errorf("chat.postMessage got %+v", form)
+	}
+}
+
+func TestSlackWithoutSecret(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	s := newTestSlackAdapter("http://127.0.0.1:0")
+	s.secret = ""
+	w := postSlackEvent(s, `{"type": "url_verification", "challenge": "abc123"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Without a signing secret we answered %v %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//Tracker is an issue tracker, like GitHub or Jira. Keys are what people
+//write in the chat, 45 or PROJ-123, without the #
+type Tracker interface {
+	Lookup(key string) (trackerIssue, error)
+	Create(issue trackerIssue) (trackerIssue, error)
+	Comment(key, text string) error
+	//Transition moves the issue to the state, "closed" and "open" work on
+	//every tracker, Jira also takes the name of any of its transitions
+	Transition(key, state string) (trackerIssue, error)
+}
+
+//trackerLabeler is for trackers that let us add labels to an issue
+type trackerLabeler interface {
+	Label(key string, labels ...string) error
+}
+
+//trackerIssue is an issue, or pull/merge request, on any tracker
+type trackerIssue struct {
+	Key   string
+	Kind  string
+	Title string
+	Body  string
+	State string
+	URL   string
+	//Assignees are ready to show, @login where the tracker has logins
+	Assignees []string
+	Labels    []string
+}
+
+//TrackerConfig sets up the tracker for a flow or channel. URL is the api,
+//like https://gitlab.com/api/v4 or https://example.atlassian.net, Project is
+//owner/repo on GitHub and Gitea, the project path or id on GitLab and the
+//project key on Jira. User is only used by Jira, with Token as the api token.
+type TrackerConfig struct {
+	Type         string
+	URL          string
+	Project      string
+	Token        string `cortex:"secret"`
+	User         string
+	AllowedUsers []string
+}
+
+//trackerFor gives you the tracker for the flow or channel, from Trackers,
+//or a GitHub one when all we have is a FlowsTicketsUrls entry
+func trackerFor(channelName string) (Tracker, []string, error) {
+	current := currentConfig()
+	trackerConfig, ok := current.Trackers[channelName]
+	if !ok {
+		trackerConfig, ok = current.Trackers["*"]
+	}
+	if !ok {
+		issuesURL, err := getIssueURLForFlowName(channelName)
+		if err != nil {
+			return nil, nil, err
+		}
+		repo, err := parseGithubRepo(issuesURL)
+		if err != nil {
+			return nil, nil, err
+		}
+		trackerConfig = TrackerConfig{
+			Type:         "github",
+			URL:          current.GithubAPIURL,
+			Project:      repo.Owner + "/" + repo.Name,
+			Token:        current.GithubToken,
+			AllowedUsers: current.GithubAllowedUsers,
+		}
+	}
+	tracker, err := newTracker(trackerConfig)
+	if err != nil {
+		return nil, trackerConfig.AllowedUsers, err
+	}
+	return tracker, trackerConfig.AllowedUsers, nil
+}
+
+func newTracker(trackerConfig TrackerConfig) (Tracker, error) {
+	switch strings.ToLower(trackerConfig.Type) {
+	case "github", "":
+		return newGithubTracker(trackerConfig)
+	case "gitlab":
+		return newGitlabTracker(trackerConfig), nil
+	case "gitea":
+		return newGiteaTracker(trackerConfig)
+	case "jira":
+		return newJiraTracker(trackerConfig), nil
+	}
+	return nil, fmt.Errorf("Unknown tracker type %s", trackerConfig.Type)
+}
+
+var issueKeyRegexp = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[0-9]+\b`)
+
+//issueKeys gives you the PROJ-123 keys in the text followed by the numbers
+//Wit found, leaving out the ones that are part of a key
+func issueKeys(text string, numbers []WitNumber) []string {
+	keys := issueKeyRegexp.FindAllString(text, -1)
+	for _, number := range numbers {
+		value := strconv.Itoa(number.Value)
+		partOfKey := false
+		for _, key := range keys {
+			if strings.HasSuffix(key, "-"+value) {
+				partOfKey = true
+			}
+		}
+		if !partOfKey {
+			keys = append(keys, value)
+		}
+	}
+	return keys
+}
+
+//issueNumber is for trackers that only know about numbers
+func issueNumber(key string) (int, error) {
+	number, err := strconv.Atoi(strings.TrimPrefix(key, "#"))
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an issue number", key)
+	}
+	return number, nil
+}
+
+//displayKey is how we show the key in replies, #45 or PROJ-123
+func displayKey(key string) string {
+	if _, err := strconv.Atoi(key); err == nil {
+		return "#" + key
+	}
+	return key
+}
+
+//trackerClient sends json to a tracker api, auth adds the headers each
+//tracker wants for its token
+type trackerClient struct {
+	name string
+	base string
+	auth func(req *http.Request)
+}
+
+func (c trackerClient) call(method, path string, payload interface{}, result interface{}) error {
+	var body []byte
+	if payload != nil {
+		var err error
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+	}
+	req, _ := http.NewRequest(method, c.base+path, bytes.NewReader(body))
+	req.Header.Add("Accept", "application/json")
+	if c.auth != nil {
+		c.auth(req)
+	}
+	if payload != nil {
+		req.Header.Add("Content-type", "application/json")
+	}
+	client := &http.Client{}
+	res, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Error calling %s %s: %v", c.name, path, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		var trackerErr struct {
+			Message       string
+			ErrorMessages []string
+		}
+		json.NewDecoder(res.Body).Decode(&trackerErr)
+		message := trackerErr.Message
+		if message == "" {
+			message = strings.Join(trackerErr.ErrorMessages, ", ")
+		}
+		return fmt.Errorf("%s %s gave status code %+v: %s", c.name, path, res.StatusCode, message)
+	}
+	if result == nil || res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(result)
+}
+
+//canModifyIssues tells you if the sender is one of the allowed users, only
+//those people can close or label issues from the chat. Each entry names the
+//chat too, like flowdock:fmpwizard or matrix:@diego:example.org, and we only
+//compare it with the ids the chat vouches for. Anybody can take a nick on
+//IRC, so nobody changes issues from there.
+func canModifyIssues(msg ChatMessage, allowedUsers []string) bool {
+	if msg.Adapter == "" || msg.Adapter == "irc" {
+		return false
+	}
+	for _, allowed := range allowedUsers {
+		adapter, user, ok := strings.Cut(allowed, ":")
+		if !ok || adapter != msg.Adapter || user == "" {
+			continue
+		}
+		//Flowdock looks up the nick by the user id, so it can be trusted
+		if user == msg.Sender || (adapter == "flowdock" && user == msg.SenderName) {
+			return true
+		}
+	}
+	return false
+}
+
+//allowedUserProblem tells you what is wrong with an allowedUsers entry, or
+//an empty string when it's fine
+func allowedUserProblem(allowed string) string {
+	adapter, user, ok := strings.Cut(allowed, ":")
+	switch {
+	case !ok || user == "":
+		return fmt.Sprintf("%q should name the chat too, like flowdock:%s", allowed, allowed)
+	case adapter == "irc":
+		return fmt.Sprintf("%q can't be allowed, anybody can take a nick on IRC", allowed)
+	case adapter != "flowdock" && adapter != "slack" && adapter != "matrix":
+		return fmt.Sprintf("%q names an unknown chat, use flowdock, slack or matrix", allowed)
+	}
+	return ""
+}
+
+//issueSummary is the markdown we reply with when somebody asks about an issue
+func issueSummary(issue trackerIssue) string {
+	kind := issue.Kind
+	if kind == "" {
+		kind = "Issue"
+	}
+	summary := fmt.Sprintf("%s %s is %s", kind, mdLink(displayKey(issue.Key)+" "+issue.Title, issue.URL), mdBold(issue.State))
+	if len(issue.Assignees) > 0 {
+		summary += ", assigned to " + strings.Join(issue.Assignees, ", ")
+	}
+	if len(issue.Labels) > 0 {
+		var labels []string
+		for _, label := range issue.Labels {
+			labels = append(labels, mdCode(label))
+		}
+		summary += ", labeled " + strings.Join(labels, " ")
+	}
+	return summary
+}
+
+//issueReplies looks up, closes or labels the issues using the tracker for
+//the channel
+func issueReplies(ctx context.Context, ret WitResponse, msg ChatMessage) []ChatReply {
+	logger := trackerLog.withContext(ctx)
+	tracker, allowedUsers, err := trackerFor(msg.ChannelName)
+	if err != nil {
+		logger.Errorf("%s", err)
+	}
+	if ret.Issues.Action == "create" {
+		if err != nil {
+			return []ChatReply{textReply(err.Error())}
+		}
+		return createIssueReplies(tracker, ret.Issues.New, msg)
+	}
+	if ret.Issues.Action != "" {
+		if !canModifyIssues(msg, allowedUsers) {
+			return []ChatReply{textReply(fmt.Sprintf("Sorry, you are not allowed to %s issues.", ret.Issues.Action))}
+		}
+		if err != nil {
+			return []ChatReply{textReply(err.Error())}
+		}
+	}
+
+	var replies []ChatReply
+	for _, key := range ret.Issues.keys {
+		link := issueLink(msg.ChannelName, key)
+		switch ret.Issues.Action {
+		case "close":
+			issue, err := tracker.Transition(key, "closed")
+			if err != nil {
+				replies = append(replies, textReply(fmt.Sprintf("Could not close %s: %v", link, err)))
+				continue
+			}
+			replies = append(replies, textReply("Closed "+mdLink(displayKey(issue.Key)+" "+issue.Title, issue.URL)))
+		case "label":
+			labeler, ok := tracker.(trackerLabeler)
+			if !ok {
+				replies = append(replies, textReply("Sorry, I can't label issues on this tracker."))
+				continue
+			}
+			if ret.Issues.Label == "" {
+				replies = append(replies, textReply(fmt.Sprintf("Which label should I add to %s?", link)))
+				continue
+			}
+			err := labeler.Label(key, ret.Issues.Label)
+			if err != nil {
+				replies = append(replies, textReply(fmt.Sprintf("Could not label %s: %v", link, err)))
+				continue
+			}
+			replies = append(replies, textReply(fmt.Sprintf("Labeled %s as %s", link, mdCode(ret.Issues.Label))))
+		default:
+			if tracker == nil {
+				replies = append(replies, textReply("just click here: "+link))
+				continue
+			}
+			issue, err := tracker.Lookup(key)
+			if err != nil {
+				//the tracker may be down, or the token can't see the project, the link still helps
+				logger.Warnf("Could not look up %s, got: %v", key, err)
+				replies = append(replies, textReply("just click here: "+link))
+				continue
+			}
+			replies = append(replies, textReply(issueSummary(issue)))
+		}
+	}
+	return replies
+}
+
+//issueLink links to the issue using FlowsTicketsUrls, or just shows the key
+//when the flow isn't there
+func issueLink(channelName, key string) string {
+	issuesURL, err := getIssueURLForFlowName(channelName)
+	if err != nil {
+		return displayKey(key)
+	}
+	return mdLink(displayKey(key), fmt.Sprintf("%+v%+v", issuesURL, key))
+}
+
+//createIssueReplies files the issue, with a link back to the chat message
+//it came from when the chat has links
+func createIssueReplies(tracker Tracker, issue trackerIssue, msg ChatMessage) []ChatReply {
+	if issue.Title == "" {
+		return []ChatReply{textReply("What should the issue say? Try " + mdCode("file a bug: the deploy script fails on arm"))}
+	}
+	sender := msg.SenderName
+	if sender == "" {
+		sender = msg.Sender
+	}
+	reported := fmt.Sprintf("Reported by %s", sender)
+	if msg.ChannelName != "" {
+		reported += " in " + msg.ChannelName
+	}
+	if msg.URL != "" {
+		reported += ", see " + mdLink("the original message", msg.URL)
+	}
+	issue.Body = strings.TrimSpace(issue.Body + "\n\n" + reported)
+	created, err := tracker.Create(issue)
+	if err != nil {
+		return []ChatReply{textReply(fmt.Sprintf("Could not create the issue: %v", err))}
+	}
+	return []ChatReply{textReply("Created " + mdLink(displayKey(created.Key)+" "+created.Title, created.URL))}
+}
+
+//newIssueFromText turns "file a bug: the deploy script fails on arm" into
+//an issue. The title is the first line after the colon, the other lines are
+//the body, and asking for a bug or a feature adds a label.
+func newIssueFromText(text string, labels ...string) trackerIssue {
+	var issue trackerIssue
+	lead, rest := "", text
+	if idx := strings.Index(text, ":"); idx >= 0 {
+		lead, rest = strings.ToLower(text[:idx]), text[idx+1:]
+	}
+	lines := strings.SplitN(strings.TrimSpace(rest), "\n", 2)
+	issue.Title = strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		issue.Body = strings.TrimSpace(lines[1])
+	}
+	if strings.Contains(lead, "bug") {
+		issue.Kind = "Bug"
+		issue.Labels = append(issue.Labels, "bug")
+	} else if strings.Contains(lead, "feature") {
+		issue.Labels = append(issue.Labels, "enhancement")
+	}
+	for _, label := range labels {
+		if label != "" {
+			issue.Labels = append(issue.Labels, label)
+		}
+	}
+	return issue
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestIssueKeys(t *testing.T) {
+	numbers := []WitNumber{{Value: 123}, {Value: 45}}
+	keys := issueKeys("what about PROJ-123 and 45?", numbers)
+	if !reflect.DeepEqual(keys, []string{"PROJ-123", "45"}) {
+		t.Errorf("issueKeys gave %+v", keys)
+	}
+}
+
+func TestNewIssueFromText(t *testing.T) {
+	issue := newIssueFromText("file a bug: the deploy script fails on arm\nit can't find gcc", "deploy")
+	if issue.Title != "the deploy script fails on arm" || issue.Body != "it can't find gcc" || issue.Kind != "Bug" ||
+		!reflect.DeepEqual(issue.Labels, []string{"bug", "deploy"}) {
+		t.Errorf("newIssueFromText gave %+v", issue)
+	}
+	issue = newIssueFromText("new feature request: dim the lights")
+	if issue.Title != "dim the lights" || issue.Kind != "" || !reflect.DeepEqual(issue.Labels, []string{"enhancement"}) {
+		t.Errorf("newIssueFromText gave %+v", issue)
+	}
+}
+
+func TestProcessIntentIssueKeys(t *testing.T) {
+	var intent WitMessage
+	intent.MsgBody = "show me OPS-7"
+	intent.Outcome.Intent = "github"
+	intent.Outcome.Entities.MultipleNumber = []WitNumber{{Value: 7}}
+	ret := ProcessIntent(context.Background(), intent)
+	if !reflect.DeepEqual(ret.Issues.keys, []string{"OPS-7"}) {
+		t.Errorf("ProcessIntent gave %+v", ret.Issues)
+	}
+}
+
+func TestTrackerFor(t *testing.T) {
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.Trackers = map[string]TrackerConfig{
+		"ops": {Type: "jira", URL: "https://example.atlassian.net", Project: "OPS"},
+		"*":   {Type: "gitlab", Project: "group/project", AllowedUsers: []string{"matrix:@diego:example.org"}},
+	}
+
+	tracker, _, err := trackerFor("ops")
+	if _, ok := tracker.(*jiraTracker); !ok || err != nil {
+		t.Errorf("trackerFor(ops) gave %T, %v", tracker, err)
+	}
+	tracker, allowed, err := trackerFor("huston")
+	if _, ok := tracker.(*gitlabTracker); !ok || err != nil || len(allowed) != 1 {
+		t.Errorf("trackerFor(huston) gave %T, %+v, %v", tracker, allowed, err)
+	}
+
+	config.Trackers = map[string]TrackerConfig{"ops": {Type: "trac"}}
+	tracker, _, err = trackerFor("ops")
+	if tracker != nil || err == nil {
+		t.Errorf("trackerFor should fail for unknown trackers, gave %T", tracker)
+	}
+}
+
+func TestJiraTracker(t *testing.T) {
+	var transitioned, comment string
+	var labels interface{}
+	jira := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, token, _ := r.BasicAuth()
+		if user != "cortex@example.com" || token != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /rest/api/2/issue/OPS-7":
+			status := "To Do"
+			if transitioned == "31" {
+				status = "Done"
+			}
+			fmt.Fprintf(w, `{"key": "OPS-7", "fields": {"summary": "Deploy fails on arm", "status": {"name": %q},
+				"assignee": {"displayName": "Diego Medina"}, "labels": ["deploy"], "issuetype": {"name": "Bug"}}}`, status)
+		case "GET /rest/api/2/issue/OPS-7/transitions":
+			fmt.Fprint(w, `{"transitions": [{"id": "21", "name": "Start", "to": {"name": "In Progress", "statusCategory": {"key": "indeterminate"}}},
+				{"id": "31", "name": "Finish", "to": {"name": "Done", "statusCategory": {"key": "done"}}}]}`)
+		case "POST /rest/api/2/issue/OPS-7/transitions":
+			var payload struct {
+				Transition struct {
+					ID string
+				}
+			}
+			json.NewDecoder(r.Body).Decode(&payload)
+			transitioned = payload.Transition.ID
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /rest/api/2/issue/OPS-7/comment":
+			var payload map[string]string
+			json.NewDecoder(r.Body).Decode(&payload)
+			comment = payload["body"]
+			fmt.Fprint(w, `{"id": "1"}`)
+		case "PUT /rest/api/2/issue/OPS-7":
+			var payload map[string]map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&payload)
+			labels = payload["update"]["labels"]
+			w.WriteHeader(http.StatusNoContent)
+		case "POST /rest/api/2/issue":
+			fmt.Fprint(w, `{"id": "10002", "key": "OPS-8"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errorMessages": ["Issue does not exist"]}`)
+		}
+	}))
+	defer jira.Close()
+	tracker := newJiraTracker(TrackerConfig{URL: jira.URL, Project: "OPS", User: "cortex@example.com", Token: "s3cret"})
+
+	issue, err := tracker.Lookup("7")
+	if err != nil || issue.Key != "OPS-7" || issue.URL != jira.URL+"/browse/OPS-7" || issue.State != "To Do" {
+		t.Errorf("Lookup gave %+v, %v", issue, err)
+	}
+	expected := "Bug [OPS-7 Deploy fails on arm](" + jira.URL + "/browse/OPS-7) is **To Do**, assigned to Diego Medina, labeled `deploy`"
+	if summary := issueSummary(issue); summary != expected {
+		t.Errorf("issueSummary gave %s", summary)
+	}
+
+	issue, err = tracker.Transition("OPS-7", "closed")
+	if err != nil || transitioned != "31" || issue.State != "Done" {
+		t.Errorf("Transition gave %+v, %v, used %s", issue, err, transitioned)
+	}
+	_, err = tracker.Transition("OPS-7", "Review")
+	if err == nil {
+		t.Error("Transition should fail without a matching transition")
+	}
+
+	if err := tracker.Comment("OPS-7", "Fixed in #12"); err != nil || comment != "Fixed in #12" {
+		t.Errorf("Comment gave %v, Jira got %q", err, comment)
+	}
+	if err := tracker.Label("OPS-7", "arm"); err != nil || fmt.Sprint(labels) != "[map[add:arm]]" {
+		t.Errorf("Label gave %v, Jira got %+v", err, labels)
+	}
+
+	created, err := tracker.Create(trackerIssue{Title: "Another one"})
+	if err != nil || created.Key != "OPS-8" || created.Kind != "Task" {
+		t.Errorf("Create gave %+v, %v", created, err)
+	}
+
+	_, err = tracker.Lookup("OPS-99")
+	if err == nil || err.Error() != "Jira /issue/OPS-99?fields=summary,description,status,assignee,labels,issuetype gave status code 404: Issue does not exist" {
+		t.Errorf("Lookup gave %v", err)
+	}
+}
+
+func TestGitlabTracker(t *testing.T) {
+	var event, addLabels string
+	gitlab := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.RawPath != "/projects/group%2Fproject/issues/12" {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "404 Not found"}`)
+			return
+		}
+		if r.Method == "PUT" {
+			var payload map[string]string
+			json.NewDecoder(r.Body).Decode(&payload)
+			event = payload["state_event"]
+			addLabels = payload["add_labels"]
+		}
+		state := "opened"
+		if event == "close" {
+			state = "closed"
+		}
+		fmt.Fprintf(w, `{"iid": 12, "title": "Flaky test", "state": %q, "web_url": "https://gitlab.com/group/project/-/issues/12",
+			"assignees": [{"username": "diego"}], "labels": ["ci"]}`, state)
+	}))
+	defer gitlab.Close()
+	tracker := newGitlabTracker(TrackerConfig{URL: gitlab.URL, Project: "group/project", Token: "s3cret"})
+
+	issue, err := tracker.Lookup("12")
+	expected := "Issue [#12 Flaky test](https://gitlab.com/group/project/-/issues/12) is **open**, assigned to @diego, labeled `ci`"
+	if err != nil || issueSummary(issue) != expected {
+		t.Errorf("Lookup gave %+v, %v", issue, err)
+	}
+	issue, err = tracker.Transition("12", "closed")
+	if err != nil || event != "close" || issue.State != "closed" {
+		t.Errorf("Transition gave %+v, %v", issue, err)
+	}
+	if err := tracker.Label("12", "bug", "arm"); err != nil || addLabels != "bug,arm" {
+		t.Errorf("Label gave %v, GitLab got %q", err, addLabels)
+	}
+	if _, err := tracker.Lookup("PROJ-12"); err == nil {
+		t.Error("GitLab should only take issue numbers")
+	}
+}
+
+func TestGiteaTracker(t *testing.T) {
+	gitea := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token s3cret" || r.URL.Path != "/api/v1/repos/ops/deploy/issues/3" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, `{"number": 3, "title": "Add arm builds", "state": "open", "html_url": "https://gitea.example.com/ops/deploy/issues/3"}`)
+	}))
+	defer gitea.Close()
+	tracker, err := newTracker(TrackerConfig{Type: "gitea", URL: gitea.URL + "/api/v1", Project: "ops/deploy", Token: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue, err := tracker.Lookup("3")
+	if err != nil || issueSummary(issue) != "Issue [#3 Add arm builds](https://gitea.example.com/ops/deploy/issues/3) is **open**" {
+		t.Errorf("Lookup gave %+v, %v", issue, err)
+	}
+	if _, ok := tracker.(trackerLabeler); ok {
+		t.Error("Gitea trackers should not offer labels")
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//unit converts to and from the base unit of its kind, base = value*factor + offset.
+//Other is the unit we answer with when nobody asked for one.
+type unit struct {
+	Symbol string
+	Kind   string
+	Factor float64
+	Offset float64
+	Other  string
+}
+
+//units are keyed by symbol, unitAliases has the other ways people write them
+var units = map[string]unit{
+	//temperature, base is kelvin
+	"C": {"C", "temperature", 1, 273.15, "F"},
+	"F": {"F", "temperature", 5.0 / 9, 273.15 - 32*5.0/9, "C"},
+	"K": {"K", "temperature", 1, 0, "C"},
+	//length, base is meters
+	"mm": {"mm", "length", 0.001, 0, "in"},
+	"cm": {"cm", "length", 0.01, 0, "in"},
+	"m":  {"m", "length", 1, 0, "ft"},
+	"km": {"km", "length", 1000, 0, "mi"},
+	"in": {"in", "length", 0.0254, 0, "cm"},
+	"ft": {"ft", "length", 0.3048, 0, "m"},
+	"yd": {"yd", "length", 0.9144, 0, "m"},
+	"mi": {"mi", "length", 1609.344, 0, "km"},
+	//weight, base is grams
+	"mg": {"mg", "weight", 0.001, 0, "oz"},
+	"g":  {"g", "weight", 1, 0, "oz"},
+	"kg": {"kg", "weight", 1000, 0, "lb"},
+	"t":  {"t", "weight", 1000000, 0, "lb"},
+	"oz": {"oz", "weight", 28.349523125, 0, "g"},
+	"lb": {"lb", "weight", 453.59237, 0, "kg"},
+	"st": {"st", "weight", 6350.29318, 0, "kg"},
+	//volume, base is liters, gallons and friends are US ones
+	"ml":    {"ml", "volume", 0.001, 0, "fl oz"},
+	"l":     {"l", "volume", 1, 0, "gal"},
+	"tsp":   {"tsp", "volume", 0.00492892159375, 0, "ml"},
+	"tbsp":  {"tbsp", "volume", 0.01478676478125, 0, "ml"},
+	"fl oz": {"fl oz", "volume", 0.0295735295625, 0, "ml"},
+	"cup":   {"cup", "volume", 0.2365882365, 0, "ml"},
+	"pt":    {"pt", "volume", 0.473176473, 0, "l"},
+	"qt":    {"qt", "volume", 0.946352946, 0, "l"},
+	"gal":   {"gal", "volume", 3.785411784, 0, "l"},
+	//speed, base is meters per second
+	"m/s":  {"m/s", "speed", 1, 0, "km/h"},
+	"km/h": {"km/h", "speed", 1000.0 / 3600, 0, "mph"},
+	"mph":  {"mph", "speed", 0.44704, 0, "km/h"},
+	"kn":   {"kn", "speed", 1852.0 / 3600, 0, "km/h"},
+	"ft/s": {"ft/s", "speed", 0.3048, 0, "m/s"},
+	//data, base is bytes
+	"bit": {"bit", "data", 0.125, 0, "B"},
+	"B":   {"B", "data", 1, 0, "KiB"},
+	"KB":  {"KB", "data", 1e3, 0, "KiB"},
+	"MB":  {"MB", "data", 1e6, 0, "MiB"},
+	"GB":  {"GB", "data", 1e9, 0, "GiB"},
+	"TB":  {"TB", "data", 1e12, 0, "TiB"},
+	"KiB": {"KiB", "data", 1 << 10, 0, "KB"},
+	"MiB": {"MiB", "data", 1 << 20, 0, "MB"},
+	"GiB": {"GiB", "data", 1 << 30, 0, "GB"},
+	"TiB": {"TiB", "data", 1 << 40, 0, "TB"},
+}
+
+var unitAliases = map[string]string{
+	"c": "C", "°c": "C", "celsius": "C", "centigrade": "C",
+	"f": "F", "°f": "F", "fahrenheit": "F",
+	"k": "K", "kelvin": "K", "kelvins": "K",
+	"millimeter": "mm", "millimeters": "mm", "millimetre": "mm", "millimetres": "mm",
+	"centimeter": "cm", "centimeters": "cm", "centimetre": "cm", "centimetres": "cm",
+	"meter": "m", "meters": "m", "metre": "m", "metres": "m",
+	"kilometer": "km", "kilometers": "km", "kilometre": "km", "kilometres": "km",
+	"inch": "in", "inches": "in", "\"": "in",
+	"foot": "ft", "feet": "ft", "'": "ft",
+	"yard": "yd", "yards": "yd",
+	"mile": "mi", "miles": "mi",
+	"milligram": "mg", "milligrams": "mg",
+	"gram": "g", "grams": "g",
+	"kilo": "kg", "kilos": "kg", "kilogram": "kg", "kilograms": "kg",
+	"tonne": "t", "tonnes": "t",
+	"ounce": "oz", "ounces": "oz",
+	"lbs": "lb", "pound": "lb", "pounds": "lb",
+	"stone": "st", "stones": "st",
+	"milliliter": "ml", "milliliters": "ml", "millilitre": "ml", "millilitres": "ml",
+	"liter": "l", "liters": "l", "litre": "l", "litres": "l",
+	"teaspoon": "tsp", "teaspoons": "tsp",
+	"tablespoon": "tbsp", "tablespoons": "tbsp",
+	"floz": "fl oz", "fluid ounce": "fl oz", "fluid ounces": "fl oz",
+	"cups": "cup",
+	"pint": "pt", "pints": "pt",
+	"quart": "qt", "quarts": "qt",
+	"gallon": "gal", "gallons": "gal",
+	"mps": "m/s", "meters per second": "m/s",
+	"kph": "km/h", "kmh": "km/h", "kilometers per hour": "km/h",
+	"mile per hour": "mph", "miles per hour": "mph",
+	"knot": "kn", "knots": "kn", "kt": "kn",
+	"fps": "ft/s", "feet per second": "ft/s",
+	"bits": "bit", "b": "B", "byte": "B", "bytes": "B",
+	"kb": "KB", "kilobyte": "KB", "kilobytes": "KB",
+	"mb": "MB", "megabyte": "MB", "megabytes": "MB",
+	"gb": "GB", "gigabyte": "GB", "gigabytes": "GB",
+	"tb": "TB", "terabyte": "TB", "terabytes": "TB",
+	"kib": "KiB", "mib": "MiB", "gib": "GiB", "tib": "TiB",
+}
+
+//findUnit gives you the unit for a symbol or any of its aliases, "degrees
+//celsius" and "°C" included
+func findUnit(name string) (unit, bool) {
+	name = strings.TrimSpace(name)
+	if u, ok := units[name]; ok {
+		return u, true
+	}
+	name = strings.ToLower(name)
+	name = strings.TrimPrefix(name, "degrees ")
+	name = strings.TrimPrefix(name, "degree ")
+	name = strings.TrimSpace(strings.TrimPrefix(name, "°"))
+	if u, ok := units[name]; ok {
+		return u, true
+	}
+	if symbol, ok := unitAliases[name]; ok {
+		return units[symbol], true
+	}
+	return unit{}, false
+}
+
+//convertUnits converts value from one unit to the other, they have to be of
+//the same kind
+func convertUnits(value float64, from, to string) (float64, error) {
+	fromUnit, ok := findUnit(from)
+	if !ok {
+		return 0, fmt.Errorf("I don't know the unit %s", from)
+	}
+	toUnit, ok := findUnit(to)
+	if !ok {
+		return 0, fmt.Errorf("I don't know the unit %s", to)
+	}
+	if fromUnit.Kind != toUnit.Kind {
+		return 0, fmt.Errorf("Can't convert %s to %s, one is %s and the other %s", fromUnit.Symbol, toUnit.Symbol, fromUnit.Kind, toUnit.Kind)
+	}
+	base := value*fromUnit.Factor + fromUnit.Offset
+	return (base - toUnit.Offset) / toUnit.Factor, nil
+}
+
+//defaultUnitDecimals is used when the config doesn't set UnitDecimals
+const defaultUnitDecimals = 2
+
+//formatUnitValue rounds to UnitDecimals and leaves out trailing zeros, so
+//100.00 is just 100
+func formatUnitValue(value float64) string {
+	decimals := defaultUnitDecimals
+	if unitDecimals := currentConfig().UnitDecimals; unitDecimals != nil && *unitDecimals >= 0 {
+		decimals = *unitDecimals
+	}
+	pow := math.Pow(10, float64(decimals))
+	value = math.Round(value*pow) / pow
+	if value == 0 {
+		//no -0
+		value = 0
+	}
+	text := strconv.FormatFloat(value, 'f', decimals, 64)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	return text
+}
+
+//formatWithUnit is how we show values, 86F or 18.64 mi, temperatures go
+//right after the number
+func formatWithUnit(value float64, symbol string) string {
+	u, _ := findUnit(symbol)
+	if u.Kind == "temperature" {
+		return formatUnitValue(value) + u.Symbol
+	}
+	return formatUnitValue(value) + " " + u.Symbol
+}
+
+var conversionRegexp = regexp.MustCompile(`(?i)(-?\d+(?:\.\d+)?)\s*([^\d?]+?)(?:\s+(?:in|to|into|as)\s+([^\d?]+?))?\s*\??\s*$`)
+
+//parseConversion finds "30C in F", or just "30 km", at the end of the text.
+//To is empty when the text doesn't ask for a unit.
+func parseConversion(text string) (WitConversionResponse, bool) {
+	matches := conversionRegexp.FindStringSubmatch(strings.TrimSpace(text))
+	if matches == nil {
+		return WitConversionResponse{}, false
+	}
+	value, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return WitConversionResponse{}, false
+	}
+	from, ok := findUnit(matches[2])
+	if !ok {
+		return WitConversionResponse{}, false
+	}
+	conversion := WitConversionResponse{Value: value, From: from.Symbol}
+	if matches[3] != "" {
+		to, ok := findUnit(matches[3])
+		if !ok {
+			return WitConversionResponse{}, false
+		}
+		conversion.To = to.Symbol
+	}
+	return conversion, true
+}
+
+//conversionReplies answers "30C in F" with "30C is 86F", and when nobody
+//asked for a unit we use the usual other one, "Which is 86F"
+func conversionReplies(conversion WitConversionResponse) []ChatReply {
+	to := conversion.To
+	passive := to == ""
+	if passive {
+		from, ok := findUnit(conversion.From)
+		if !ok {
+			return []ChatReply{textReply(fmt.Sprintf("I don't know the unit %s", conversion.From))}
+		}
+		to = from.Other
+	}
+	value, err := convertUnits(conversion.Value, conversion.From, to)
+	if err != nil {
+		return []ChatReply{textReply(err.Error())}
+	}
+	if passive {
+		return []ChatReply{textReply("Which is " + formatWithUnit(value, to))}
+	}
+	return []ChatReply{textReply(fmt.Sprintf("%s is %s", formatWithUnit(conversion.Value, conversion.From), formatWithUnit(value, to)))}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestConvertUnits(t *testing.T) {
+	tests := []struct {
+		value    float64
+		from, to string
+		expected string
+	}{
+		{30, "C", "F", "86"},
+		{-40, "F", "C", "-40"},
+		{0, "K", "C", "-273.15"},
+		{98.6, "fahrenheit", "kelvin", "310.15"},
+		{10, "km", "mi", "6.21"},
+		{6, "feet", "m", "1.83"},
+		{1, "kg", "lbs", "2.2"},
+		{1, "gal", "l", "3.79"},
+		{100, "km/h", "mph", "62.14"},
+		{1, "GiB", "MB", "1073.74"},
+		{8, "bits", "B", "1"},
+	}
+	for _, test := range tests {
+		value, err := convertUnits(test.value, test.from, test.to)
+		if err != nil || formatUnitValue(value) != test.expected {
+			t.Errorf("convertUnits(%v, %s, %s) gave %v, %v", test.value, test.from, test.to, value, err)
+		}
+	}
+	_, err := convertUnits(1, "kg", "km")
+	if err == nil {
+		t.Error("convertUnits should not convert weight to length")
+	}
+}
+
+func TestFormatUnitValueDecimals(t *testing.T) {
+	decimals := 0
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.UnitDecimals = &decimals
+	if value := formatUnitValue(6.2137); value != "6" {
+		t.Errorf("formatUnitValue gave %s", value)
+	}
+}
+
+func TestParseConversion(t *testing.T) {
+	conversion, ok := parseConversion("what is 30C in F?")
+	if !ok || conversion != (WitConversionResponse{30, "C", "F"}) {
+		t.Errorf("parseConversion gave %+v", conversion)
+	}
+	conversion, ok = parseConversion("cortex, how much is 12.5 fl oz in ml")
+	if !ok || conversion != (WitConversionResponse{12.5, "fl oz", "ml"}) {
+		t.Errorf("parseConversion gave %+v", conversion)
+	}
+	conversion, ok = parseConversion("it is 72 degrees fahrenheit")
+	if !ok || conversion != (WitConversionResponse{72, "F", ""}) {
+		t.Errorf("parseConversion gave %+v", conversion)
+	}
+	_, ok = parseConversion("turn light 3 on")
+	if ok {
+		t.Error("parseConversion should not find units in turn light 3 on")
+	}
+}
+
+func TestConversionReplies(t *testing.T) {
+	replies := conversionReplies(WitConversionResponse{Value: 30, From: "C", To: "F"})
+	if len(replies) != 1 || replies[0].Text != "30C is 86F" {
+		t.Errorf("conversionReplies gave %+v", replies)
+	}
+	replies = conversionReplies(WitConversionResponse{Value: 10, From: "km"})
+	if len(replies) != 1 || replies[0].Text != "Which is 6.21 mi" {
+		t.Errorf("conversionReplies gave %+v", replies)
+	}
+}
+
+func TestProcessIntentTemperature(t *testing.T) {
+	var intent WitMessage
+	intent.MsgBody = "it is 25 in here"
+	intent.Outcome.Intent = "temperature"
+	intent.Outcome.Entities.Temperature.Value = WitTemperatureValue{Unit: "C", Temperature: 25}
+	ret := ProcessIntent(context.Background(), intent)
+	if ret.Conversion != (WitConversionResponse{25, "C", ""}) {
+		t.Errorf("ProcessIntent gave %+v", ret.Conversion)
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//defaultWebhookAttempts is how many times we try to deliver an event, set
+//maxAttempts on the webhook to change it
+const defaultWebhookAttempts = 5
+
+//deadLettersSize is how many failed deliveries /webhooks/dead-letters shows
+const deadLettersSize = 100
+
+//eventWebhookTest is the event the test-fire endpoint sends
+const eventWebhookTest = "webhook.test"
+
+//webhookQueueSize is how many events can wait for a webhook that is slow or
+//retrying, the ones after that go to the dead letters
+var webhookQueueSize = 1000
+
+//The wait between attempts starts at webhookRetryWait and doubles each time,
+//up to webhookMaxRetryWait
+var webhookRetryWait = time.Second
+var webhookMaxRetryWait = time.Minute
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+//WebhookConfig is where Cortex posts the events, of the Events types and
+//the intent.parsed events of the Intents. With a Secret we sign the body.
+type WebhookConfig struct {
+	URL         string
+	Events      []string
+	Intents     []string
+	Secret      string `cortex:"secret"`
+	MaxAttempts int
+}
+
+//wants tells you if the webhook gets the event, Intents on their own mean
+//intent.parsed
+func (hook WebhookConfig) wants(event cortexEvent) bool {
+	if event.Type == eventIntentParsed && len(hook.Intents) > 0 {
+		parsed, _ := event.Data.(intentParsedEvent)
+		return containsString(hook.Intents, parsed.Intent)
+	}
+	return containsString(hook.Events, event.Type)
+}
+
+func (hook WebhookConfig) eventTypes() []string {
+	types := append([]string{}, hook.Events...)
+	if len(hook.Intents) > 0 && !containsString(types, eventIntentParsed) {
+		types = append(types, eventIntentParsed)
+	}
+	return types
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+//webhookDelivery is how delivering an event to a webhook went
+type webhookDelivery struct {
+	Webhook  string      `json:"webhook"`
+	URL      string      `json:"url"`
+	Event    cortexEvent `json:"event"`
+	Attempts int         `json:"attempts"`
+	Status   int         `json:"status,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	Time     time.Time   `json:"time"`
+}
+
+//webhooksMu guards stopWebhookWorkers, the webhooks restart when their
+//config changes
+var webhooksMu sync.Mutex
+var stopWebhookWorkers context.CancelFunc
+var webhookWorkers sync.WaitGroup
+
+//startWebhooks starts two workers per webhook, one takes the events from
+//its subscription to the event bus and queues them, so a retry doesn't hold
+//up the bus, and the other delivers them in order
+func startWebhooks(hooks map[string]WebhookConfig) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if stopWebhookWorkers != nil {
+		stopWebhookWorkers()
+		webhookWorkers.Wait()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopWebhookWorkers = cancel
+	for name, hook := range hooks {
+		queue := make(chan cortexEvent, webhookQueueSize)
+		sub := events.subscribeDropped(hook.eventTypes(), droppedWebhookEvent(name, hook))
+		webhookWorkers.Add(2)
+		go func(name string, hook WebhookConfig) {
+			defer webhookWorkers.Done()
+			defer events.unsubscribe(sub)
+			queueWebhookEvents(ctx, name, hook, sub, queue)
+		}(name, hook)
+		go func(name string, hook WebhookConfig) {
+			defer webhookWorkers.Done()
+			runWebhook(ctx, name, hook, queue)
+		}(name, hook)
+	}
+}
+
+//stopWebhooks waits for the deliveries in flight, the ones still retrying
+//go to the dead letters
+func stopWebhooks() {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if stopWebhookWorkers != nil {
+		stopWebhookWorkers()
+		webhookWorkers.Wait()
+		stopWebhookWorkers = nil
+	}
+}
+
+//reloadWebhooks is a configReloader
+func reloadWebhooks(old, current CortexConfig) {
+	if !reflect.DeepEqual(old.Webhooks, current.Webhooks) {
+		webhookLog.Infof("Webhooks changed, restarting them")
+		startWebhooks(current.Webhooks)
+	}
+}
+
+//droppedWebhookEvent dead letters the events the event bus couldn't give
+//the webhook
+func droppedWebhookEvent(name string, hook WebhookConfig) func(cortexEvent) {
+	return func(event cortexEvent) {
+		if hook.wants(event) {
+			undelivered(name, hook, event, "the webhook was too far behind, the event bus dropped it")
+		}
+	}
+}
+
+//queueWebhookEvents never waits for the webhook, when its queue is full the
+//event goes to the dead letters
+func queueWebhookEvents(ctx context.Context, name string, hook WebhookConfig, sub *eventSubscription, queue chan<- cortexEvent) {
+	defer close(queue)
+	for {
+		select {
+		case event := <-sub.Events:
+			if !hook.wants(event) {
+				continue
+			}
+			select {
+			case queue <- event:
+			default:
+				undelivered(name, hook, event, fmt.Sprintf("the queue of the webhook was full, with %d events", cap(queue)))
+			}
+		case <-ctx.Done():
+			//the webhook will not get what is still waiting here either
+			for {
+				select {
+				case event := <-sub.Events:
+					if hook.wants(event) {
+						undelivered(name, hook, event, "Cortex stopped before we could deliver it")
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+//runWebhook delivers the queued events until queueWebhookEvents stops, the
+//ones left when Cortex stops go to the dead letters
+func runWebhook(ctx context.Context, name string, hook WebhookConfig, queue <-chan cortexEvent) {
+	for event := range queue {
+		if ctx.Err() != nil {
+			undelivered(name, hook, event, "Cortex stopped before we could deliver it")
+			continue
+		}
+		delivery := deliverWebhook(ctx, name, hook, event)
+		if delivery.Error != "" {
+			deadLetter(delivery)
+		}
+	}
+}
+
+//undelivered dead letters an event we never tried to deliver
+func undelivered(name string, hook WebhookConfig, event cortexEvent, reason string) {
+	webhookDeliveries.inc(name, "dropped")
+	webhookLog.with("webhook", name).with("event", event.ID).Warnf("Not delivering %s to %s: %s", event.Type, name, reason)
+	deadLetter(webhookDelivery{Webhook: name, URL: redactURL(hook.URL), Event: event, Error: reason})
+}
+
+//deliverWebhook posts the event, and tries again with backoff when the
+//webhook is down or answers 5xx, 408 or 429. Error says why we gave up.
+func deliverWebhook(ctx context.Context, name string, hook WebhookConfig, event cortexEvent) webhookDelivery {
+	logger := webhookLog.with("webhook", name).with("event", event.ID)
+	if event.CorrelationID != "" {
+		logger = logger.with("cid", event.CorrelationID)
+	}
+	delivery := webhookDelivery{Webhook: name, URL: redactURL(hook.URL), Event: event}
+	body, err := json.Marshal(event)
+	if err != nil {
+		delivery.Error = err.Error()
+		return delivery
+	}
+	attempts := hook.MaxAttempts
+	if attempts < 1 {
+		attempts = defaultWebhookAttempts
+	}
+	wait := webhookRetryWait
+	for {
+		delivery.Attempts++
+		var retry bool
+		delivery.Status, retry, err = postWebhook(ctx, name, hook, event, body)
+		if err == nil {
+			webhookDeliveries.inc(name, "ok")
+			logger.Debugf("Delivered %s to %s", event.Type, name)
+			delivery.Error = ""
+			return delivery
+		}
+		delivery.Error = err.Error()
+		if !retry || delivery.Attempts >= attempts {
+			break
+		}
+		webhookDeliveries.inc(name, "retry")
+		//Warnf and not Errorf, errors are events too and this one could be
+		//going to this same webhook
+		logger.Warnf("Could not deliver %s to %s, trying again in %v: %v", event.Type, name, wait, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			delivery.Error = "Cortex stopped before we could deliver it, last error: " + delivery.Error
+			return delivery
+		}
+		wait *= 2
+		if wait > webhookMaxRetryWait {
+			wait = webhookMaxRetryWait
+		}
+	}
+	webhookDeliveries.inc(name, "failed")
+	logger.Warnf("Giving up on delivering %s to %s after %d attempts: %s", event.Type, name, delivery.Attempts, delivery.Error)
+	return delivery
+}
+
+//postWebhook sends the event once, retry tells you if it is worth trying
+//again
+func postWebhook(ctx context.Context, name string, hook WebhookConfig, event cortexEvent, body []byte) (int, bool, error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, false, redactURLError(err)
+	}
+	req = req.WithContext(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-cortex")
+	req.Header.Set("X-Cortex-Webhook", name)
+	req.Header.Set("X-Cortex-Event", event.Type)
+	req.Header.Set("X-Cortex-Delivery", strconv.FormatUint(event.ID, 10))
+	req.Header.Set("X-Cortex-Timestamp", timestamp)
+	if hook.Secret != "" {
+		req.Header.Set("X-Cortex-Signature", signWebhook(hook.Secret, timestamp, body))
+	}
+	res, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, true, redactURLError(err)
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		return res.StatusCode, false, nil
+	case res.StatusCode >= 500 || res.StatusCode == http.StatusRequestTimeout || res.StatusCode == http.StatusTooManyRequests:
+		return res.StatusCode, true, fmt.Errorf("%s answered %s", name, res.Status)
+	}
+	return res.StatusCode, false, fmt.Errorf("%s answered %s", name, res.Status)
+}
+
+//redactURL leaves the scheme and host of a webhook url, the path and the
+//query often have a token in them
+func redactURL(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Host == "" {
+		return "(invalid url)"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+//redactURLError takes the url out of the errors of the http client
+func redactURLError(err error) error {
+	if urlErr, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s %s: %v", urlErr.Op, redactURL(urlErr.URL), urlErr.Err)
+	}
+	return err
+}
+
+//signWebhook is the X-Cortex-Signature header, sha256= and the hex HMAC of
+//the timestamp, a dot and the body. The receiver computes the same with
+//the secret and X-Cortex-Timestamp, and rejects old timestamps.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var deadLettersMu sync.Mutex
+var deadLetters []webhookDelivery
+
+//deadLetter keeps the failed delivery for /webhooks/dead-letters, and adds
+//it to WebhookDeadLetterFile as a json line when that is set
+func deadLetter(delivery webhookDelivery) {
+	delivery.Time = time.Now().UTC()
+	deadLettersMu.Lock()
+	defer deadLettersMu.Unlock()
+	deadLetters = append(deadLetters, delivery)
+	if len(deadLetters) > deadLettersSize {
+		deadLetters = deadLetters[len(deadLetters)-deadLettersSize:]
+	}
+
+	name := currentConfig().WebhookDeadLetterFile
+	if name == "" {
+		return
+	}
+	line, _ := json.Marshal(delivery)
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err == nil {
+		_, err = file.Write(append(line, '\n'))
+		file.Close()
+	}
+	if err != nil {
+		webhookLog.Warnf("Could not write to the dead letter file %s: %v", name, err)
+	}
+}
+
+func getDeadLetters() []webhookDelivery {
+	deadLettersMu.Lock()
+	defer deadLettersMu.Unlock()
+	return append([]webhookDelivery{}, deadLetters...)
+}
+
+type webhookInfo struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Events      []string `json:"events,omitempty"`
+	Intents     []string `json:"intents,omitempty"`
+	Signed      bool     `json:"signed"`
+	MaxAttempts int      `json:"maxAttempts"`
+}
+
+//WebhooksHandler lists the webhooks on /webhooks and the failed deliveries
+//on /webhooks/dead-letters. POST /webhooks/test?name=ci sends ci a
+//webhook.test event, once, and tells you how it went.
+func WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	if !passwordAuthorized(w, r) {
+		return
+	}
+	hooks := currentConfig().Webhooks
+	switch r.URL.Path {
+	case "/webhooks":
+		infos := []webhookInfo{}
+		for name, hook := range hooks {
+			attempts := hook.MaxAttempts
+			if attempts < 1 {
+				attempts = defaultWebhookAttempts
+			}
+			infos = append(infos, webhookInfo{name, redactURL(hook.URL), hook.Events, hook.Intents, hook.Secret != "", attempts})
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+		writeDashboardJSON(w, http.StatusOK, infos)
+	case "/webhooks/dead-letters":
+		writeDashboardJSON(w, http.StatusOK, getDeadLetters())
+	case "/webhooks/test":
+		if r.Method != "POST" {
+			writeDashboardJSON(w, http.StatusMethodNotAllowed, dashboardError{"use POST"})
+			return
+		}
+		name := r.FormValue("name")
+		hook, ok := hooks[name]
+		if !ok {
+			writeDashboardJSON(w, http.StatusNotFound, dashboardError{fmt.Sprintf("there is no webhook called %q", name)})
+			return
+		}
+		ctx := requestContext(w, r)
+		event := cortexEvent{
+			Type:          eventWebhookTest,
+			Time:          time.Now().UTC(),
+			CorrelationID: correlationID(ctx),
+			Data:          map[string]string{"message": "Test event from Cortex"},
+		}
+		hook.MaxAttempts = 1
+		delivery := deliverWebhook(ctx, name, hook, event)
+		code := http.StatusOK
+		if delivery.Error != "" {
+			code = http.StatusBadGateway
+		}
+		writeDashboardJSON(w, code, delivery)
+	default:
+		http.NotFound(w, r)
+	}
+}
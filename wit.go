@@ -2,33 +2,57 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 )
 
 const WIT_VERSION = "20140510"
 
+//witDefaultAPIURL is used when the config doesn't set WitAPIURL
+const witDefaultAPIURL = "https://api.wit.ai"
+
+//witClient gives up on Wit after a while, so a hung request doesn't keep a
+//command, and the shutdown waiting for it, running forever
+var witClient = &http.Client{Timeout: 30 * time.Second}
+
+func witAPIURL() string {
+	if apiURL := currentConfig().WitAPIURL; apiURL != "" {
+		return strings.TrimSuffix(apiURL, "/")
+	}
+	return witDefaultAPIURL
+}
+
 //WitHandler is am http request handler that looks for the "q" query parameter
 //and sends it to Wit for processing.
 func WitHandler(w http.ResponseWriter, r *http.Request) {
 	//read the "q" GET query parameter and pass it to
 	// the wit service
 	message := r.FormValue("q")
+	if !beginCommand() {
+		http.Error(w, "Cortex is stopping", http.StatusServiceUnavailable)
+		return
+	}
+	defer endCommand()
+	ctx := requestContext(w, r)
 	if len(message) > 0 {
-		intent, err := FetchIntent(message)
+		_, ret, err := runCommand(ctx, "http", r.RemoteAddr, message)
 		if err != nil {
-			log.Printf("Error: %+v", err)
+			witLog.withContext(ctx).Errorf("Error: %+v", err)
 		} else {
-			ret := ProcessIntent(intent)
 			//print what we understood from your request to the browser.
 			msg := fmt.Sprintf("Turning light %v %s", ret.Arduino.Light, ret.Arduino.Action)
-			fmt.Fprintf(w, msg)
+			if ret.Reply != "" {
+				msg = ret.Reply
+			}
+			fmt.Fprint(w, msg)
 		}
 
 	} else {
@@ -36,166 +60,258 @@ func WitHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//runCommand is what /wit and the dashboard do with a command, send it to
+//Wit and run the intent, channel and sender are for the metrics and the
+//recent commands, and undo and history go by them too
+func runCommand(ctx context.Context, channel, sender, text string) (WitMessage, WitResponse, error) {
+	events.publish(ctx, eventCommandReceived, commandReceivedEvent{Channel: channel, Sender: sender, Text: text})
+	intent, err := FetchIntent(ctx, text)
+	countCommand(channel, intent, err)
+	if err != nil {
+		recentCommands.add(newCommandRecord(channel, sender, text, intent, nil, err))
+		return intent, WitResponse{}, err
+	}
+	publishIntent(ctx, channel, text, intent)
+	key := callerHistoryKey(channel, sender)
+	var ret WitResponse
+	if replies, ok := historyReplies(ctx, key, intent); ok {
+		var lines []string
+		for _, reply := range replies {
+			lines = append(lines, reply.Text)
+		}
+		ret.Reply = strings.Join(lines, "\n")
+	} else {
+		ret = ProcessIntent(ctx, intent)
+		userHistories.record(key, historyEntry{Text: text, Actions: ret.Actions})
+	}
+	recentCommands.add(newCommandRecord(channel, sender, text, intent, commandReplies(ret), nil))
+	return intent, ret, nil
+}
+
+//commandReplies is what we would answer on a chat, without looking up
+//issues, which needs to know the channel
+func commandReplies(ret WitResponse) []ChatReply {
+	if len(ret.Issues.keys) > 0 || ret.Issues.Action != "" {
+		return nil
+	}
+	return chatReplies(context.Background(), ret, ChatMessage{})
+}
+
 //FetchIntent is the whole go wit wrapper, if you call it that.
 //We send the query string to wit, parse the result json
 //into a struct and return it.
-func FetchIntent(str string) (WitMessage, error) {
-
+func FetchIntent(ctx context.Context, str string) (WitMessage, error) {
+	logger := witLog.withContext(ctx)
 	str, err := sanitizeQuerryString(str)
 	if err != nil {
+		logger.Warnf("Somebody talked too much, more than the 256 characters I can read.")
 		return WitMessage{}, err
 	}
 
-	url := fmt.Sprintf("https://api.wit.ai/message?v=%s&q=%s", WIT_VERSION, str)
-	client := &http.Client{}
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", config.WitAccessToken))
-	res, err := client.Do(req)
+	url := fmt.Sprintf("%s/message?v=%s&q=%s", witAPIURL(), WIT_VERSION, str)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		logger.Errorf("Could not build the request to wit: %v", err)
+		return WitMessage{}, errors.New("Sorry, I could not reach the machine learning service I use for my brain, please try again in a bit.")
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", currentConfig().WitAccessToken))
+	start := time.Now()
+	res, err := witClient.Do(req)
 
 	if err != nil {
-		log.Fatalf("Requesting wit's api gave: %v", err)
+		timeNLU("message", start, err)
+		logger.Errorf("Requesting wit's api gave: %v", err)
+		return WitMessage{}, errors.New("Sorry, I could not reach the machine learning service I use for my brain, please try again in a bit.")
 	}
 
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		log.Println("Something went really wrong with the response from Wit.ai")
+		timeNLU("message", start, fmt.Errorf("Wit gave status code %d", res.StatusCode))
+		logger.Errorf("Something went really wrong with the response from Wit.ai, status code %d", res.StatusCode)
 		errMsg := "Sorry, the machine learning service I use for my brain went down, @Diego: check the logs, there may be something for you there."
 		return WitMessage{}, errors.New(errMsg)
 	}
-	return ProcessWitResponse(res.Body), nil
+	timeNLU("message", start, nil)
+	return ProcessWitResponse(ctx, res.Body), nil
 }
 
 func sanitizeQuerryString(str string) (string, error) {
 	if len(url.QueryEscape(str)) > 255 {
-		log.Println("Somebody talked too much, more than the 256 characters I can read.")
 		errMsg := "Sorry, I can only read up to 256 characters and I didn't want to just ignore the end of your message."
 		return "", errors.New(errMsg)
 	}
 	return url.QueryEscape(str), nil
 }
 
-//FetchVoiceIntent is like FetchIntent, but sends a wav file
+//FetchVoiceIntent is like FetchIntent, but sends a wav (or mp3) file
 // to the speech endpoint, Wit extracts the text from the sound file
 //and then returns a json response with all the info we need.
-func FetchVoiceIntent(filePath string) (WitMessage, error) {
-	log.Println("reading file")
+func FetchVoiceIntent(ctx context.Context, filePath string) (WitMessage, error) {
+	logger := witLog.withContext(ctx)
+	logger.Debugf("Reading voice memo %s", filePath)
 	body, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		log.Printf("error: %v reading file", err)
+		logger.Errorf("Could not read voice memo %s: %v", filePath, err)
 	}
 	if len(body) == 0 {
 		return WitMessage{}, errors.New("no sound in file")
 	}
 
-	url := "https://api.wit.ai/speech"
-	client := &http.Client{}
-	req, _ := http.NewRequest("POST", url, bytes.NewReader(body))
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", config.WitAccessToken))
+	url := witAPIURL() + "/speech"
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		logger.Errorf("Could not build the request to wit: %v", err)
+		return WitMessage{}, errors.New("Sorry, I could not reach the machine learning service I use for my brain, please try again in a bit.")
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", currentConfig().WitAccessToken))
 	req.Header.Add("Accept", fmt.Sprintf("application/vnd.wit.%s+json", WIT_VERSION))
-	req.Header.Add("Content-Type", "audio/wav")
-	log.Println("sending request")
-	res, err := client.Do(req)
+	req.Header.Add("Content-Type", voiceContentType(filePath))
+	logger.Debugf("Sending voice memo %s to Wit", filePath)
+	start := time.Now()
+	res, err := witClient.Do(req)
+	if err != nil {
+		timeNLU("speech", start, err)
+		logger.Errorf("Requesting wit's api gave: %v", err)
+		return WitMessage{}, errors.New("Sorry, I could not reach the machine learning service I use for my brain, please try again in a bit.")
+	}
 	defer res.Body.Close()
 
-	if err != nil {
-		log.Fatalf("Requesting wit's api gave: %v", err)
+	if res.StatusCode != 200 {
+		timeNLU("speech", start, fmt.Errorf("Wit gave status code %d", res.StatusCode))
+	} else {
+		timeNLU("speech", start, nil)
 	}
 	if res.StatusCode == 401 {
-		log.Fatalln("Access denied, check your wit access token ")
+		logger.Errorf("Access denied, check your wit access token")
+		return WitMessage{}, errors.New("Sorry, the machine learning service I use for my brain didn't let me in.")
+	} else if res.StatusCode != 200 {
+		logger.Errorf("Wit's speech api gave status code %+v", res.StatusCode)
+		return WitMessage{}, errors.New("Sorry, I could not understand that sound file.")
 	}
 
-	return ProcessWitResponse(res.Body), nil
+	return ProcessWitResponse(ctx, res.Body), nil
+
+}
 
+//voiceContentType picks the Content-Type for the speech endpoint, Wit
+//takes wav and mp3 files
+func voiceContentType(filePath string) string {
+	if strings.HasSuffix(strings.ToLower(filePath), ".mp3") {
+		return "audio/mpeg3"
+	}
+	return "audio/wav"
 }
 
 //ProcessWitResponse gets the raw response from the http request, and
 //returns a WitMessage with all the information we got from Wit
-func ProcessWitResponse(message io.ReadCloser) WitMessage {
+func ProcessWitResponse(ctx context.Context, message io.ReadCloser) WitMessage {
+	logger := witLog.withContext(ctx)
 	intent, _ := ioutil.ReadAll(message)
 
-	jsonString := string(intent[:])
-	_ = jsonString
-
 	var jsonResponse WitMessage
 	err := json.Unmarshal(intent, &jsonResponse)
 	if err != nil {
-		log.Println("error parsing json: ", err)
-		log.Printf("plain text json was %+v", jsonString)
+		logger.with("body", string(intent)).Errorf("Error parsing the json Wit gave us: %v", err)
 	}
 
-	var numbers []WitNumber
-	var number WitNumber
-
-	err = json.Unmarshal(jsonResponse.Outcome.Entities.RawGithub, &numbers)
-	if err != nil {
-		//log.Println("1 error parsing number json: ", err)
-		//log.Println("string number object is: ", string(jsonResponse.Outcome.Entities.RawGithub))
-		err = json.Unmarshal(jsonResponse.Outcome.Entities.RawGithub, &number)
-		if err != nil {
-			//log.Println("2 error parsing number json: ", err)
-		} else {
-			jsonResponse.Outcome.Entities.MultipleNumber = []WitNumber{number}
+	var all struct {
+		Outcome struct {
+			Entities map[string]interface{}
 		}
+	}
+	if json.Unmarshal(intent, &all) == nil {
+		jsonResponse.Outcome.AllEntities = all.Outcome.Entities
+	}
 
-	} else {
+	//the github entity is either a list of numbers or a single one
+	var numbers []WitNumber
+	var number WitNumber
+	if json.Unmarshal(jsonResponse.Outcome.Entities.RawGithub, &numbers) == nil {
 		jsonResponse.Outcome.Entities.MultipleNumber = numbers
+	} else if json.Unmarshal(jsonResponse.Outcome.Entities.RawGithub, &number) == nil {
+		jsonResponse.Outcome.Entities.MultipleNumber = []WitNumber{number}
 	}
 
-	//log.Printf("a: %+v\n\n\n", jsonResponse)
-	//log.Printf("b: %+v\n\n\n", jsonString)
-
+	logger.with("intent", jsonResponse.Outcome.Intent).with("confidence", jsonResponse.Outcome.Confidence).Debugf("Wit understood %q", jsonResponse.MsgBody)
 	return jsonResponse
-
 }
 
 //ProcessIntent gets the json parsed result from wit.ai and
 //depending on the intent, it calles the right service.
 //So far we only have one service, the Arduino lights service
-func ProcessIntent(jsonResponse WitMessage) WitResponse {
+func ProcessIntent(ctx context.Context, jsonResponse WitMessage) WitResponse {
+	witLog.withContext(ctx).with("intent", jsonResponse.Outcome.Intent).Infof("Running intent %s", jsonResponse.Outcome.Intent)
 	switch jsonResponse.Outcome.Intent {
 	case "lights":
-
-		for _, row := range jsonResponse.Outcome.Entities.MultipleNumber {
-
-			light := row.Value
-			action := jsonResponse.Outcome.Entities.OnOff.Value
-			Arduino(action, light)
-			msg := fmt.Sprintf("Turning light %v %s", light, action)
-			_ = msg
-			return WitResponse{
-				WitArduinoResponse{light, action},
-				WitTemperatureResponse{},
-				WitGithubResponse{},
-				witError{},
+		var ret WitResponse
+		for _, light := range desiredLights(jsonResponse) {
+			ret.Actions = append(ret.Actions, switchLight(ctx, light.Light, light.Action))
+			if ret.Arduino.Action == "" {
+				ret.Arduino = light
+			}
+		}
+		return ret
+	case "temperature", "convert":
+		//"what is 30C in F" asks for a unit, otherwise we use the entity
+		conversion, ok := parseConversion(jsonResponse.MsgBody)
+		if !ok && jsonResponse.Outcome.Entities.Temperature.Value.Unit != "" {
+			conversion = WitConversionResponse{
+				Value: jsonResponse.Outcome.Entities.Temperature.Value.Temperature,
+				From:  jsonResponse.Outcome.Entities.Temperature.Value.Unit,
 			}
 		}
-	case "temperature":
-		unit := jsonResponse.Outcome.Entities.Temperature.Value.Unit
-		temperature := jsonResponse.Outcome.Entities.Temperature.Value.Temperature
 		return WitResponse{
-			WitArduinoResponse{},
-			WitTemperatureResponse{unit, temperature},
-			WitGithubResponse{},
-			witError{},
+			Conversion: conversion,
+		}
+	case "github", "github_close", "github_label":
+		issues := WitIssuesResponse{
+			keys: issueKeys(jsonResponse.MsgBody, jsonResponse.Outcome.Entities.MultipleNumber),
 		}
-	case "github":
-		var issues []int
-		for _, row := range jsonResponse.Outcome.Entities.MultipleNumber {
-			//log.Printf("1\n\n%+v\n\n", len(jsonResponse.Outcome.Entities.MultipleNumber))
-			//log.Printf("2\n\n%+v\n\n", row)
-			issues = append(issues, row.Value)
+		switch jsonResponse.Outcome.Intent {
+		case "github_close":
+			issues.Action = "close"
+		case "github_label":
+			issues.Action = "label"
+			issues.Label = jsonResponse.Outcome.Entities.Label.Value
 		}
 		return WitResponse{
-			WitArduinoResponse{},
-			WitTemperatureResponse{},
-			WitGithubResponse{issues},
-			witError{},
+			Issues: issues,
+		}
+	case "create_issue":
+		return WitResponse{
+			Issues: WitIssuesResponse{
+				Action: "create",
+				New:    newIssueFromText(jsonResponse.MsgBody, jsonResponse.Outcome.Entities.Label.Value),
+			},
+		}
+	default:
+		if action, ok := currentConfig().Actions[jsonResponse.Outcome.Intent]; ok {
+			return WitResponse{
+				Reply: runAction(ctx, jsonResponse, action),
+			}
 		}
-
 	}
 	return WitResponse{}
 }
 
+//desiredLights gives you the lights a lights intent asks for, and what to
+//do with them, without touching the Arduino
+func desiredLights(jsonResponse WitMessage) []WitArduinoResponse {
+	if jsonResponse.Outcome.Intent != "lights" {
+		return nil
+	}
+	numbers := jsonResponse.Outcome.Entities.MultipleNumber
+	if len(numbers) == 0 && jsonResponse.Outcome.Entities.SingleNumber.Body != "" {
+		numbers = []WitNumber{jsonResponse.Outcome.Entities.SingleNumber}
+	}
+	action := jsonResponse.Outcome.Entities.OnOff.Value
+	var lights []WitArduinoResponse
+	for _, row := range numbers {
+		lights = append(lights, WitArduinoResponse{row.Value, action})
+	}
+	return lights
+}
+
 //These make up the different parts of the wit result
 //There are more options, but I'm using only these so far.
 
@@ -214,16 +330,19 @@ type WitMessageOutcome struct {
 	Intent     string
 	Entities   WitMessageEntities
 	Confidence float64
+	//AllEntities has every entity as Wit sent it, for the HTTP actions
+	AllEntities map[string]interface{} `json:"-"`
 }
 
 //WitMessageEntities contains all the possible entities we process from Wit
 type WitMessageEntities struct {
 	Location       WitLocation
-	OnOff          WitOnOff
+	OnOff          WitOnOff        `json:"on_off"`
 	RawGithub      json.RawMessage `json:"github_issue"`
 	MultipleNumber []WitNumber
 	SingleNumber   WitNumber `json:"number"`
 	Temperature    WitTemperature
+	Label          WitLabel `json:"github_label"`
 }
 
 //WitLocation is the Location entity
@@ -240,6 +359,12 @@ type WitOnOff struct {
 	Value string
 }
 
+//WitLabel is the github_label entity, the bug in "label 45 as bug"
+type WitLabel struct {
+	Value string
+	Body  string
+}
+
 //WitNumber is the wit/number entity
 type WitNumber struct {
 	End   int
@@ -259,15 +384,19 @@ type WitTemperature struct {
 //WitTemperatureValue is the actual value and unit
 type WitTemperatureValue struct {
 	Unit        string
-	Temperature int
+	Temperature float64
 }
 
 //WitResponse holds just the information you need to act on each intent
 type WitResponse struct {
-	Arduino     WitArduinoResponse
-	Temperature WitTemperatureResponse
-	Github      WitGithubResponse
-	Error       witError
+	Arduino    WitArduinoResponse
+	Conversion WitConversionResponse
+	Issues     WitIssuesResponse
+	Error      witError
+	//Actions are the lights we switched, so they can be reverted
+	Actions []lightAction
+	//Reply is the answer of an HTTP action from the config
+	Reply string
 }
 
 //WitArduinoResponse gives you the light number and a string representing on/off for the light number
@@ -276,15 +405,22 @@ type WitArduinoResponse struct {
 	Action string
 }
 
-//WitTemperatureResponse gives you the Unit and degrees
-type WitTemperatureResponse struct {
-	Unit    string
-	Degrees int
+//WitConversionResponse is a value to convert From a unit, To is empty when
+//nobody asked for one and we answer with the usual other unit
+type WitConversionResponse struct {
+	Value float64
+	From  string
+	To    string
 }
 
-//WitGithubResponse gives you a slice of issue numbers
-type WitGithubResponse struct {
-	issues []int
+//WitIssuesResponse gives you the issue keys, 45 or PROJ-123, Action is
+//empty when we only look them up, or close/label/create. New is the issue
+//to create.
+type WitIssuesResponse struct {
+	keys   []string
+	Action string
+	Label  string
+	New    trackerIssue
 }
 
 type witError struct {
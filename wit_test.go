@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type NopCloser struct {
@@ -15,7 +19,7 @@ func (NopCloser) Close() error { return nil }
 func TestProcessWitResponseGithubMultipleIssues(t *testing.T) {
 
 	withJSON := stringToReadeClosser(githubMultipleIssues)
-	numbers := ProcessWitResponse(withJSON).Outcome.Entities.MultipleNumber
+	numbers := ProcessWitResponse(context.Background(), withJSON).Outcome.Entities.MultipleNumber
 
 	if len(numbers) != 2 {
 		t.Errorf("ProcessWitResponse didn't parse the 'numbers' array. We got %+v\n", numbers)
@@ -25,7 +29,7 @@ func TestProcessWitResponseGithubMultipleIssues(t *testing.T) {
 func TestProcessWitResponseGithubSingleIssue(t *testing.T) {
 
 	withJSON := stringToReadeClosser(githubSingleIssue)
-	number := ProcessWitResponse(withJSON).Outcome.Entities.MultipleNumber
+	number := ProcessWitResponse(context.Background(), withJSON).Outcome.Entities.MultipleNumber
 
 	if len(number) != 1 {
 		t.Errorf("ProcessWitResponse didn't parse the 'number' object. We got %+v\n", number)
@@ -39,7 +43,7 @@ func TestProcessWitResponseGithubSingleIssue(t *testing.T) {
 func TestProcessWitResponseSingleLight(t *testing.T) {
 
 	withJSON := stringToReadeClosser(lightPayload)
-	number := ProcessWitResponse(withJSON).Outcome.Entities.SingleNumber
+	number := ProcessWitResponse(context.Background(), withJSON).Outcome.Entities.SingleNumber
 
 	if number.Value != 1 {
 		t.Errorf("ProcessWitResponse didn't parse the 'number' object. We got %+v\n", number)
@@ -62,6 +66,26 @@ func TestSanitizeQuerryStringStringLen(t *testing.T) {
 	}
 }
 
+func TestFetchIntentCanceled(t *testing.T) {
+	hung := make(chan struct{})
+	wit := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer wit.Close()
+	defer close(hung)
+	oldConfig := config
+	defer func() { config = oldConfig }()
+	config.WitAPIURL = wit.URL
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := FetchIntent(ctx, "turn light 3 on")
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("FetchIntent gave %v after %v", err, time.Since(start))
+	}
+}
+
 const string300 = (`245485328217529591072968367825520430801937353549236235032205454278011159517553408301117871215897624083557692321819508308225339640853054008672033271569751783199322357002915818244872430853340789879400481978383988517251094914866992168126566388692301329752249123938027308855068750472072224632356977779896`)
 
 const string254 = (`24548532821752959107296836782552043080193735354923623503220545427801115951755340830111787121589762408s3557692362408s355769232181950830822533964085305400867203327156975178319932235700291581824487243085334078987940048197838398851725109497222463235697777989`)